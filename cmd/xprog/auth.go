@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Environment variable holding the passphrase of encrypted private keys.
+const passphraseEnv = "XPROG_SSH_PASSPHRASE"
+
+// The IdentityFile entries tried by OpenSSH when none is configured.
+var defaultIdentityFiles = []string{
+	"~/.ssh/id_rsa",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/id_ecdsa_sk",
+	"~/.ssh/id_ed25519",
+	"~/.ssh/id_ed25519_sk",
+}
+
+// sshAuth collects the keys to authenticate with, in the order of OpenSSH: the
+// keys of the IdentityFile entries, each preceded by its certificates, then the
+// other keys of the ssh-agent (unless IdentitiesOnly). A key also held by the
+// agent is used via the agent, so that it needs no passphrase.
+type sshAuth struct {
+	signers   []ssh.Signer
+	agentConn net.Conn
+}
+
+// newSshAuth returns the sshAuth for host. Call Close when done.
+func newSshAuth(host Host, log hclog.Logger) (*sshAuth, error) {
+	self := &sshAuth{}
+	agentSigners, err := self.connectAgent(host, log)
+	if err != nil {
+		return nil, err
+	}
+	inAgent := map[string]ssh.Signer{}
+	for _, signer := range agentSigners {
+		inAgent[string(signer.PublicKey().Marshal())] = signer
+	}
+
+	files := host.GetAll("IdentityFile")
+	explicit := len(files) > 0
+	if !explicit {
+		files = defaultIdentityFiles
+	}
+
+	// Identities, from the IdentityFile entries.
+	var identities []ssh.Signer
+	used := map[string]bool{}
+	certFiles := host.GetAll("CertificateFile")
+	for _, file := range files {
+		if file == "none" {
+			continue
+		}
+		file, err := expandTilde(file)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := loadIdentity(file, inAgent)
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			continue
+		}
+		if err != nil {
+			log.Warn("skipping IdentityFile", "err", err)
+			continue
+		}
+		pubKey := string(signer.PublicKey().Marshal())
+		if used[pubKey] {
+			continue
+		}
+		used[pubKey] = true
+		log.Debug("identity", "file", file, "agent", inAgent[pubKey] != nil,
+			"key", ssh.FingerprintSHA256(signer.PublicKey()))
+		identities = append(identities, signer)
+		if _, err := os.Stat(file + "-cert.pub"); err == nil {
+			certFiles = append(certFiles, file+"-cert.pub")
+		}
+	}
+	if !strings.EqualFold(host.GetDef("IdentitiesOnly", "no"), "yes") {
+		for _, signer := range agentSigners {
+			if !used[string(signer.PublicKey().Marshal())] {
+				identities = append(identities, signer)
+			}
+		}
+	}
+
+	// Certificates, paired with the identity holding their private key.
+	certs := map[string][]*ssh.Certificate{}
+	for _, file := range certFiles {
+		cert, err := loadCertificate(file)
+		if err != nil {
+			log.Warn("skipping CertificateFile", "err", err)
+			continue
+		}
+		pubKey := string(cert.Key.Marshal())
+		certs[pubKey] = append(certs[pubKey], cert)
+	}
+
+	for _, signer := range identities {
+		for _, cert := range certs[string(signer.PublicKey().Marshal())] {
+			certSigner, err := ssh.NewCertSigner(cert, signer)
+			if err != nil {
+				return nil, fmt.Errorf("certificate %s: %s", cert.KeyId, err)
+			}
+			log.Debug("certificate", "id", cert.KeyId,
+				"key", ssh.FingerprintSHA256(signer.PublicKey()))
+			self.signers = append(self.signers, certSigner)
+		}
+		self.signers = append(self.signers, signer)
+	}
+
+	if len(self.signers) == 0 {
+		self.Close()
+		return nil, errors.New("no usable key (IdentityFile, CertificateFile, ssh-agent)")
+	}
+	return self, nil
+}
+
+// connectAgent connects to the ssh-agent designated by IdentityAgent or by the
+// environment variable SSH_AUTH_SOCK and returns its signers. No agent is not
+// an error.
+func (self *sshAuth) connectAgent(host Host, log hclog.Logger) ([]ssh.Signer, error) {
+	sock := host.GetDef("IdentityAgent", "SSH_AUTH_SOCK")
+	if sock == "SSH_AUTH_SOCK" {
+		sock = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if sock == "" || sock == "none" {
+		return nil, nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		log.Debug("ssh-agent not available", "err", err)
+		return nil, nil
+	}
+	self.agentConn = conn
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, fmt.Errorf("ssh-agent %s: %s", sock, err)
+	}
+	log.Debug("ssh-agent", "socket", sock, "keys", len(signers))
+	return signers, nil
+}
+
+// Methods returns the authentication methods to use in ssh.ClientConfig.
+func (self *sshAuth) Methods() []ssh.AuthMethod {
+	return []ssh.AuthMethod{ssh.PublicKeys(self.signers...)}
+}
+
+// Close closes the connection to the ssh-agent, if any.
+func (self *sshAuth) Close() error {
+	if self.agentConn == nil {
+		return nil
+	}
+	return self.agentConn.Close()
+}
+
+// loadIdentity returns the signer for the private key at path. If the agent
+// holds the key, as told by the public key next to it, the agent signer is
+// returned and the private key is not read.
+func loadIdentity(path string, inAgent map[string]ssh.Signer) (ssh.Signer, error) {
+	if pub, err := os.ReadFile(path + ".pub"); err == nil {
+		if pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pub); err == nil {
+			if signer, ok := inAgent[string(pubKey.Marshal())]; ok {
+				return signer, nil
+			}
+		}
+	}
+
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := parsePrivateKey(path, pem)
+	if err != nil {
+		return nil, err
+	}
+	if agentSigner, ok := inAgent[string(signer.PublicKey().Marshal())]; ok {
+		return agentSigner, nil
+	}
+	return signer, nil
+}
+
+// parsePrivateKey parses the private key at path, decrypting it if needed.
+func parsePrivateKey(path string, pem []byte) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(pem)
+	var missingErr *ssh.PassphraseMissingError
+	if !errors.As(err, &missingErr) {
+		if err != nil {
+			return nil, fmt.Errorf("private key %s: %s", path, err)
+		}
+		return signer, nil
+	}
+
+	passphrase, err := readPassphrase(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("private key %s: %s", path, err)
+	}
+	return signer, nil
+}
+
+// readPassphrase returns the passphrase of the encrypted key at path, from the
+// environment variable XPROG_SSH_PASSPHRASE or, if not set, from the program
+// named by SSH_ASKPASS.
+func readPassphrase(path string) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(passphraseEnv); ok {
+		return []byte(passphrase), nil
+	}
+	askpass := os.Getenv("SSH_ASKPASS")
+	if askpass == "" {
+		return nil, fmt.Errorf("private key %s is encrypted: set %s or SSH_ASKPASS",
+			path, passphraseEnv)
+	}
+	prompt := fmt.Sprintf("Enter passphrase for key '%s':", path)
+	out, err := exec.Command(askpass, prompt).Output()
+	if err != nil {
+		return nil, fmt.Errorf("private key %s: SSH_ASKPASS %s: %s", path, askpass, err)
+	}
+	return bytes.TrimRight(out, "\r\n"), nil
+}
+
+// loadCertificate reads the OpenSSH certificate at path.
+func loadCertificate(path string) (*ssh.Certificate, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: %s", path, err)
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("certificate %s: not a certificate", path)
+	}
+	return cert, nil
+}
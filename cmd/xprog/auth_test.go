@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type testKey struct {
+	priv   ed25519.PrivateKey
+	signer ssh.Signer
+}
+
+func newTestKey(t *testing.T) testKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{priv: priv, signer: signer}
+}
+
+// writeKey writes the private key (encrypted if passphrase is not empty) to
+// path and the public key to path.pub.
+func (self testKey) writeKey(t *testing.T, path string, passphrase string) {
+	t.Helper()
+	var block *pem.Block
+	var err error
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(self.priv, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(self.priv, "",
+			[]byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pub := ssh.MarshalAuthorizedKey(self.signer.PublicKey())
+	if err := os.WriteFile(path+".pub", pub, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (self testKey) fingerprint() string {
+	return ssh.FingerprintSHA256(self.signer.PublicKey())
+}
+
+// startAgent serves an ssh-agent holding keys and returns its socket path.
+func startAgent(t *testing.T, keys ...testKey) string {
+	t.Helper()
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key.priv}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	return sock
+}
+
+func signerFingerprints(signers []ssh.Signer) []string {
+	var fps []string
+	for _, signer := range signers {
+		if cert, ok := signer.PublicKey().(*ssh.Certificate); ok {
+			fps = append(fps, "cert:"+ssh.FingerprintSHA256(cert.Key))
+			continue
+		}
+		fps = append(fps, ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+	return fps
+}
+
+func TestSshAuth(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("SSH_ASKPASS", "")
+	plain := newTestKey(t)
+	plain.writeKey(t, filepath.Join(dir, "plain"), "")
+	encrypted := newTestKey(t)
+	encrypted.writeKey(t, filepath.Join(dir, "encrypted"), "secret")
+	agentOnly := newTestKey(t)
+	certified := newTestKey(t)
+	certified.writeKey(t, filepath.Join(dir, "certified"), "")
+
+	// A certificate for key certified, found by the -cert.pub convention.
+	ca := newTestKey(t)
+	cert := &ssh.Certificate{
+		Key:         certified.signer.PublicKey(),
+		KeyId:       "test",
+		CertType:    ssh.UserCert,
+		ValidBefore: uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca.signer); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "certified-cert.pub"),
+		ssh.MarshalAuthorizedKey(cert), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := startAgent(t, encrypted, agentOnly)
+
+	testCases := []struct {
+		name       string
+		host       Host
+		passphrase string
+		want       []string
+	}{
+		{
+			name: "IdentityFile entries in order",
+			host: Host{
+				"identityagent": {"none"},
+				"identityfile": {
+					filepath.Join(dir, "plain"),
+					filepath.Join(dir, "nonexisting"),
+					filepath.Join(dir, "certified"),
+				},
+			},
+			want: []string{
+				plain.fingerprint(),
+				"cert:" + certified.fingerprint(),
+				certified.fingerprint(),
+			},
+		},
+		{
+			name: "encrypted key, passphrase from environment",
+			host: Host{
+				"identityagent": {"none"},
+				"identityfile":  {filepath.Join(dir, "encrypted")},
+			},
+			passphrase: "secret",
+			want:       []string{encrypted.fingerprint()},
+		},
+		{
+			name: "encrypted key, wrong passphrase",
+			host: Host{
+				"identityagent": {"none"},
+				"identityfile": {
+					filepath.Join(dir, "encrypted"),
+					filepath.Join(dir, "plain"),
+				},
+			},
+			passphrase: "wrong",
+			want:       []string{plain.fingerprint()},
+		},
+		{
+			name: "agent keys after IdentityFile, encrypted key via agent",
+			host: Host{
+				"identityagent": {sock},
+				"identityfile": {
+					filepath.Join(dir, "plain"),
+					filepath.Join(dir, "encrypted"),
+				},
+			},
+			want: []string{
+				plain.fingerprint(),
+				encrypted.fingerprint(),
+				agentOnly.fingerprint(),
+			},
+		},
+		{
+			name: "IdentitiesOnly skips the other agent keys",
+			host: Host{
+				"identityagent":  {sock},
+				"identitiesonly": {"yes"},
+				"identityfile":   {filepath.Join(dir, "encrypted")},
+			},
+			want: []string{encrypted.fingerprint()},
+		},
+		{
+			name: "agent from SSH_AUTH_SOCK, no default identity files",
+			host: Host{},
+			want: []string{encrypted.fingerprint(), agentOnly.fingerprint()},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SSH_AUTH_SOCK", sock)
+			if tc.passphrase != "" {
+				t.Setenv(passphraseEnv, tc.passphrase)
+			}
+
+			sut, err := newSshAuth(tc.host, hclog.NewNullLogger())
+			if err != nil {
+				t.Fatalf("error: have: %s; want: <no error>", err)
+			}
+			defer sut.Close()
+
+			if diff := cmp.Diff(signerFingerprints(sut.signers), tc.want); diff != "" {
+				t.Fatalf("\nsigners mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSshAuthNoKeys(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	_, err := newSshAuth(Host{}, hclog.NewNullLogger())
+
+	have := "<no error>"
+	if err != nil {
+		have = err.Error()
+	}
+	if want := "no usable key (IdentityFile, CertificateFile, ssh-agent)"; have != want {
+		t.Fatalf("error: have: %s; want: %s", have, want)
+	}
+}
+
+func TestReadPassphraseAskpass(t *testing.T) {
+	askpass := filepath.Join(t.TempDir(), "askpass")
+	script := "#!/bin/sh\necho \"secret for $1\"\n"
+	if err := os.WriteFile(askpass, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(passphraseEnv, "") // restored at the end of the test
+	os.Unsetenv(passphraseEnv)
+	t.Setenv("SSH_ASKPASS", askpass)
+
+	have, err := readPassphrase("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "secret for Enter passphrase for key 'key':"; string(have) != want {
+		t.Fatalf("have: %q; want: %q", have, want)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+)
+
+// Default size bound of the binary cache of the target.
+const defaultBinCacheSize = "1GiB"
+
+// binCache is the cache of test binaries on the target, in directory
+// $XDG_CACHE_HOME/xprog/bin (default ~/.cache/xprog/bin). Each binary is named
+// by its SHA-256, so that an unchanged test binary, as with go test -count=N or
+// when rebuilding other packages, is not uploaded again. The least recently
+// used binaries are evicted when the cache exceeds its size.
+type binCache struct {
+	dir   string
+	limit int64
+	log   hclog.Logger
+	// Runs a helper command on the target, returning its standard output.
+	remote func(cmd string) (string, error)
+}
+
+// binCacheEntry is a binary of the cache, as listed by binCache.List.
+type binCacheEntry struct {
+	name string
+	size int64
+}
+
+// openBinCache creates, if needed, the binary cache of the target.
+func (self SshCmd) openBinCache(conn *ssh.Client) (*binCache, error) {
+	cache := &binCache{
+		limit: self.binCacheSize,
+		log:   self.opts.logger,
+		remote: func(cmd string) (string, error) {
+			return self.remoteOutput(conn, cmd)
+		},
+	}
+	dir, err := cache.remote(`dir="${XDG_CACHE_HOME:-$HOME/.cache}/xprog/bin" && ` +
+		`mkdir -p "$dir" && cd "$dir" && pwd`)
+	if err != nil {
+		return nil, err
+	}
+	cache.dir = dir
+	return cache, nil
+}
+
+// uploadTestBinary copies the test binary to dst on the target, taking it from
+// the binary cache of the target if there, else uploading it, as a delta
+// against the previous version if possible, and storing it in the cache. A
+// failure of the cache or of the delta is not fatal: the binary is uploaded in
+// full.
+func (self SshCmd) uploadTestBinary(conn *ssh.Client, sf *sftpTransfer,
+	tools map[string]bool, dst string) error {
+	log := self.opts.logger
+	comp := self.compression(tools)
+	if self.NoBinCache {
+		return self.sendTestBinary(conn, sf, dst, comp)
+	}
+	sum, err := fileSHA256(self.TestBinary)
+	if err != nil {
+		return fmt.Errorf("scp TestBinary: %s", err)
+	}
+	cache, err := self.openBinCache(conn)
+	if err != nil {
+		log.Warn("bin cache: not available", "err", err)
+		return self.sendTestBinary(conn, sf, dst, comp)
+	}
+	hit, err := cache.Fetch(sum, dst)
+	if err != nil {
+		log.Warn("bin cache: fetch", "err", err)
+	}
+	if hit {
+		log.Debug("bin cache: hit, not uploading TestBinary", "sha256", sum,
+			"dir", cache.dir)
+		return nil
+	}
+	log.Debug("bin cache: miss", "sha256", sum, "dir", cache.dir)
+	sent := false
+	if !self.NoDelta {
+		if sent, err = self.sendDelta(conn, cache, dst, tools, comp); err != nil {
+			log.Warn("delta: failed, uploading in full", "err", err)
+		}
+	}
+	if !sent {
+		if err := self.sendTestBinary(conn, sf, dst, comp); err != nil {
+			return err
+		}
+	}
+	if err := cache.Store(dst, sum); err != nil {
+		log.Warn("bin cache: store", "err", err)
+	}
+	if !self.NoDelta {
+		self.saveDeltaBase()
+	}
+	return nil
+}
+
+// Fetch copies the binary with SHA-256 sum from the cache to dst, reporting
+// whether it was there. If sha256sum is available on the target, the content
+// is verified and a corrupted binary is removed.
+func (self *binCache) Fetch(sum string, dst string) (bool, error) {
+	path := shellQuote(self.dir + "/" + sum)
+	cmd := fmt.Sprintf(`f=%s
+[ -f "$f" ] || exit 0
+if command -v sha256sum >/dev/null 2>&1; then
+  [ "$(sha256sum < "$f" | cut -d ' ' -f 1)" = %s ] || { rm -f "$f"; exit 0; }
+fi
+{ ln -f "$f" %[3]s 2>/dev/null || cp "$f" %[3]s; } && touch "$f" && echo hit`,
+		path, sum, shellQuote(dst))
+	out, err := self.remote(cmd)
+	if err != nil {
+		return false, err
+	}
+	return out == "hit", nil
+}
+
+// Store copies src, with SHA-256 sum, to the cache, atomically since several
+// xprog can share the cache, then evicts the least recently used binaries.
+func (self *binCache) Store(src string, sum string) error {
+	path := self.dir + "/" + sum
+	tmp := fmt.Sprintf("%s/.%s.$$", shellQuote(self.dir), sum)
+	cmd := fmt.Sprintf("cp %s %s && mv -f %[2]s %s", shellQuote(src), tmp,
+		shellQuote(path))
+	if _, err := self.remote(cmd); err != nil {
+		return err
+	}
+	entries, err := self.List()
+	if err != nil {
+		return err
+	}
+	evict := binCacheEvictions(entries, self.limit, sum)
+	if len(evict) == 0 {
+		return nil
+	}
+	self.log.Debug("bin cache: evict", "binaries", len(evict))
+	args := []string{"rm", "-f"}
+	for _, name := range evict {
+		args = append(args, self.dir+"/"+name)
+	}
+	_, err = self.remote(shellJoin(args))
+	return err
+}
+
+// List returns the binaries of the cache, most recently used first.
+func (self *binCache) List() ([]binCacheEntry, error) {
+	cmd := fmt.Sprintf(`cd %s && for f in $(ls -t); do echo "$(wc -c < "$f") $f"; done`,
+		shellQuote(self.dir))
+	out, err := self.remote(cmd)
+	if err != nil {
+		return nil, err
+	}
+	var entries []binCacheEntry
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !isSHA256(fields[1]) {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, binCacheEntry{name: fields[1], size: size})
+	}
+	return entries, nil
+}
+
+// binCacheEvictions returns the entries, most recently used first, to remove so
+// that the cache fits in limit bytes: once an entry does not fit, it and all
+// the older ones. Entry keep, just stored, is never evicted.
+func binCacheEvictions(entries []binCacheEntry, limit int64, keep string) []string {
+	var total int64
+	for _, entry := range entries {
+		if entry.name == keep {
+			total = entry.size
+		}
+	}
+	var evict []string
+	full := false
+	for _, entry := range entries {
+		if entry.name == keep {
+			continue
+		}
+		if full || total+entry.size > limit {
+			full = true
+			evict = append(evict, entry.name)
+			continue
+		}
+		total += entry.size
+	}
+	return evict
+}
+
+// fileSHA256 returns the SHA-256 of the file at path, in hex.
+func fileSHA256(path string) (string, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fi.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fi); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func isSHA256(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
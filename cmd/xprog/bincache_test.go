@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestBinCacheEvictions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		entries []binCacheEntry // most recently used first
+		limit   int64
+		keep    string
+		want    []string
+	}{
+		{
+			name:    "empty",
+			limit:   10,
+			keep:    "a",
+			entries: nil,
+		},
+		{
+			name:    "fits",
+			entries: []binCacheEntry{{"a", 4}, {"b", 3}, {"c", 3}},
+			limit:   10,
+			keep:    "a",
+		},
+		{
+			name:    "the oldest do not fit",
+			entries: []binCacheEntry{{"a", 4}, {"b", 3}, {"c", 4}, {"d", 1}},
+			limit:   10,
+			keep:    "a",
+			want:    []string{"c", "d"},
+		},
+		{
+			name:    "kept even if too big",
+			entries: []binCacheEntry{{"a", 20}, {"b", 3}},
+			limit:   10,
+			keep:    "a",
+			want:    []string{"b"},
+		},
+		{
+			name:    "kept even if not the most recent",
+			entries: []binCacheEntry{{"b", 8}, {"a", 4}, {"c", 1}},
+			limit:   10,
+			keep:    "a",
+			want:    []string{"b", "c"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			have := binCacheEvictions(tc.entries, tc.limit, tc.keep)
+
+			if diff := cmp.Diff(have, tc.want); diff != "" {
+				t.Errorf("evictions mismatch (-have, +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSshCmdRunBinCache(t *testing.T) {
+	sshConfig, home := startShellServer(t)
+	cacheDir := filepath.Join(home, ".cache", "xprog", "bin")
+	run := func(testBinary string) (string, string) {
+		t.Helper()
+		var logs, stdout strings.Builder
+		sut := SshCmd{
+			CommonArgs:   CommonArgs{TestBinary: testBinary},
+			SshConfig:    sshConfig,
+			BinCacheSize: "100B",
+			opts: Opts{logger: hclog.New(&hclog.LoggerOptions{
+				Output: &logs,
+				Level:  hclog.Debug,
+			})},
+			stdout: &stdout,
+			stderr: io.Discard,
+		}
+		if err := sut.Run(sut.opts); err != nil {
+			t.Fatal(err)
+		}
+		return stdout.String(), logs.String()
+	}
+	cached := func() []string {
+		t.Helper()
+		entries, err := os.ReadDir(cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	binary1 := writeTestBinary(t, "echo one\n")
+	sum1, err := fileSHA256(binary1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, logs := run(binary1)
+	if !strings.Contains(logs, "bin cache: miss") {
+		t.Errorf("first run: want a miss; logs:\n%s", logs)
+	}
+	if diff := cmp.Diff(cached(), []string{sum1}); diff != "" {
+		t.Errorf("cache mismatch (-have, +want):\n%s", diff)
+	}
+
+	stdout, logs := run(binary1)
+	if !strings.Contains(logs, "bin cache: hit") {
+		t.Errorf("second run: want a hit; logs:\n%s", logs)
+	}
+	if have, want := stdout, "one\n"; have != want {
+		t.Errorf("stdout: have: %q; want: %q", have, want)
+	}
+
+	// A corrupted binary is not used.
+	writeFiles(t, cacheDir, map[string]string{sum1: "#!/bin/sh\necho corrupted\n"})
+	stdout, logs = run(binary1)
+	if !strings.Contains(logs, "bin cache: miss") {
+		t.Errorf("corrupted: want a miss; logs:\n%s", logs)
+	}
+	if have, want := stdout, "one\n"; have != want {
+		t.Errorf("stdout: have: %q; want: %q", have, want)
+	}
+
+	// The two binaries do not fit in 100 bytes.
+	binary2 := writeTestBinary(t, "echo two; # "+strings.Repeat("x", 60)+"\n")
+	sum2, err := fileSHA256(binary2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(binary2)
+	if diff := cmp.Diff(cached(), []string{sum2}); diff != "" {
+		t.Errorf("cache mismatch (-have, +want):\n%s", diff)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/ssh"
+)
+
+// compression is a compression of the uploads, with the command decompressing
+// its standard input on the target.
+type compression struct {
+	name       string
+	decompress string
+	writer     func(w io.Writer) (io.WriteCloser, error)
+}
+
+// compressions are in order of preference.
+var compressions = []compression{
+	{
+		name:       "zstd",
+		decompress: "zstd -d -c -q",
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	},
+	{
+		name:       "gzip",
+		decompress: "gzip -d -c",
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+	},
+}
+
+// remoteTools returns the helper programs found on the target, among those
+// that the transfers can use.
+func (self SshCmd) remoteTools(conn *ssh.Client) (map[string]bool, error) {
+	out, err := self.remoteOutput(conn, "for tool in scp tar zstd gzip dd sha256sum; do "+
+		"command -v $tool >/dev/null 2>&1 && echo $tool; done; true")
+	if err != nil {
+		return nil, err
+	}
+	tools := map[string]bool{}
+	for _, tool := range strings.Fields(out) {
+		tools[tool] = true
+	}
+	return tools, nil
+}
+
+// checkCompress validates --compress.
+func (self SshCmd) checkCompress() error {
+	switch self.Compress {
+	case "", "auto", "none", "zstd", "gzip":
+		return nil
+	}
+	return fmt.Errorf("--compress %s: want auto, zstd, gzip or none", self.Compress)
+}
+
+// compression returns the compression of the uploads according to --compress
+// and the tools of the target, nil for none. If the target lacks the
+// requested one, the uploads are not compressed.
+func (self SshCmd) compression(tools map[string]bool) *compression {
+	log := self.opts.logger
+	if self.Compress == "none" {
+		return nil
+	}
+	for _, comp := range compressions {
+		switch {
+		case self.Compress != "" && self.Compress != "auto" && self.Compress != comp.name:
+			continue
+		case tools[comp.name]:
+			return &comp
+		case self.Compress == comp.name:
+			log.Warn("compress: not available on target, not compressing",
+				"compress", comp.name, "target", self.addr)
+		}
+	}
+	return nil
+}
+
+// remoteWrite writes src to file dst on the target, compressed with comp in
+// transit (if not nil), in at most timeout.
+func remoteWrite(conn *ssh.Client, dst string, src io.Reader, comp *compression,
+	timeout time.Duration) error {
+	cmd := "cat > " + shellQuote(dst)
+	if comp != nil {
+		cmd = comp.decompress + " > " + shellQuote(dst)
+	}
+	sess, err := conn.NewSession()
+	if err != nil {
+		return fmt.Errorf("%s: %s", cmd, err)
+	}
+	defer sess.Close()
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("%s: %s", cmd, err)
+	}
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	if err := sess.Start(cmd); err != nil {
+		return fmt.Errorf("%s: %s", cmd, err)
+	}
+	timer := time.AfterFunc(timeout, func() { sess.Close() })
+
+	var w io.WriteCloser = stdin
+	if comp != nil {
+		if w, err = comp.writer(stdin); err != nil {
+			timer.Stop()
+			return fmt.Errorf("%s: %s", comp.name, err)
+		}
+	}
+	_, copyErr := io.Copy(w, src)
+	if comp != nil {
+		if err := w.Close(); copyErr == nil {
+			copyErr = err
+		}
+	}
+	stdin.Close()
+	waitErr := sess.Wait()
+	if !timer.Stop() {
+		return fmt.Errorf("%s: timeout %s expired", cmd, timeout)
+	}
+	if waitErr != nil {
+		return fmt.Errorf("%s: %s: %s", cmd, waitErr, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if copyErr != nil {
+		return fmt.Errorf("%s: %s", cmd, copyErr)
+	}
+	return nil
+}
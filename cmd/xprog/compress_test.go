@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestSshCmdCompression(t *testing.T) {
+	all := map[string]bool{"zstd": true, "gzip": true}
+	testCases := []struct {
+		compress string
+		tools    map[string]bool
+		want     string // empty for none
+	}{
+		{compress: "", tools: all, want: "zstd"},
+		{compress: "auto", tools: map[string]bool{"gzip": true}, want: "gzip"},
+		{compress: "auto", tools: nil},
+		{compress: "gzip", tools: all, want: "gzip"},
+		{compress: "zstd", tools: map[string]bool{"gzip": true}},
+		{compress: "none", tools: all},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.compress, func(t *testing.T) {
+			sut := SshCmd{Compress: tc.compress, opts: Opts{logger: hclog.NewNullLogger()}}
+
+			comp := sut.compression(tc.tools)
+
+			have := ""
+			if comp != nil {
+				have = comp.name
+			}
+			if have != tc.want {
+				t.Errorf("have: %q; want: %q", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestSshCmdCheckCompress(t *testing.T) {
+	sut := SshCmd{Compress: "lz4"}
+
+	err := sut.checkCompress()
+
+	want := "--compress lz4: want auto, zstd, gzip or none"
+	if err == nil || err.Error() != want {
+		t.Errorf("error: have: %v; want: %s", err, want)
+	}
+}
+
+func TestSshCmdRunCompressed(t *testing.T) {
+	sshConfig, _ := startShellServer(t)
+	testBinary := writeTestBinary(t, "echo compressed\n")
+	var logs, stdout strings.Builder
+	sut := SshCmd{
+		CommonArgs: CommonArgs{TestBinary: testBinary},
+		SshConfig:  sshConfig,
+		NoBinCache: true,
+		Compress:   "gzip",
+		opts: Opts{logger: hclog.New(&hclog.LoggerOptions{
+			Output: &logs,
+			Level:  hclog.Debug,
+		})},
+		stdout: &stdout,
+		stderr: io.Discard,
+	}
+
+	if err := sut.Run(sut.opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(logs.String(), "compress=gzip") {
+		t.Errorf("want a gzip upload; logs:\n%s", logs.String())
+	}
+	if have, want := stdout.String(), "compressed\n"; have != want {
+		t.Errorf("stdout: have: %q; want: %q", have, want)
+	}
+}
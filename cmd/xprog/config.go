@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Name of the project configuration file.
+const configName = "xprog.yaml"
+
+// Config is the project configuration, read from file xprog.yaml. It provides
+// the defaults of the command-line options, so that the configuration can be
+// versioned with the module and go test -exec=xprog works from any package.
+type Config struct {
+	// Subcommand when xprog is invoked without one, as by go test -exec=xprog.
+	Command string `yaml:"command"`
+	// Environment variables for the test binary.
+	Env map[string]string `yaml:"env"`
+	Ssh SshOptions        `yaml:"ssh"`
+	// Named targets, reached via the ssh subcommand.
+	Targets map[string]Target `yaml:"targets"`
+	// The first route matching the package selects its targets.
+	Routes []Route `yaml:"routes"`
+	//
+	path   string
+	target string // selected by Apply
+}
+
+// SshOptions are the defaults of the options of the ssh subcommand.
+type SshOptions struct {
+	// Relative to the directory of the configuration file.
+	Cfg        string   `yaml:"cfg"`
+	Host       string   `yaml:"host"`
+	Sudo       bool     `yaml:"sudo"`
+	Upload     []string `yaml:"upload"`
+	SyncBack   []string `yaml:"sync-back"`
+	KeepRemote bool     `yaml:"keep-remote"`
+	// Host paths, relative to the directory of the configuration file too.
+	GoCoverDir     string `yaml:"gocoverdir"`
+	GoCoverProfile string `yaml:"gocoverprofile"`
+	// With a matrix of targets: group or prefix.
+	MatrixOutput string `yaml:"matrix-output"`
+	// Durations such as 30s or 2m; MinThroughput is a size such as 1MiB.
+	ConnectTimeout  time.Duration `yaml:"connect-timeout"`
+	UploadTimeout   time.Duration `yaml:"upload-timeout"`
+	DownloadTimeout time.Duration `yaml:"download-timeout"`
+	RunTimeout      time.Duration `yaml:"run-timeout"`
+	MinThroughput   string        `yaml:"min-throughput"`
+	BinCacheSize    string        `yaml:"bin-cache-size"`
+	NoBinCache      bool          `yaml:"no-bin-cache"`
+	NoDelta         bool          `yaml:"no-delta"`
+	Compress        string        `yaml:"compress"`
+	Transport       string        `yaml:"transport"`
+}
+
+// findConfig looks for the configuration file in dir and its parents, up to the
+// module root, the directory holding go.mod. It returns the empty string if not
+// found.
+func findConfig(dir string) (string, error) {
+	for {
+		path := filepath.Join(dir, configName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("config: %s", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return "", nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// loadConfig reads the configuration file at path. Unknown keys are an error,
+// to catch typos.
+func loadConfig(path string) (*Config, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+	defer fi.Close()
+	self := &Config{path: path}
+	dec := yaml.NewDecoder(fi)
+	dec.KnownFields(true)
+	if err := dec.Decode(self); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("config %s: %s", path, err)
+	}
+
+	switch self.Command {
+	case "", "direct", "ssh":
+	default:
+		return nil, fmt.Errorf("config %s: command: unknown subcommand '%s' (want direct or ssh)",
+			path, self.Command)
+	}
+	self.Ssh.Cfg = self.resolve(self.Ssh.Cfg)
+	self.Ssh.GoCoverDir = self.resolve(self.Ssh.GoCoverDir)
+	self.Ssh.GoCoverProfile = self.resolve(self.Ssh.GoCoverProfile)
+	for name, target := range self.Targets {
+		if name == "" || strings.ContainsAny(name, ",= ") {
+			return nil, fmt.Errorf("config %s: target '%s': invalid name", path, name)
+		}
+		target.Cfg = self.resolve(target.Cfg)
+		self.Targets[name] = target
+	}
+	for i, route := range self.Routes {
+		if route.Packages == "" {
+			return nil, fmt.Errorf("config %s: routes[%d]: missing packages", path, i)
+		}
+		if _, err := self.selectTargets(route.Target); err != nil {
+			return nil, fmt.Errorf("config %s: routes[%d]: %s", path, i, err)
+		}
+	}
+	return self, nil
+}
+
+// resolve returns path relative to the directory of the configuration file.
+func (self *Config) resolve(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(self.path), path)
+}
+
+// splitGlobalArgs splits args into the options of Opts, before the subcommand,
+// and the rest.
+func splitGlobalArgs(args []string) ([]string, []string) {
+	i := 0
+	for i < len(args) {
+		switch args[i] {
+		case "-v", "--verbose", "-h", "--help", "--version", "--matrix":
+			i++
+		case "--target":
+			i = min(i+2, len(args))
+		default:
+			if !strings.HasPrefix(args[i], "--target=") {
+				return args[:i], args[i:]
+			}
+			i++
+		}
+	}
+	return args[:i], args[i:]
+}
+
+// globalTarget returns the value of --target in global, else of XPROG_TARGET.
+func globalTarget(global []string) string {
+	sel := os.Getenv("XPROG_TARGET")
+	for i, arg := range global {
+		switch {
+		case arg == "--target" && i+1 < len(global):
+			sel = global[i+1]
+		case strings.HasPrefix(arg, "--target="):
+			sel = strings.TrimPrefix(arg, "--target=")
+		}
+	}
+	return sel
+}
+
+// globalMatrix reports whether --matrix is in global or XPROG_MATRIX is true.
+func globalMatrix(global []string) bool {
+	matrix, _ := strconv.ParseBool(os.Getenv("XPROG_MATRIX"))
+	for _, arg := range global {
+		matrix = matrix || arg == "--matrix"
+	}
+	return matrix
+}
+
+// Args returns args, adding the default subcommand if args starts with the
+// test binary, as when invoked by go test -exec=xprog.
+func (self *Config) Args(args []string) []string {
+	global, rest := splitGlobalArgs(args)
+	if self.Command == "" || len(rest) == 0 {
+		return args
+	}
+	switch first := rest[0]; {
+	case first == "help" || first == "direct" || first == "ssh" || first == "cover" ||
+		first == "mux":
+		return args
+	case len(first) > 0 && first[0] == '-':
+		return args
+	}
+	return append(append(global[:len(global):len(global)], self.Command, "--"), rest...)
+}
+
+// Apply sets in opts the defaults of the subcommand selected by args, to be
+// overridden by the command-line flags and environment variables. For the
+// ssh subcommand, the target selected by --target (or XPROG_TARGET) or by the
+// routes for the package in the working directory replaces ssh.host; if they
+// are several (a matrix), the test binary runs on each of them.
+func (self *Config) Apply(opts *Opts, args []string) error {
+	global, rest := splitGlobalArgs(args)
+	var subcommand string
+	if len(rest) > 0 {
+		subcommand = rest[0]
+	}
+	env := self.EnvList()
+	switch subcommand {
+	case "direct":
+		opts.Direct = &DirectCmd{CommonArgs: CommonArgs{Env: env}}
+	case "ssh":
+		ssh := self.Ssh
+		var matrix []matrixTarget
+		if sel := globalTarget(global); sel != "" || len(self.Routes) > 0 {
+			cwd, err := os.Getwd()
+			if err != nil {
+				return fmt.Errorf("get cwd: %s", err)
+			}
+			names, err := self.TargetsFor(sel, globalMatrix(global), cwd)
+			if err != nil {
+				return fmt.Errorf("config %s: %s", self.path, err)
+			}
+			for _, name := range names {
+				matrix = append(matrix, self.targetOptions(name))
+			}
+			self.target = strings.Join(names, ",")
+		}
+		if len(matrix) == 1 {
+			ssh.Host, ssh.Cfg, ssh.Sudo = matrix[0].host, matrix[0].cfg, matrix[0].sudo
+			matrix = nil
+		}
+		opts.Ssh = &SshCmd{
+			CommonArgs:      CommonArgs{Env: env},
+			SshConfig:       ssh.Cfg,
+			Host:            ssh.Host,
+			Sudo:            ssh.Sudo,
+			Upload:          ssh.Upload,
+			SyncBack:        ssh.SyncBack,
+			KeepRemote:      ssh.KeepRemote,
+			GoCoverDir:      ssh.GoCoverDir,
+			GoCoverProfile:  ssh.GoCoverProfile,
+			MatrixOutput:    ssh.MatrixOutput,
+			ConnectTimeout:  ssh.ConnectTimeout,
+			UploadTimeout:   ssh.UploadTimeout,
+			DownloadTimeout: ssh.DownloadTimeout,
+			RunTimeout:      ssh.RunTimeout,
+			MinThroughput:   ssh.MinThroughput,
+			BinCacheSize:    ssh.BinCacheSize,
+			NoBinCache:      ssh.NoBinCache,
+			NoDelta:         ssh.NoDelta,
+			Compress:        ssh.Compress,
+			Transport:       ssh.Transport,
+			matrix:          matrix,
+		}
+	}
+	return nil
+}
+
+// EnvList returns Env as a list of KEY=VALUE, sorted by key.
+func (self *Config) EnvList() []string {
+	var env []string
+	for key, val := range self.Env {
+		env = append(env, key+"="+val)
+	}
+	sort.Strings(env)
+	return env
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestFindConfig(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"xprog.yaml":             "",
+		"mod/go.mod":             "module example.com/mod\n",
+		"mod/xprog.yaml":         "",
+		"mod/a/b/x.go":           "",
+		"mod/nested/xprog.yaml":  "",
+		"mod/nested/pkg/x.go":    "",
+		"other/go.mod":           "module example.com/other\n",
+		"other/pkg/x.go":         "",
+		"other/pkg/testdata/x.y": "",
+	})
+
+	testCases := []struct {
+		dir  string
+		want string
+	}{
+		{dir: "mod/a/b", want: "mod/xprog.yaml"},
+		{dir: "mod", want: "mod/xprog.yaml"},
+		{dir: "mod/nested/pkg", want: "mod/nested/xprog.yaml"},
+		{dir: "other/pkg", want: ""}, // stops at the module root
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.dir, func(t *testing.T) {
+			have, err := findConfig(filepath.Join(root, tc.dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.want
+			if want != "" {
+				want = filepath.Join(root, want)
+			}
+			if have != want {
+				t.Errorf("have: %s; want: %s", have, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		want     Config // path and Cfg relative to DIR
+		wantErr  string
+	}{
+		{
+			name: "full",
+			contents: `
+command: ssh
+env:
+  B: 2
+  A: "x y"
+ssh:
+  cfg: vm/ssh_config
+  host: debian
+  sudo: true
+  upload: [../shared]
+  sync-back: [testdata]
+  keep-remote: true
+  gocoverdir: build/gocoverdir
+  gocoverprofile: /tmp/integration.out
+  connect-timeout: 30s
+  run-timeout: 10m
+  min-throughput: 1MiB
+  bin-cache-size: 512MiB
+  compress: gzip
+  transport: sftp
+`,
+			want: Config{
+				Command: "ssh",
+				Env:     map[string]string{"A": "x y", "B": "2"},
+				Ssh: SshOptions{
+					Cfg:            "DIR/vm/ssh_config",
+					Host:           "debian",
+					Sudo:           true,
+					Upload:         []string{"../shared"},
+					SyncBack:       []string{"testdata"},
+					KeepRemote:     true,
+					GoCoverDir:     "DIR/build/gocoverdir",
+					GoCoverProfile: "/tmp/integration.out",
+					ConnectTimeout: 30 * time.Second,
+					RunTimeout:     10 * time.Minute,
+					MinThroughput:  "1MiB",
+					BinCacheSize:   "512MiB",
+					Compress:       "gzip",
+					Transport:      "sftp",
+				},
+			},
+		},
+		{
+			name:     "empty",
+			contents: "",
+		},
+		{
+			name:     "absolute cfg",
+			contents: "ssh:\n  cfg: /etc/ssh_config\n",
+			want:     Config{Ssh: SshOptions{Cfg: "/etc/ssh_config"}},
+		},
+		{
+			name:     "unknown key",
+			contents: "ssh:\n  sudoo: true\n",
+			wantErr: "config DIR/xprog.yaml: yaml: unmarshal errors:\n" +
+				"  line 2: field sudoo not found in type main.SshOptions",
+		},
+		{
+			name: "targets and routes",
+			contents: `
+targets:
+  vm1:
+    cfg: vm/ssh_config
+    sudo: true
+    labels: {distro: debian, destructive-ok: true}
+  shared:
+    host: cheap
+routes:
+  - packages: ./netlink/...
+    target: destructive-ok=true
+`,
+			want: Config{
+				Targets: map[string]Target{
+					"vm1": {
+						Cfg:    "DIR/vm/ssh_config",
+						Sudo:   true,
+						Labels: map[string]string{"distro": "debian", "destructive-ok": "true"},
+					},
+					"shared": {Host: "cheap"},
+				},
+				Routes: []Route{{Packages: "./netlink/...", Target: "destructive-ok=true"}},
+			},
+		},
+		{
+			name:     "invalid target name",
+			contents: "targets:\n  a=b: {}\n",
+			wantErr:  "config DIR/xprog.yaml: target 'a=b': invalid name",
+		},
+		{
+			name:     "route without packages",
+			contents: "targets:\n  vm1: {}\nroutes:\n  - target: vm1\n",
+			wantErr:  "config DIR/xprog.yaml: routes[0]: missing packages",
+		},
+		{
+			name:     "route without target",
+			contents: "targets:\n  vm1: {}\nroutes:\n  - packages: ./...\n    target: vm2\n",
+			wantErr:  "config DIR/xprog.yaml: routes[0]: target selector 'vm2': no matching target",
+		},
+		{
+			name:     "unknown command",
+			contents: "command: telnet\n",
+			wantErr:  "config DIR/xprog.yaml: command: unknown subcommand 'telnet' (want direct or ssh)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, configName)
+			if err := os.WriteFile(path, []byte(tc.contents), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			conf, err := loadConfig(path)
+
+			have := "<no error>"
+			if err != nil {
+				have = strings.ReplaceAll(err.Error(), dir, "DIR")
+			}
+			want := tc.wantErr
+			if want == "" {
+				want = "<no error>"
+			}
+			if have != want {
+				t.Fatalf("error: have: %s; want: %s", have, want)
+			}
+			if err != nil {
+				return
+			}
+			tc.want.path = path
+			tc.want.Ssh.Cfg = strings.Replace(tc.want.Ssh.Cfg, "DIR", dir, 1)
+			tc.want.Ssh.GoCoverDir = strings.Replace(tc.want.Ssh.GoCoverDir, "DIR", dir, 1)
+			for name, target := range tc.want.Targets {
+				target.Cfg = strings.Replace(target.Cfg, "DIR", dir, 1)
+				tc.want.Targets[name] = target
+			}
+			if diff := cmp.Diff(*conf, tc.want, cmp.AllowUnexported(Config{})); diff != "" {
+				t.Errorf("\nconfig mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConfigArgs(t *testing.T) {
+	conf := &Config{Command: "ssh"}
+	testCases := []struct {
+		args []string
+		want []string
+	}{
+		{
+			args: []string{"/tmp/go-build1/b001/foo.test", "-test.v=true"},
+			want: []string{"ssh", "--", "/tmp/go-build1/b001/foo.test", "-test.v=true"},
+		},
+		{
+			args: []string{"--target", "vm1", "-v", "foo.test"},
+			want: []string{"--target", "vm1", "-v", "ssh", "--", "foo.test"},
+		},
+		{
+			args: []string{"--target=vm1", "ssh", "foo.test"},
+			want: []string{"--target=vm1", "ssh", "foo.test"},
+		},
+		{
+			args: []string{"direct", "foo.test"},
+			want: []string{"direct", "foo.test"},
+		},
+		{
+			args: []string{"-v", "ssh", "--", "foo.test"},
+			want: []string{"-v", "ssh", "--", "foo.test"},
+		},
+		{
+			args: nil,
+			want: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			if diff := cmp.Diff(conf.Args(tc.args), tc.want); diff != "" {
+				t.Errorf("\nargs mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConfigApplyTarget(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"go.mod": "module example.com/mod\n",
+		"xprog.yaml": `
+ssh:
+  cfg: ssh_config
+  host: shared
+targets:
+  vm1:
+    cfg: vm/ssh_config
+    sudo: true
+    labels: {os: linux, destructive-ok: true}
+  alpine:
+    host: alpine-3
+    labels: {os: linux}
+routes:
+  - packages: ./netlink/...
+    target: destructive-ok=true
+`,
+		"netlink/x.go": "",
+		"other/x.go":   "",
+	})
+	conf, err := loadConfig(filepath.Join(root, configName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name string
+		args []string
+		env  string // XPROG_TARGET
+		dir  string
+		want SshCmd
+		// Names of the targets of the matrix, if any.
+		wantMatrix []string
+	}{
+		{
+			name: "routed",
+			args: []string{"ssh", "foo.test"},
+			dir:  "netlink",
+			want: SshCmd{SshConfig: "vm/ssh_config", Host: "vm1", Sudo: true},
+		},
+		{
+			name: "no route",
+			args: []string{"ssh", "foo.test"},
+			dir:  "other",
+			want: SshCmd{SshConfig: "ssh_config", Host: "shared"},
+		},
+		{
+			name: "flag --target",
+			args: []string{"--target", "alpine", "ssh", "foo.test"},
+			dir:  "netlink",
+			want: SshCmd{SshConfig: "ssh_config", Host: "alpine-3"},
+		},
+		{
+			name: "env XPROG_TARGET",
+			args: []string{"ssh", "foo.test"},
+			env:  "alpine",
+			dir:  "netlink",
+			want: SshCmd{SshConfig: "ssh_config", Host: "alpine-3"},
+		},
+		{
+			name:       "matrix",
+			args:       []string{"--target", "vm1,destructive-ok=true", "--matrix", "ssh", "foo.test"},
+			dir:        "other",
+			want:       SshCmd{SshConfig: "vm/ssh_config", Host: "vm1", Sudo: true},
+			wantMatrix: nil, // a single target is not a matrix
+		},
+		{
+			name:       "matrix of all",
+			args:       []string{"--matrix", "--target=os=linux", "ssh", "foo.test"},
+			dir:        "other",
+			want:       SshCmd{SshConfig: "ssh_config", Host: "shared"},
+			wantMatrix: []string{"alpine", "vm1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("XPROG_TARGET", tc.env)
+			chdir(t, filepath.Join(root, tc.dir))
+			var opts Opts
+
+			if err := conf.Apply(&opts, tc.args); err != nil {
+				t.Fatal(err)
+			}
+
+			var haveMatrix []string
+			for _, target := range opts.Ssh.matrix {
+				haveMatrix = append(haveMatrix, target.name)
+			}
+			if diff := cmp.Diff(haveMatrix, tc.wantMatrix); diff != "" {
+				t.Errorf("\nmatrix mismatch (-have, +want)\n%s", diff)
+			}
+			have := *opts.Ssh
+			have.SshConfig = strings.TrimPrefix(have.SshConfig, root+string(filepath.Separator))
+			if diff := cmp.Diff(have, tc.want, cmpopts.IgnoreUnexported(SshCmd{})); diff != "" {
+				t.Errorf("\nssh mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMainIntWithConfig(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"go.mod": "module example.com/mod\n",
+		"xprog.yaml": `
+command: direct
+env:
+  FROM_CONFIG: yes
+`,
+	})
+	pkgDir := filepath.Join(root, "pkg")
+	if err := os.Mkdir(pkgDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(pkgDir, "pkg.test")
+	contents := "#!/bin/sh\necho \"$FROM_CONFIG $FROM_CLI $*\" > \"$0.out\"\n"
+	if err := os.WriteFile(script, []byte(contents), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, pkgDir)
+
+	testCases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "as go test -exec=xprog",
+			args: []string{script, "-test.v=true"},
+			want: "yes  -test.v=true\n",
+		},
+		{
+			name: "explicit subcommand and flags",
+			args: []string{"direct", "--env", "FROM_CLI=1", "--", script},
+			want: "yes 1 \n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if code := mainInt(&out, tc.args); code != 0 {
+				t.Fatalf("status code: have: %d; want: 0\n%s", code, out.String())
+			}
+			have, err := os.ReadFile(script + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(have) != tc.want {
+				t.Errorf("have: %q; want: %q", have, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type CoverCmd struct {
+	Merge *CoverMergeCmd `arg:"subcommand:merge" help:"merge coverprofiles, for example of several targets or runs"`
+}
+
+type CoverMergeCmd struct {
+	Output  string   `arg:"-o,--output" help:"output file (default: standard output)"`
+	Profile []string `arg:"required,positional" help:"coverprofile, as written by go test -coverprofile"`
+}
+
+func (self CoverCmd) Run(opts Opts) error {
+	switch {
+	case self.Merge != nil:
+		return self.Merge.Run(opts)
+	default:
+		return fmt.Errorf("cover: missing subcommand (merge)")
+	}
+}
+
+func (self CoverMergeCmd) Run(opts Opts) error {
+	opts.logger.Debug("cover merge", "profiles", self.Profile, "output", self.Output)
+	prof, err := readCoverProfiles(self.Profile)
+	if err != nil {
+		return fmt.Errorf("cover merge: %s", err)
+	}
+	var out bytes.Buffer
+	if err := prof.Write(&out); err != nil {
+		return fmt.Errorf("cover merge: %s", err)
+	}
+	if self.Output == "" {
+		_, err = os.Stdout.Write(out.Bytes())
+	} else {
+		err = os.WriteFile(self.Output, out.Bytes(), 0o644)
+	}
+	if err != nil {
+		return fmt.Errorf("cover merge: %s", err)
+	}
+	return nil
+}
+
+// coverProfile is a coverprofile, with the blocks of all the profiles merged
+// into it.
+type coverProfile struct {
+	mode   string // set, count or atomic
+	blocks map[coverBlock]coverCount
+}
+
+// coverBlock is the position of a block: file:startLine.startCol,endLine.endCol.
+type coverBlock struct {
+	file      string
+	startLine int
+	startCol  int
+	endLine   int
+	endCol    int
+}
+
+type coverCount struct {
+	numStmt int
+	count   int64
+}
+
+// mergeCoverProfiles writes to dst the merge of the coverprofiles srcs, that
+// must have the same mode. Each block is the union of the blocks at the same
+// position: for mode set, it is covered if covered in any profile; for modes
+// count and atomic, its count is the sum of the counts. If srcs is empty, dst
+// is not written.
+func mergeCoverProfiles(dst string, srcs []string) error {
+	if len(srcs) == 0 {
+		return nil
+	}
+	prof, err := readCoverProfiles(srcs)
+	if err != nil {
+		return fmt.Errorf("merge coverprofiles: %s", err)
+	}
+	var out bytes.Buffer
+	if err := prof.Write(&out); err != nil {
+		return fmt.Errorf("merge coverprofiles: %s", err)
+	}
+	if err := os.WriteFile(dst, out.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("merge coverprofiles: %s", err)
+	}
+	return nil
+}
+
+// readCoverProfiles reads and merges the coverprofiles at paths.
+func readCoverProfiles(paths []string) (*coverProfile, error) {
+	prof := &coverProfile{blocks: map[coverBlock]coverCount{}}
+	for _, path := range paths {
+		fi, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = prof.Read(fi)
+		fi.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return prof, nil
+}
+
+// Read merges into self the coverprofile read from r.
+func (self *coverProfile) Read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if lineNum == 1 {
+			mode, ok := strings.CutPrefix(line, "mode: ")
+			switch {
+			case !ok:
+				return fmt.Errorf("line 1: want mode: set|count|atomic, have %q", line)
+			case mode != "set" && mode != "count" && mode != "atomic":
+				return fmt.Errorf("line 1: unknown mode %s", mode)
+			case self.mode == "":
+				self.mode = mode
+			case mode != self.mode:
+				return fmt.Errorf("mode %s, want %s", mode, self.mode)
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		block, count, err := parseCoverLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		prev, ok := self.blocks[block]
+		switch {
+		case !ok:
+		case prev.numStmt != count.numStmt:
+			return fmt.Errorf("line %d: %s: %d statements, want %d (profiles of different builds?)",
+				lineNum, block, count.numStmt, prev.numStmt)
+		case self.mode == "set":
+			count.count = max(count.count, prev.count)
+		default:
+			count.count += prev.count
+		}
+		self.blocks[block] = count
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if lineNum == 0 {
+		return fmt.Errorf("empty coverprofile")
+	}
+	return nil
+}
+
+// Write writes the profile, with the blocks sorted by file and position.
+func (self *coverProfile) Write(w io.Writer) error {
+	blocks := make([]coverBlock, 0, len(self.blocks))
+	for block := range self.blocks {
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		a, b := blocks[i], blocks[j]
+		if a.file != b.file {
+			return a.file < b.file
+		}
+		if a.startLine != b.startLine {
+			return a.startLine < b.startLine
+		}
+		if a.startCol != b.startCol {
+			return a.startCol < b.startCol
+		}
+		if a.endLine != b.endLine {
+			return a.endLine < b.endLine
+		}
+		return a.endCol < b.endCol
+	})
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "mode: %s\n", self.mode)
+	for _, block := range blocks {
+		count := self.blocks[block]
+		fmt.Fprintf(bw, "%s %d %d\n", block, count.numStmt, count.count)
+	}
+	return bw.Flush()
+}
+
+func (self coverBlock) String() string {
+	return fmt.Sprintf("%s:%d.%d,%d.%d", self.file, self.startLine, self.startCol,
+		self.endLine, self.endCol)
+}
+
+// parseCoverLine parses a line of a coverprofile:
+// file:startLine.startCol,endLine.endCol numStmt count.
+func parseCoverLine(line string) (coverBlock, coverCount, error) {
+	var block coverBlock
+	var count coverCount
+	invalid := fmt.Errorf("invalid block %q", line)
+	i := strings.LastIndexByte(line, ':')
+	if i <= 0 {
+		return block, count, invalid
+	}
+	block.file = line[:i]
+	fields := strings.Fields(line[i+1:])
+	if len(fields) != 3 {
+		return block, count, invalid
+	}
+	_, err := fmt.Sscanf(fields[0], "%d.%d,%d.%d", &block.startLine, &block.startCol,
+		&block.endLine, &block.endCol)
+	if err != nil {
+		return block, count, invalid
+	}
+	if count.numStmt, err = strconv.Atoi(fields[1]); err != nil {
+		return block, count, invalid
+	}
+	if count.count, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return block, count, invalid
+	}
+	return block, count, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMergeCoverProfiles(t *testing.T) {
+	testCases := []struct {
+		name     string
+		profiles []string
+		want     string
+		wantErr  string
+	}{
+		{
+			name: "set: union",
+			profiles: []string{
+				"mode: set\nx.go:1.1,2.2 1 1\nx.go:3.1,4.2 2 0\n",
+				"mode: set\nx.go:1.1,2.2 1 0\nx.go:3.1,4.2 2 1\ny.go:1.1,2.2 1 0\n",
+			},
+			want: "mode: set\nx.go:1.1,2.2 1 1\nx.go:3.1,4.2 2 1\ny.go:1.1,2.2 1 0\n",
+		},
+		{
+			name: "count: sum",
+			profiles: []string{
+				"mode: count\nx.go:1.1,2.2 1 3\n",
+				"mode: count\nx.go:1.1,2.2 1 0\nx.go:3.1,4.2 2 1\n",
+				"mode: count\nx.go:1.1,2.2 1 4\n",
+			},
+			want: "mode: count\nx.go:1.1,2.2 1 7\nx.go:3.1,4.2 2 1\n",
+		},
+		{
+			name: "atomic: sum, also within a profile",
+			profiles: []string{
+				"mode: atomic\nx.go:3.1,4.2 2 1\nx.go:1.1,2.2 1 2\nx.go:3.1,4.2 2 5\n",
+			},
+			want: "mode: atomic\nx.go:1.1,2.2 1 2\nx.go:3.1,4.2 2 6\n",
+		},
+		{
+			name: "sorted by file and position",
+			profiles: []string{
+				"mode: set\nb.go:10.1,12.2 1 1\na.go:9.5,9.8 1 1\na.go:9.1,9.4 1 0\n",
+			},
+			want: "mode: set\na.go:9.1,9.4 1 0\na.go:9.5,9.8 1 1\nb.go:10.1,12.2 1 1\n",
+		},
+		{
+			name: "different modes",
+			profiles: []string{
+				"mode: count\nx.go:1.1,2.2 1 3\n",
+				"mode: set\nx.go:1.1,2.2 1 1\n",
+			},
+			wantErr: "merge coverprofiles: DIR/1.out: mode set, want count",
+		},
+		{
+			name: "different number of statements",
+			profiles: []string{
+				"mode: count\nx.go:1.1,2.2 1 3\n",
+				"mode: count\n\nx.go:1.1,2.2 2 3\n",
+			},
+			wantErr: "merge coverprofiles: DIR/1.out: line 3: x.go:1.1,2.2: 2 statements, want 1 (profiles of different builds?)",
+		},
+		{
+			name:     "unknown mode",
+			profiles: []string{"mode: random\n"},
+			wantErr:  "merge coverprofiles: DIR/0.out: line 1: unknown mode random",
+		},
+		{
+			name:     "missing mode",
+			profiles: []string{"x.go:1.1,2.2 1 3\n"},
+			wantErr:  `merge coverprofiles: DIR/0.out: line 1: want mode: set|count|atomic, have "x.go:1.1,2.2 1 3"`,
+		},
+		{
+			name:     "invalid block",
+			profiles: []string{"mode: set\nx.go:1.1 1 1\n"},
+			wantErr:  `merge coverprofiles: DIR/0.out: line 2: invalid block "x.go:1.1 1 1"`,
+		},
+		{
+			name:     "empty",
+			profiles: []string{""},
+			wantErr:  "merge coverprofiles: DIR/0.out: empty coverprofile",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var srcs []string
+			for i, contents := range tc.profiles {
+				src := filepath.Join(dir, strconv.Itoa(i)+".out")
+				if err := os.WriteFile(src, []byte(contents), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				srcs = append(srcs, src)
+			}
+			dst := filepath.Join(dir, "cover.out")
+
+			err := mergeCoverProfiles(dst, srcs)
+
+			have := "<no error>"
+			if err != nil {
+				have = strings.ReplaceAll(err.Error(), dir, "DIR")
+			}
+			want := tc.wantErr
+			if want == "" {
+				want = "<no error>"
+			}
+			if have != want {
+				t.Fatalf("error: have: %s; want: %s", have, want)
+			}
+			if err != nil {
+				return
+			}
+			buf, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(buf), tc.want); diff != "" {
+				t.Errorf("\nprofile mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCoverMergeCmd(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.out": "mode: count\nx.go:1.1,2.2 1 3\n",
+		"b.out": "mode: count\nx.go:1.1,2.2 1 2\n",
+	})
+	dst := filepath.Join(dir, "total.out")
+	var out bytes.Buffer
+	args := []string{"cover", "merge", "-o", dst,
+		filepath.Join(dir, "a.out"), filepath.Join(dir, "b.out")}
+
+	if code := mainInt(&out, args); code != 0 {
+		t.Fatalf("status code: have: %d; want: 0\n%s", code, out.String())
+	}
+
+	have, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "mode: count\nx.go:1.1,2.2 1 5\n"; string(have) != want {
+		t.Errorf("have: %q; want: %q", have, want)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Size of the blocks of the base matched by the delta.
+	deltaBlockSize = 4 << 10
+	// Maximum size of a literal read by a single dd on the target.
+	deltaMaxLiteral = 1 << 20
+	// Shorter copies of the base are sent as literals, to save a dd.
+	deltaMinCopy = 4
+	// Each operation runs a dd on the target: above this count, uploading the
+	// binary in full is faster.
+	deltaMaxOps = 256
+)
+
+// deltaOp is an operation of a delta, producing a part of the new file: if
+// n > 0, copy n blocks of the base starting at block; else copy size bytes
+// of the literals, that is of the new file at offset off.
+type deltaOp struct {
+	block int64
+	n     int64
+	off   int64
+	size  int64
+}
+
+// computeDelta returns the delta of data against base, as rsync: the blocks of
+// the base are indexed by their weak rolling checksum, that slides over data
+// byte by byte; a candidate match is then compared byte by byte, since both
+// files are on the host. The parts of data not found in base are literals.
+func computeDelta(base, data []byte, blockSize int) []deltaOp {
+	bs := int64(blockSize)
+	sigs := map[uint32][]int64{}
+	for blk := int64(0); (blk+1)*bs <= int64(len(base)); blk++ {
+		a, b := weakChecksum(base[blk*bs : (blk+1)*bs])
+		key := weakKey(a, b)
+		sigs[key] = append(sigs[key], blk)
+	}
+
+	var ops []deltaOp
+	addLiteral := func(off, end int64) {
+		if off == end {
+			return
+		}
+		if n := len(ops); n > 0 && ops[n-1].n == 0 && ops[n-1].off+ops[n-1].size == off {
+			ops[n-1].size += end - off
+			return
+		}
+		ops = append(ops, deltaOp{off: off, size: end - off})
+	}
+	addBlock := func(blk int64) {
+		if n := len(ops); n > 0 && ops[n-1].n > 0 && ops[n-1].block+ops[n-1].n == blk {
+			ops[n-1].n++
+			return
+		}
+		ops = append(ops, deltaOp{block: blk, n: 1})
+	}
+	// match returns the block of base equal to data at pos, preferring the one
+	// extending the last copy, or -1.
+	match := func(key uint32, pos int64) int64 {
+		found := int64(-1)
+		for _, blk := range sigs[key] {
+			if !bytes.Equal(base[blk*bs:(blk+1)*bs], data[pos:pos+bs]) {
+				continue
+			}
+			if n := len(ops); n > 0 && ops[n-1].n > 0 && ops[n-1].block+ops[n-1].n == blk {
+				return blk
+			}
+			if found == -1 {
+				found = blk
+			}
+		}
+		return found
+	}
+
+	size := int64(len(data))
+	var litStart, pos int64
+	if len(sigs) > 0 && size >= bs {
+		a, b := weakChecksum(data[:bs])
+		for pos+bs <= size {
+			if blk := match(weakKey(a, b), pos); blk != -1 {
+				addLiteral(litStart, pos)
+				addBlock(blk)
+				pos += bs
+				litStart = pos
+				if pos+bs <= size {
+					a, b = weakChecksum(data[pos : pos+bs])
+				}
+				continue
+			}
+			if pos+bs < size {
+				out, in := uint32(data[pos]), uint32(data[pos+bs])
+				a = a - out + in
+				b = b - uint32(bs)*out + a
+			}
+			pos++
+		}
+	}
+	addLiteral(litStart, size)
+	return ops
+}
+
+// weakChecksum returns the two halves of the rsync rolling checksum of block.
+// They are kept modulo 2^32 while rolling, only the low 16 bits matter.
+func weakChecksum(block []byte) (uint32, uint32) {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a, b
+}
+
+func weakKey(a, b uint32) uint32 {
+	return a&0xffff | b<<16
+}
+
+// coalesceDeltaOps returns ops with the copies shorter than minBlocks blocks
+// turned into literals, merged with the neighbouring ones, so that the target
+// runs fewer dd.
+func coalesceDeltaOps(ops []deltaOp, blockSize int, minBlocks int64) []deltaOp {
+	var out []deltaOp
+	var pos int64 // in the new file
+	for _, op := range ops {
+		size := op.size
+		if op.n > 0 {
+			size = op.n * int64(blockSize)
+		}
+		if op.n > 0 && op.n < minBlocks {
+			op = deltaOp{off: pos, size: size}
+		}
+		if n := len(out); n > 0 && op.n == 0 && out[n-1].n == 0 {
+			out[n-1].size += op.size
+		} else {
+			out = append(out, op)
+		}
+		pos += size
+	}
+	return out
+}
+
+// deltaLiteralSize returns the total size of the literals of ops.
+func deltaLiteralSize(ops []deltaOp) int64 {
+	var size int64
+	for _, op := range ops {
+		size += op.size
+	}
+	return size
+}
+
+// deltaScript returns the shell script that, on the target, applies ops to
+// base, reading the literals from file lit, and writes the result to dst, after
+// verifying its size and, if sha256sum is available, its SHA-256 sum. It uses
+// only dd, reading the literals sequentially from its standard input.
+func deltaScript(ops []deltaOp, blockSize int, base, lit, dst string, size int64,
+	sum string) string {
+	var buf strings.Builder
+	tmp := dst + ".delta"
+	fmt.Fprintf(&buf, "set -e\nb=%s\n{\n", shellQuote(base))
+	for _, op := range ops {
+		if op.n > 0 {
+			fmt.Fprintf(&buf, "dd if=\"$b\" bs=%d skip=%d count=%d 2>/dev/null\n",
+				blockSize, op.block, op.n)
+			continue
+		}
+		for left := op.size; left > 0; left -= deltaMaxLiteral {
+			fmt.Fprintf(&buf, "dd bs=%d count=1 2>/dev/null\n", min(left, deltaMaxLiteral))
+		}
+	}
+	fmt.Fprintf(&buf, "} < %s > %s\n", shellQuote(lit), shellQuote(tmp))
+	fmt.Fprintf(&buf, "[ \"$(wc -c < %s)\" -eq %d ]\n", shellQuote(tmp), size)
+	fmt.Fprintf(&buf, "if command -v sha256sum >/dev/null 2>&1; then\n"+
+		"  [ \"$(sha256sum < %s | cut -d ' ' -f 1)\" = %s ]\nfi\n", shellQuote(tmp), sum)
+	fmt.Fprintf(&buf, "chmod 755 %s\nmv -f %[1]s %s\n", shellQuote(tmp), shellQuote(dst))
+	return buf.String()
+}
+
+// sendDelta uploads the test binary to dst as a delta against the previous
+// version uploaded to the target, if both the host (in its cache directory)
+// and the binary cache of the target still have it. It reports whether it did:
+// without a previous version, or if the delta would be too big, the binary
+// must be uploaded in full.
+func (self SshCmd) sendDelta(conn *ssh.Client, cache *binCache, dst string,
+	tools map[string]bool, comp *compression) (bool, error) {
+	log := self.opts.logger
+	basePath := deltaBasePath(self.deltaBaseKey(), path.Base(self.TestBinary))
+	if basePath == "" || !tools["dd"] {
+		log.Debug("delta: not available", "dd", tools["dd"])
+		return false, nil
+	}
+	base, err := os.ReadFile(basePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Debug("delta: no previous version", "path", basePath)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	baseSum, err := fileSHA256(basePath)
+	if err != nil {
+		return false, err
+	}
+	remoteBase := cache.dir + "/" + baseSum
+	if out, err := self.remoteOutput(conn, "[ -f "+shellQuote(remoteBase)+
+		" ] && echo yes; true"); err != nil || out != "yes" {
+		log.Debug("delta: previous version not in target cache", "sha256", baseSum)
+		return false, err
+	}
+	data, err := os.ReadFile(self.TestBinary)
+	if err != nil {
+		return false, err
+	}
+	sum, err := fileSHA256(self.TestBinary)
+	if err != nil {
+		return false, err
+	}
+
+	ops := coalesceDeltaOps(computeDelta(base, data, deltaBlockSize), deltaBlockSize,
+		deltaMinCopy)
+	litSize := deltaLiteralSize(ops)
+	log.Debug("delta", "base", baseSum, "size", formatByteSize(int64(len(data))),
+		"literals", formatByteSize(litSize), "ops", len(ops))
+	if litSize > int64(len(data))*3/4 || len(ops) > deltaMaxOps {
+		log.Debug("delta: too big, uploading in full")
+		return false, nil
+	}
+	var lits bytes.Buffer
+	for _, op := range ops {
+		lits.Write(data[op.off : op.off+op.size])
+	}
+	lit := dst + ".lit"
+	script := dst + ".sh"
+	defer self.remoteRun(conn, "rm -f "+shellQuote(lit)+" "+shellQuote(script))
+	timeout := self.transferTimeout(false, litSize)
+	err = remoteWrite(conn, lit, newProgressReader(log, "TestBinary delta", &lits, litSize),
+		comp, timeout)
+	if err != nil {
+		return false, fmt.Errorf("upload literals (%s, timeout %s): %s",
+			formatByteSize(litSize), timeout, err)
+	}
+	src := deltaScript(ops, deltaBlockSize, remoteBase, lit, dst, int64(len(data)), sum)
+	err = remoteWrite(conn, script, strings.NewReader(src), nil,
+		self.transferTimeout(false, int64(len(src))))
+	if err != nil {
+		return false, fmt.Errorf("upload script: %s", err)
+	}
+	if err := self.remoteRun(conn, "sh "+shellQuote(script)); err != nil {
+		return false, fmt.Errorf("apply: %s", err)
+	}
+	log.Debug("delta: uploaded", "literals", formatByteSize(litSize),
+		"size", formatByteSize(int64(len(data))))
+	return true, nil
+}
+
+// deltaBaseDir returns the directory of the bases in the host cache directory,
+// empty if there is no cache directory.
+func deltaBaseDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "xprog", "delta")
+}
+
+// deltaBasePath returns the path in the host cache directory of the last
+// version of the test binary named name uploaded to the target with key, its
+// host key fingerprint or else its address, the base of the next delta. It is
+// empty if there is no cache directory.
+func deltaBasePath(key string, name string) string {
+	dir := deltaBaseDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, targetCacheName(key), name)
+}
+
+// deltaBaseKey returns the key of the target in the host cache of the delta
+// bases: its host key fingerprint, as the uname cache, so that a target
+// reached by another address or behind the same address after a reinstall is
+// told apart; its address if the host key is unknown.
+func (self SshCmd) deltaBaseKey() string {
+	if self.target != nil && self.target.hostKey != "" {
+		return self.target.hostKey
+	}
+	return self.addr
+}
+
+// saveDeltaBase copies the test binary to the host cache directory, as the
+// base of the next delta, then evicts the least recently saved bases beyond
+// the size of the binary cache. Errors are only logged: it is an optimization.
+func (self SshCmd) saveDeltaBase() {
+	log := self.opts.logger
+	dst := deltaBasePath(self.deltaBaseKey(), path.Base(self.TestBinary))
+	if dst == "" {
+		return
+	}
+	data, err := os.ReadFile(self.TestBinary)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(dst), 0o755)
+	}
+	tmp := fmt.Sprintf("%s.%d", dst, os.Getpid())
+	if err == nil {
+		err = os.WriteFile(tmp, data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Debug("delta: save base", "err", err)
+		return
+	}
+	dir := deltaBaseDir()
+	keep, _ := filepath.Rel(dir, dst)
+	evicted, err := evictDeltaBases(dir, self.binCacheSize, keep)
+	if err != nil {
+		log.Debug("delta: evict bases", "err", err)
+	}
+	if evicted > 0 {
+		log.Debug("delta: evict bases", "count", evicted)
+	}
+}
+
+// evictDeltaBases removes the least recently saved bases below dir so that,
+// as the binary cache of the target, they fit in limit bytes. Base keep, just
+// saved, is never evicted. It returns the number of bases removed.
+func evictDeltaBases(dir string, limit int64, keep string) (int, error) {
+	var entries []binCacheEntry
+	mtimes := map[string]time.Time{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, binCacheEntry{name: rel, size: info.Size()})
+		mtimes[rel] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Most recently used first, as binCache.List.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return mtimes[entries[i].name].After(mtimes[entries[j].name])
+	})
+	evict := binCacheEvictions(entries, limit, keep)
+	for _, name := range evict {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return 0, err
+		}
+	}
+	return len(evict), nil
+}
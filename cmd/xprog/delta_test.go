@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+)
+
+// applyDelta is the reference implementation of the script of deltaScript.
+func applyDelta(base, data []byte, ops []deltaOp, blockSize int) []byte {
+	bs := int64(blockSize)
+	var out []byte
+	for _, op := range ops {
+		if op.n > 0 {
+			out = append(out, base[op.block*bs:(op.block+op.n)*bs]...)
+		} else {
+			out = append(out, data[op.off:op.off+op.size]...)
+		}
+	}
+	return out
+}
+
+func randomBytes(seed int64, size int) []byte {
+	buf := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(buf)
+	return buf
+}
+
+func TestComputeDelta(t *testing.T) {
+	const bs = 16
+	base := randomBytes(1, 10*bs)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	testCases := []struct {
+		name    string
+		base    []byte
+		data    []byte
+		want    []deltaOp
+		wantLit int64
+	}{
+		{
+			name: "identical",
+			base: base,
+			data: base,
+			want: []deltaOp{{block: 0, n: 10}},
+		},
+		{
+			name:    "no base",
+			data:    base,
+			want:    []deltaOp{{off: 0, size: 10 * bs}},
+			wantLit: 10 * bs,
+		},
+		{
+			name:    "shorter than a block",
+			base:    base,
+			data:    base[:bs-1],
+			want:    []deltaOp{{off: 0, size: bs - 1}},
+			wantLit: bs - 1,
+		},
+		{
+			name: "insertion, not aligned",
+			base: base,
+			data: join(base[:3*bs], []byte("hello"), base[3*bs:]),
+			want: []deltaOp{
+				{block: 0, n: 3},
+				{off: 3 * bs, size: 5},
+				{block: 3, n: 7},
+			},
+			wantLit: 5,
+		},
+		{
+			name: "modification and moved blocks",
+			base: base,
+			data: join(base[5*bs:7*bs], []byte("x"), base[bs+1:2*bs], base[:bs]),
+			want: []deltaOp{
+				{block: 5, n: 2},
+				{off: 2 * bs, size: bs},
+				{block: 0, n: 1},
+			},
+			wantLit: bs,
+		},
+		{
+			name: "trailing partial block",
+			base: base,
+			data: join(base, []byte("tail")),
+			want: []deltaOp{
+				{block: 0, n: 10},
+				{off: 10 * bs, size: 4},
+			},
+			wantLit: 4,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			have := computeDelta(tc.base, tc.data, bs)
+
+			if diff := cmp.Diff(have, tc.want, cmp.AllowUnexported(deltaOp{})); diff != "" {
+				t.Errorf("ops mismatch (-have, +want):\n%s", diff)
+			}
+			if have, want := deltaLiteralSize(have), tc.wantLit; have != want {
+				t.Errorf("literal size: have: %d; want: %d", have, want)
+			}
+			if !bytes.Equal(applyDelta(tc.base, tc.data, have, bs), tc.data) {
+				t.Errorf("applied delta differs from data")
+			}
+		})
+	}
+}
+
+func TestCoalesceDeltaOps(t *testing.T) {
+	const bs = 16
+	testCases := []struct {
+		name string
+		ops  []deltaOp
+		want []deltaOp
+	}{
+		{
+			name: "long copies kept",
+			ops:  []deltaOp{{block: 3, n: 4}, {off: 64, size: 5}, {block: 0, n: 9}},
+			want: []deltaOp{{block: 3, n: 4}, {off: 64, size: 5}, {block: 0, n: 9}},
+		},
+		{
+			name: "short copy between literals",
+			ops:  []deltaOp{{off: 0, size: 5}, {block: 7, n: 2}, {off: 37, size: 3}},
+			want: []deltaOp{{off: 0, size: 40}},
+		},
+		{
+			name: "short copies between long ones",
+			ops: []deltaOp{{block: 0, n: 4}, {block: 9, n: 1}, {block: 2, n: 3},
+				{block: 4, n: 6}},
+			want: []deltaOp{{block: 0, n: 4}, {off: 64, size: 64}, {block: 4, n: 6}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			base := randomBytes(4, 10*bs)
+			data := applyDelta(base, randomBytes(5, 200), tc.ops, bs)
+
+			have := coalesceDeltaOps(tc.ops, bs, 4)
+
+			if diff := cmp.Diff(have, tc.want, cmp.AllowUnexported(deltaOp{})); diff != "" {
+				t.Errorf("\nops mismatch (-have, +want)\n%s", diff)
+			}
+			if !bytes.Equal(applyDelta(base, data, have, bs), data) {
+				t.Errorf("applied delta differs from data")
+			}
+		})
+	}
+}
+
+func TestDeltaScript(t *testing.T) {
+	if _, err := exec.LookPath("dd"); err != nil {
+		t.Skip("skip: dd not found")
+	}
+	const bs = 64
+	base := randomBytes(2, 100*bs+7)
+	data := bytes.Join([][]byte{
+		base[50*bs : 90*bs],
+		randomBytes(3, 3*deltaMaxLiteral/2),
+		base[:20*bs+3],
+	}, nil)
+	ops := computeDelta(base, data, bs)
+	var lits bytes.Buffer
+	for _, op := range ops {
+		lits.Write(data[op.off : op.off+op.size])
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"base": string(base), "lit": lits.String()})
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	dst := filepath.Join(dir, "new")
+
+	script := deltaScript(ops, bs, filepath.Join(dir, "base"), filepath.Join(dir, "lit"),
+		dst, int64(len(data)), sum)
+	out, err := exec.Command("/bin/sh", "-c", script).CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("script: %s\n%s", err, out)
+	}
+	have, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, data) {
+		t.Errorf("result differs from data: have %d bytes; want %d", len(have), len(data))
+	}
+}
+
+func TestEvictDeltaBases(t *testing.T) {
+	dir := t.TempDir()
+	ten := strings.Repeat("x", 10)
+	writeFiles(t, dir, map[string]string{
+		"host1_22/a.test": ten,
+		"host1_22/b.test": ten,
+		"host2_22/a.test": ten,
+		"host2_22/c.test": ten,
+	})
+	// From the least recently saved; c.test, just saved, is the oldest.
+	now := time.Now()
+	for i, name := range []string{"host2_22/c.test", "host1_22/b.test",
+		"host1_22/a.test", "host2_22/a.test"} {
+		mtime := now.Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evicted, err := evictDeltaBases(dir, 25, filepath.Join("host2_22", "c.test"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evicted != 2 {
+		t.Errorf("evicted: have: %d; want: 2", evicted)
+	}
+	want := map[string]string{"host2_22/a.test": ten, "host2_22/c.test": ten}
+	if diff := cmp.Diff(readFiles(t, dir), want); diff != "" {
+		t.Errorf("\nfiles mismatch (-have, +want)\n%s", diff)
+	}
+}
+
+func TestSshCmdRunDelta(t *testing.T) {
+	sshConfig, _ := startShellServer(t)
+	// A comment makes the test binary bigger than a few blocks.
+	padding := "# " + strings.Repeat("0123456789abcdef", 4*deltaBlockSize/16) + "\n"
+	run := func(script string) (string, string) {
+		t.Helper()
+		testBinary := writeTestBinary(t, padding+script)
+		var logs, stdout strings.Builder
+		sut := SshCmd{
+			CommonArgs: CommonArgs{TestBinary: testBinary},
+			SshConfig:  sshConfig,
+			Compress:   "gzip",
+			opts: Opts{logger: hclog.New(&hclog.LoggerOptions{
+				Output: &logs,
+				Level:  hclog.Debug,
+			})},
+			stdout: &stdout,
+			stderr: io.Discard,
+		}
+		if err := sut.Run(sut.opts); err != nil {
+			t.Fatalf("%s\nlogs:\n%s", err, logs.String())
+		}
+		return stdout.String(), logs.String()
+	}
+
+	stdout, logs := run("echo one\n")
+	if !strings.Contains(logs, "delta: no previous version") {
+		t.Errorf("first run: want no delta; logs:\n%s", logs)
+	}
+	if have, want := stdout, "one\n"; have != want {
+		t.Errorf("stdout: have: %q; want: %q", have, want)
+	}
+	// The base is keyed on the host key of the target, not on its address.
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bases, err := filepath.Glob(filepath.Join(cacheDir, "xprog", "delta", "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bases) != 1 || !strings.HasPrefix(filepath.Base(filepath.Dir(bases[0])), "SHA256_") {
+		t.Errorf("delta bases: have: %q; want one below SHA256_<fingerprint>", bases)
+	}
+
+	stdout, logs = run("echo two\n")
+	if !strings.Contains(logs, "delta: uploaded") {
+		t.Errorf("second run: want a delta; logs:\n%s", logs)
+	}
+	if have, want := stdout, "two\n"; have != want {
+		t.Errorf("stdout: have: %q; want: %q", have, want)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+)
+
+// The seed corpus and the failing inputs found by fuzzing, relative to the
+// package directory.
+const fuzzCorpusDir = "testdata/fuzz"
+
+// fuzzSync keeps the fuzzing state of the test binary in sync between host and
+// target, when running go test -fuzz. The seed corpus is uploaded with
+// testdata; the new failing inputs written to testdata/fuzz are copied back to
+// the package on the host, where they become regression tests. The cache of
+// generated inputs (-test.fuzzcachedir) is uploaded and its new entries are
+// copied back, so that the next run continues from there. Fuzzing names its
+// files by content, so only the files missing on the host are copied.
+type fuzzSync struct {
+	workDir     string
+	localCache  string
+	remoteCache string
+	log         hclog.Logger
+}
+
+// newFuzzSync returns a fuzzSync for a test binary running in workDir on the
+// target, rewriting -test.fuzzcachedir. If not fuzzing, it returns nil.
+func newFuzzSync(flags *testFlags, workDir string, log hclog.Logger) *fuzzSync {
+	if fuzz, _ := flags.Lookup("fuzz"); fuzz == "" {
+		return nil
+	}
+	self := &fuzzSync{workDir: workDir, log: log}
+	if cache, _ := flags.Lookup("fuzzcachedir"); cache != "" {
+		self.localCache = cache
+		self.remoteCache = path.Join(workDir, "fuzzcache")
+		flags.Rewrite("fuzzcachedir", func(string) string { return self.remoteCache })
+	}
+	return self
+}
+
+// Upload copies the fuzz cache to the target, as uploadTree.
+func (self *fuzzSync) Upload(conn *ssh.Client, sf *sftpTransfer,
+	timeout func(size int64) time.Duration) error {
+	if self.localCache == "" {
+		return nil
+	}
+	if fi, err := os.Stat(self.localCache); err != nil || !fi.IsDir() {
+		return nil
+	}
+	self.log.Debug("fuzz: upload cache", "src", self.localCache, "dst", self.remoteCache)
+	err := uploadTree(conn, sf, self.workDir,
+		[]uploadPath{{src: self.localCache, dst: path.Base(self.remoteCache)}}, timeout)
+	if err != nil {
+		return fmt.Errorf("fuzz cache: %s", err)
+	}
+	return nil
+}
+
+// Download copies back to the host the new failing inputs and the new entries
+// of the fuzz cache, as downloadTree.
+func (self *fuzzSync) Download(conn *ssh.Client, sf *sftpTransfer,
+	timeout func(size int64) time.Duration) error {
+	crashers, err := downloadNew(conn, sf, path.Join(self.workDir, fuzzCorpusDir),
+		filepath.FromSlash(fuzzCorpusDir), timeout)
+	if err != nil {
+		return fmt.Errorf("fuzz corpus: %s", err)
+	}
+	for _, file := range crashers {
+		self.log.Info("fuzz: failing input copied to host",
+			"path", path.Join(fuzzCorpusDir, file))
+	}
+
+	if self.localCache == "" {
+		return nil
+	}
+	entries, err := downloadNew(conn, sf, self.remoteCache, self.localCache, timeout)
+	if err != nil {
+		return fmt.Errorf("fuzz cache: %s", err)
+	}
+	self.log.Debug("fuzz: cache entries copied to host", "count", len(entries),
+		"dir", self.localCache)
+	return nil
+}
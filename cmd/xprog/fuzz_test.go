@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestSshCmdRunFuzz(t *testing.T) {
+	sshConfig, _ := startShellServer(t)
+	// Behaves as a test binary finding a failing input: it needs the seed
+	// corpus and the cache, adds an entry to the cache and writes the input.
+	testBinary := writeTestBinary(t, `
+for arg; do
+  case $arg in
+  -test.fuzzcachedir=*) cache=${arg#*=} ;;
+  esac
+done
+cat testdata/fuzz/FuzzX/seed "$cache/FuzzX/old" > /dev/null || exit 3
+echo "fuzz: elapsed: 0s, execs: 1 (1/sec), new interesting: 1 (total: 2)"
+echo new > "$cache/FuzzX/new"
+mkdir -p testdata/fuzz/FuzzX
+echo crasher > testdata/fuzz/FuzzX/0123abcd
+echo "Failing input written to testdata/fuzz/FuzzX/0123abcd"
+exit 1
+`)
+	pkgDir := t.TempDir()
+	cacheDir := filepath.Join(t.TempDir(), "fuzz", "example.com", "pkg")
+	writeFiles(t, pkgDir, map[string]string{"testdata/fuzz/FuzzX/seed": "seed"})
+	writeFiles(t, cacheDir, map[string]string{"FuzzX/old": "old"})
+	chdir(t, pkgDir)
+
+	sut := SshCmd{
+		CommonArgs: CommonArgs{
+			TestBinary: testBinary,
+			GoTestFlag: []string{"-test.paniconexit0", "-test.fuzz=FuzzX",
+				"-test.fuzzcachedir=" + cacheDir, "-test.run=FuzzX"},
+		},
+		SshConfig: sshConfig,
+		opts:      Opts{logger: hclog.NewNullLogger()},
+	}
+
+	err := sut.Run(sut.opts)
+
+	var testErr *testExitError
+	if !errors.As(err, &testErr) || testErr.code != 1 {
+		t.Fatalf("error: have: %v; want: exit status 1", err)
+	}
+	if diff := cmp.Diff(readFiles(t, "testdata"), map[string]string{
+		"fuzz/FuzzX/seed":     "seed",
+		"fuzz/FuzzX/0123abcd": "crasher\n",
+	}); diff != "" {
+		t.Errorf("\ncorpus mismatch (-have, +want)\n%s", diff)
+	}
+	if diff := cmp.Diff(readFiles(t, cacheDir), map[string]string{
+		"FuzzX/old": "old",
+		"FuzzX/new": "new\n",
+	}); diff != "" {
+		t.Errorf("\ncache mismatch (-have, +want)\n%s", diff)
+	}
+}
+
+func TestNewFuzzSync(t *testing.T) {
+	flags := parseTestFlags([]string{"-test.run=X"})
+	if sut := newFuzzSync(flags, "/W", hclog.NewNullLogger()); sut != nil {
+		t.Fatalf("not fuzzing: have: %v; want: nil", sut)
+	}
+
+	flags = parseTestFlags([]string{"-test.fuzz=FuzzX", "-test.fuzzcachedir", "/cache"})
+	sut := newFuzzSync(flags, "/W", hclog.NewNullLogger())
+
+	if have, want := sut.remoteCache, "/W/fuzzcache"; have != want {
+		t.Errorf("remoteCache: have: %s; want: %s", have, want)
+	}
+	want := []string{"-test.fuzz=FuzzX", "-test.fuzzcachedir=/W/fuzzcache"}
+	if diff := cmp.Diff(flags.Args(), want); diff != "" {
+		t.Errorf("\nargs mismatch (-have, +want)\n%s", diff)
+	}
+}
+
+// writeFiles creates below dir the files, relative path -> contents.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readFiles returns the regular files below dir, relative path -> contents.
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	names, err := localFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for name := range names {
+		buf, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = string(buf)
+	}
+	return files
+}
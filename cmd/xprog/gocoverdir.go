@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+)
+
+// goCoverDir collects the coverage data written on the target by the binaries
+// built with -cover (Go 1.20+) that the tests run, for integration coverage.
+// The remote directory is exported as GOCOVERDIR to the test binary, so that
+// the processes it starts inherit it; the new covmeta and covcounters files are
+// then copied to the host directory. Their names are unique, so the directory
+// accumulates the data of all the packages and runs.
+type goCoverDir struct {
+	local  string
+	remote string
+	log    hclog.Logger
+}
+
+// newGoCoverDir returns a goCoverDir for host directory local and a test
+// binary running in workDir on the target. If local is empty, it returns nil.
+func newGoCoverDir(local string, workDir string, log hclog.Logger) *goCoverDir {
+	if local == "" {
+		return nil
+	}
+	return &goCoverDir{local: local, remote: workDir + "/gocoverdir", log: log}
+}
+
+// newTestGoCoverDir rewrites -test.gocoverdir, that go test -cover (Go 1.20+)
+// passes with a host directory, to a directory in workDir on the target and
+// returns a goCoverDir to copy the coverage data back, for go test to merge it
+// into the coverprofile. If the flag is missing, it returns nil.
+func newTestGoCoverDir(flags *testFlags, workDir string, log hclog.Logger) *goCoverDir {
+	local, ok := flags.Lookup("gocoverdir")
+	if !ok || local == "" {
+		return nil
+	}
+	remote := workDir + "/testgocoverdir"
+	flags.Rewrite("gocoverdir", func(string) string { return remote })
+	return &goCoverDir{local: local, remote: remote, log: log}
+}
+
+// Env returns the environment variable for the test binary.
+func (self *goCoverDir) Env() string {
+	return "GOCOVERDIR=" + self.remote
+}
+
+// Upload creates the remote directory with the files of the host directory,
+// such as the meta-files file that go test -coverpkg puts there, as uploadTree.
+func (self *goCoverDir) Upload(conn *ssh.Client, sf *sftpTransfer,
+	timeout func(size int64) time.Duration) error {
+	paths := []uploadPath{{src: self.local, dst: path.Base(self.remote)}}
+	if err := uploadTree(conn, sf, path.Dir(self.remote), paths, timeout); err != nil {
+		return fmt.Errorf("gocoverdir: %s", err)
+	}
+	return nil
+}
+
+// Download copies the new coverage data files from the target to the host, as
+// downloadTree.
+func (self *goCoverDir) Download(conn *ssh.Client, sf *sftpTransfer,
+	timeout func(size int64) time.Duration) error {
+	files, err := downloadNew(conn, sf, self.remote, self.local, timeout)
+	if err != nil {
+		return fmt.Errorf("gocoverdir: %s", err)
+	}
+	self.log.Debug("gocoverdir: coverage data copied to host", "count", len(files),
+		"dir", self.local)
+	return nil
+}
+
+// convertCoverDir converts the coverage data files in dir to the text
+// coverprofile profile, as go tool covdata textfmt. go test puts the bin
+// directory of its toolchain first in PATH, so the versions match. The profile
+// is replaced atomically, since several xprog can share dir.
+func convertCoverDir(dir string, profile string, log hclog.Logger) error {
+	metas, err := filepath.Glob(filepath.Join(dir, "covmeta.*"))
+	if err != nil {
+		return fmt.Errorf("gocoverdir: %s", err)
+	}
+	if len(metas) == 0 {
+		log.Warn("gocoverdir: no coverage data, not converting", "dir", dir)
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(profile), filepath.Base(profile)+".*")
+	if err != nil {
+		return fmt.Errorf("gocoverdir: %s", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	cmd := exec.Command("go", "tool", "covdata", "textfmt", "-i="+dir,
+		"-o="+tmp.Name())
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	log.Debug("gocoverdir: convert", "cmd", strings.Join(cmd.Args, " "))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("gocoverdir: %s: %s: %s", strings.Join(cmd.Args, " "), err,
+			bytes.TrimSpace(out.Bytes()))
+	}
+	if err := os.Rename(tmp.Name(), profile); err != nil {
+		return fmt.Errorf("gocoverdir: %s", err)
+	}
+	log.Debug("gocoverdir: converted", "path", profile)
+	return nil
+}
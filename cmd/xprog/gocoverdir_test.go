@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestSshCmdRunGoCoverDir(t *testing.T) {
+	sshConfig, _ := startShellServer(t)
+	// Stands for a binary built with -cover; the failure of the test binary
+	// must not prevent the download.
+	testBinary := writeTestBinary(t, `
+echo meta > "$GOCOVERDIR/covmeta.1234"
+echo counters > "$GOCOVERDIR/covcounters.1234.$$.1"
+exit 1
+`)
+	coverDir := filepath.Join(t.TempDir(), "gocoverdir")
+	writeFiles(t, coverDir, map[string]string{"covmeta.1234": "meta\n"})
+	sut := SshCmd{
+		CommonArgs: CommonArgs{TestBinary: testBinary},
+		SshConfig:  sshConfig,
+		GoCoverDir: coverDir,
+		opts:       Opts{logger: hclog.NewNullLogger()},
+	}
+
+	err := sut.Run(sut.opts)
+
+	var testErr *testExitError
+	if !errors.As(err, &testErr) {
+		t.Fatalf("error: have: %v; want: testExitError", err)
+	}
+	have := readFiles(t, coverDir)
+	if len(have) != 2 || have["covmeta.1234"] != "meta\n" {
+		t.Errorf("files: have: %v; want: covmeta.1234 and covcounters.1234.*", have)
+	}
+	for name, contents := range have {
+		if strings.HasPrefix(name, "covcounters.1234.") && contents != "counters\n" {
+			t.Errorf("%s: have: %q; want: %q", name, contents, "counters\n")
+		}
+	}
+}
+
+func TestSshCmdRunGoCoverProfile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip: builds a binary with -cover")
+	}
+	// startShellServer changes XDG_CACHE_HOME, keep the Go build cache.
+	gocache, err := exec.Command("go", "env", "GOCACHE").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOCACHE", strings.TrimSpace(string(gocache)))
+	sshConfig, _ := startShellServer(t)
+	// The shell server runs on the host, so a native helper will do.
+	srcDir := t.TempDir()
+	writeFiles(t, srcDir, map[string]string{
+		"go.mod":  "module example.com/hello\n\ngo 1.23\n",
+		"main.go": "package main\n\nfunc main() {\n\tprintln(\"hello\")\n}\n",
+	})
+	helper := filepath.Join(t.TempDir(), "hello")
+	build := exec.Command("go", "build", "-cover", "-o", helper, ".")
+	build.Dir = srcDir
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %s\n%s", err, out)
+	}
+	testBinary := writeTestBinary(t, shellQuote(helper)+"\n")
+	coverDir := filepath.Join(t.TempDir(), "gocoverdir")
+	profile := filepath.Join(t.TempDir(), "integration.out")
+	sut := SshCmd{
+		CommonArgs:     CommonArgs{TestBinary: testBinary},
+		SshConfig:      sshConfig,
+		GoCoverDir:     coverDir,
+		GoCoverProfile: profile,
+		opts:           Opts{logger: hclog.NewNullLogger()},
+		stdout:         io.Discard,
+		stderr:         io.Discard,
+	}
+
+	if err := sut.Run(sut.opts); err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := os.ReadFile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The block positions depend on the toolchain.
+	lines := strings.Split(strings.TrimSpace(string(have)), "\n")
+	if len(lines) != 2 || lines[0] != "mode: set" ||
+		!strings.HasPrefix(lines[1], "example.com/hello/main.go:") ||
+		!strings.HasSuffix(lines[1], " 1 1") {
+		t.Errorf("profile: have: %q; want: one covered block of main.go", have)
+	}
+}
+
+func TestSshCmdRunTestGoCoverDir(t *testing.T) {
+	sshConfig, _ := startShellServer(t)
+	// go test creates the directory, maybe with the meta-files file.
+	coverDir := t.TempDir()
+	writeFiles(t, coverDir, map[string]string{"metafiles.txt": "meta\n"})
+	testBinary := writeTestBinary(t, `
+dir=${1#-test.gocoverdir=}
+[ "$dir" != `+shellQuote(coverDir)+` ] || { echo "host directory $dir" >&2; exit 3; }
+[ "$GOCOVERDIR" = "$dir" ] || { echo "GOCOVERDIR $GOCOVERDIR" >&2; exit 4; }
+cp "$dir/metafiles.txt" "$dir/covcounters.1234"
+`)
+	var stderr strings.Builder
+	sut := SshCmd{
+		CommonArgs: CommonArgs{TestBinary: testBinary,
+			GoTestFlag: []string{"-test.gocoverdir=" + coverDir}},
+		SshConfig: sshConfig,
+		opts:      Opts{logger: hclog.NewNullLogger()},
+		stdout:    io.Discard,
+		stderr:    &stderr,
+	}
+
+	if err := sut.Run(sut.opts); err != nil {
+		t.Fatalf("%s\nstderr: %s", err, stderr.String())
+	}
+
+	want := map[string]string{"metafiles.txt": "meta\n", "covcounters.1234": "meta\n"}
+	if diff := cmp.Diff(readFiles(t, coverDir), want); diff != "" {
+		t.Errorf("\nfiles mismatch (-have, +want)\n%s", diff)
+	}
+}
+
+func TestSshCmdRunGoTestCover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip: builds a test binary with -cover")
+	}
+	// startShellServer changes XDG_CACHE_HOME, keep the Go build cache.
+	gocache, err := exec.Command("go", "env", "GOCACHE").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOCACHE", strings.TrimSpace(string(gocache)))
+	sshConfig, _ := startShellServer(t)
+	srcDir := t.TempDir()
+	writeFiles(t, srcDir, map[string]string{
+		"go.mod":        "module example.com/hello\n\ngo 1.23\n",
+		"hello.go":      "package hello\n\nfunc Hello() string {\n\treturn \"hello\"\n}\n",
+		"hello_test.go": "package hello\n\nimport \"testing\"\n\nfunc TestHello(t *testing.T) {\n\tHello()\n}\n",
+	})
+	testBinary := filepath.Join(t.TempDir(), "hello.test")
+	build := exec.Command("go", "test", "-c", "-cover", "-o", testBinary, ".")
+	build.Dir = srcDir
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go test -c: %s\n%s", err, out)
+	}
+	// As go test -coverprofile passes them.
+	coverDir := t.TempDir()
+	profile := filepath.Join(t.TempDir(), "_cover_.out")
+	var logs strings.Builder
+	sut := SshCmd{
+		CommonArgs: CommonArgs{TestBinary: testBinary, GoTestFlag: []string{
+			"-test.paniconexit0", "-test.gocoverdir=" + coverDir,
+			"-test.coverprofile=" + profile}},
+		SshConfig: sshConfig,
+		opts: Opts{logger: hclog.New(&hclog.LoggerOptions{
+			Output: &logs,
+			Level:  hclog.Debug,
+		})},
+		stdout: io.Discard,
+		stderr: io.Discard,
+	}
+
+	if err := sut.Run(sut.opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shell server runs on the host: the host directory would work too.
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "ssh execute TestBinary") &&
+			strings.Contains(line, coverDir) {
+			t.Errorf("test binary run with the host -test.gocoverdir: %s", line)
+		}
+	}
+	metas, err := filepath.Glob(filepath.Join(coverDir, "covmeta.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 {
+		t.Errorf("covmeta files: have: %v; want: 1", metas)
+	}
+	have, err := os.ReadFile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(have)), "\n")
+	if len(lines) != 2 || lines[0] != "mode: set" ||
+		!strings.HasPrefix(lines[1], "example.com/hello/hello.go:") ||
+		!strings.HasSuffix(lines[1], " 1 1") {
+		t.Errorf("profile: have: %q; want: one covered block of hello.go", have)
+	}
+}
+
+func TestSshCmdGoCoverProfileRequiresDir(t *testing.T) {
+	sut := SshCmd{
+		SshConfig:      "ssh_config",
+		GoCoverProfile: "integration.out",
+		opts:           Opts{logger: hclog.NewNullLogger()},
+	}
+
+	err := sut.prepare()
+
+	want := "sshRun: --gocoverprofile requires --gocoverdir"
+	if err == nil || err.Error() != want {
+		t.Errorf("error: have: %v; want: %s", err, want)
+	}
+}
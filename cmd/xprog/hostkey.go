@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Values of StrictHostKeyChecking, normalized.
+const (
+	hostKeyStrict    = "yes"
+	hostKeyAcceptNew = "accept-new"
+	hostKeyNo        = "no"
+)
+
+// hostKeyChecker verifies the host key presented by the target against the
+// known_hosts files, following the StrictHostKeyChecking semantics of OpenSSH.
+type hostKeyChecker struct {
+	mode         string
+	userFiles    []string // UserKnownHostsFile; new keys go to the first one
+	globalFiles  []string // GlobalKnownHostsFile
+	hashHosts    bool     // HashKnownHosts
+	hostKeyAlias string   // HostKeyAlias
+	log          hclog.Logger
+	//
+	callback ssh.HostKeyCallback
+}
+
+// newHostKeyChecker returns a hostKeyChecker configured from host.
+// Since xprog cannot prompt the user, StrictHostKeyChecking ask (the OpenSSH
+// default) behaves as yes.
+func newHostKeyChecker(host Host, log hclog.Logger) (*hostKeyChecker, error) {
+	var mode string
+	switch val := strings.ToLower(host.GetDef("StrictHostKeyChecking", "ask")); val {
+	case "yes", "ask":
+		mode = hostKeyStrict
+	case "accept-new":
+		mode = hostKeyAcceptNew
+	case "no", "off":
+		mode = hostKeyNo
+	default:
+		return nil, fmt.Errorf("StrictHostKeyChecking=%s: unsupported value", val)
+	}
+
+	userFiles, err := knownHostsFiles(host.GetAll("UserKnownHostsFile"),
+		"~/.ssh/known_hosts", "~/.ssh/known_hosts2")
+	if err != nil {
+		return nil, err
+	}
+	globalFiles, err := knownHostsFiles(host.GetAll("GlobalKnownHostsFile"),
+		"/etc/ssh/ssh_known_hosts", "/etc/ssh/ssh_known_hosts2")
+	if err != nil {
+		return nil, err
+	}
+
+	self := &hostKeyChecker{
+		mode:         mode,
+		userFiles:    userFiles,
+		globalFiles:  globalFiles,
+		hashHosts:    strings.EqualFold(host.GetDef("HashKnownHosts", "no"), "yes"),
+		hostKeyAlias: host.GetDef("HostKeyAlias", ""),
+		log:          log,
+	}
+	if err := self.load(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// knownHostsFiles returns the files to use, defaults if none is configured.
+// The special value "none" means no file.
+func knownHostsFiles(files []string, defaults ...string) ([]string, error) {
+	if len(files) == 0 {
+		files = defaults
+	}
+	var result []string
+	for _, file := range files {
+		if file == "none" {
+			continue
+		}
+		file, err := expandTilde(file)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, file)
+	}
+	return result, nil
+}
+
+// load (re)reads the known_hosts files that exist.
+func (self *hostKeyChecker) load() error {
+	var files []string
+	for _, file := range append(self.userFiles, self.globalFiles...) {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return fmt.Errorf("known_hosts: %s", err)
+	}
+	self.callback = callback
+	return nil
+}
+
+// lookupName returns the name, in host:port form, under which the key of
+// address is searched in and recorded to the known_hosts files.
+func (self *hostKeyChecker) lookupName(address string) string {
+	if self.hostKeyAlias != "" {
+		// Port 22 is omitted by knownhosts.Normalize, as OpenSSH does for
+		// HostKeyAlias.
+		return net.JoinHostPort(self.hostKeyAlias, "22")
+	}
+	return address
+}
+
+// Check is a ssh.HostKeyCallback.
+func (self *hostKeyChecker) Check(address string, remote net.Addr, key ssh.PublicKey) error {
+	name := self.lookupName(address)
+	if _, ok := remote.(*net.TCPAddr); !ok {
+		// knownhosts insists on a TCP address, which we don't have when
+		// connected via a ProxyCommand.
+		remote = &net.TCPAddr{}
+	}
+	err := self.callback(name, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	var revokedErr *knownhosts.RevokedError
+	if errors.As(err, &revokedErr) {
+		return fmt.Errorf("host key verification failed for %s: %s key %s is revoked (%s:%d)",
+			name, key.Type(), ssh.FingerprintSHA256(key),
+			revokedErr.Revoked.Filename, revokedErr.Revoked.Line)
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return fmt.Errorf("host key verification failed for %s: %s", name, err)
+	}
+
+	if len(keyErr.Want) > 0 {
+		// The host is known, with a different key.
+		var expected []string
+		for _, want := range keyErr.Want {
+			expected = append(expected, fmt.Sprintf("%s %s (%s:%d)",
+				want.Key.Type(), ssh.FingerprintSHA256(want.Key),
+				want.Filename, want.Line))
+		}
+		if self.mode == hostKeyNo {
+			self.log.Warn("host key mismatch, ignored (StrictHostKeyChecking=no)",
+				"host", name, "presented", ssh.FingerprintSHA256(key))
+			return nil
+		}
+		return fmt.Errorf("host key verification failed for %s: "+
+			"REMOTE HOST IDENTIFICATION HAS CHANGED: presented %s %s; expected %s",
+			name, key.Type(), ssh.FingerprintSHA256(key),
+			strings.Join(expected, ", "))
+	}
+
+	// The host is unknown.
+	if self.mode == hostKeyStrict {
+		return fmt.Errorf("host key verification failed for %s: "+
+			"no %s key known (StrictHostKeyChecking=yes); presented %s",
+			name, key.Type(), ssh.FingerprintSHA256(key))
+	}
+	if err := self.record(name, key); err != nil {
+		return fmt.Errorf("host key for %s: %s", name, err)
+	}
+	return nil
+}
+
+// record appends the key of a new host to the first UserKnownHostsFile.
+func (self *hostKeyChecker) record(name string, key ssh.PublicKey) error {
+	if len(self.userFiles) == 0 {
+		return nil
+	}
+	file := self.userFiles[0]
+	self.log.Info("adding host key to known_hosts", "host", name,
+		"key", key.Type()+" "+ssh.FingerprintSHA256(key), "file", file)
+
+	pattern := knownhosts.Normalize(name)
+	if self.hashHosts {
+		pattern = knownhosts.HashHostname(pattern)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	fi, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(fi, knownhosts.Line([]string{pattern}, key)); err != nil {
+		fi.Close()
+		return err
+	}
+	if err := fi.Close(); err != nil {
+		return err
+	}
+	return self.load()
+}
+
+// Algorithms returns the host key algorithms of the keys known for address, so
+// that the server presents a key we can verify. Returns nil if no key is known,
+// meaning any algorithm.
+func (self *hostKeyChecker) Algorithms(address string) []string {
+	if self.mode == hostKeyNo {
+		return nil
+	}
+	// Trick: a key that can never match gives us the list of known keys.
+	placeholder := &probeKey{}
+	err := self.callback(self.lookupName(address), &net.TCPAddr{}, placeholder)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var algos []string
+	seen := map[string]bool{}
+	for _, want := range keyErr.Want {
+		for _, algo := range hostKeyAlgos(want.Key.Type()) {
+			if !seen[algo] {
+				seen[algo] = true
+				algos = append(algos, algo)
+			}
+		}
+	}
+	return algos
+}
+
+// hostKeyAlgos returns the signature algorithms usable with a key type.
+func hostKeyAlgos(keyType string) []string {
+	switch keyType {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	default:
+		return []string{keyType}
+	}
+}
+
+// probeKey is a ssh.PublicKey that matches no known key.
+type probeKey struct{}
+
+func (probeKey) Type() string                                 { return "xprog-probe" }
+func (probeKey) Marshal() []byte                              { return []byte("xprog-probe") }
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("probe") }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyChecker(t *testing.T) {
+	knownKey := newTestPublicKey(t)
+	otherKey := newTestPublicKey(t)
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+
+	testCases := []struct {
+		name       string
+		strict     string
+		address    string
+		key        ssh.PublicKey
+		wantErr    string
+		wantRecord bool
+	}{
+		{
+			name:    "known host, yes",
+			strict:  "yes",
+			address: "known:2222",
+			key:     knownKey,
+		},
+		{
+			name:    "unknown host, yes",
+			strict:  "yes",
+			address: "unknown:2222",
+			key:     otherKey,
+			wantErr: fmt.Sprintf("host key verification failed for unknown:2222: "+
+				"no ssh-ed25519 key known (StrictHostKeyChecking=yes); presented %s",
+				ssh.FingerprintSHA256(otherKey)),
+		},
+		{
+			name:    "unknown host, ask behaves as yes",
+			strict:  "ask",
+			address: "unknown:2222",
+			key:     otherKey,
+			wantErr: fmt.Sprintf("host key verification failed for unknown:2222: "+
+				"no ssh-ed25519 key known (StrictHostKeyChecking=yes); presented %s",
+				ssh.FingerprintSHA256(otherKey)),
+		},
+		{
+			name:    "mismatch, accept-new",
+			strict:  "accept-new",
+			address: "known:2222",
+			key:     otherKey,
+			wantErr: fmt.Sprintf("host key verification failed for known:2222: "+
+				"REMOTE HOST IDENTIFICATION HAS CHANGED: presented ssh-ed25519 %s; "+
+				"expected ssh-ed25519 %s (KNOWN_HOSTS:1)",
+				ssh.FingerprintSHA256(otherKey), ssh.FingerprintSHA256(knownKey)),
+		},
+		{
+			name:       "unknown host, accept-new",
+			strict:     "accept-new",
+			address:    "unknown:2222",
+			key:        otherKey,
+			wantRecord: true,
+		},
+		{
+			name:    "mismatch, no",
+			strict:  "no",
+			address: "known:2222",
+			key:     otherKey,
+		},
+		{
+			name:       "unknown host, no",
+			strict:     "no",
+			address:    "unknown:2222",
+			key:        otherKey,
+			wantRecord: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+			line := knownhosts.Line([]string{"[known]:2222"}, knownKey) + "\n"
+			if err := os.WriteFile(knownHosts, []byte(line), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			host := Host{
+				"stricthostkeychecking": {tc.strict},
+				"userknownhostsfile":    {knownHosts},
+				"globalknownhostsfile":  {"none"},
+			}
+			sut, err := newHostKeyChecker(host, hclog.NewNullLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = sut.Check(tc.address, remote, tc.key)
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			want := strings.ReplaceAll(tc.wantErr, "KNOWN_HOSTS", knownHosts)
+			if want == "" {
+				want = "<no error>"
+			}
+			if have != want {
+				t.Fatalf("error:\nhave: %s\nwant: %s", have, want)
+			}
+
+			contents, err := os.ReadFile(knownHosts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantRecord {
+				line += knownhosts.Line([]string{"[unknown]:2222"}, tc.key) + "\n"
+			}
+			if diff := cmp.Diff(string(contents), line); diff != "" {
+				t.Errorf("\nknown_hosts mismatch (-have, +want)\n%s", diff)
+			}
+			if tc.wantRecord {
+				// A recorded key must be accepted also by the strict mode.
+				sut.mode = hostKeyStrict
+				if err := sut.Check(tc.address, remote, tc.key); err != nil {
+					t.Errorf("check after record: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHostKeyCheckerAliasAndAlgorithms(t *testing.T) {
+	key := newTestPublicKey(t)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{"myalias"}, key) + "\n"
+	if err := os.WriteFile(knownHosts, []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	host := Host{
+		"hostkeyalias":          {"myalias"},
+		"stricthostkeychecking": {"yes"},
+		"userknownhostsfile":    {knownHosts},
+		"globalknownhostsfile":  {"none"},
+	}
+	sut, err := newHostKeyChecker(host, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sut.Check("127.0.0.1:2222", &net.TCPAddr{}, key); err != nil {
+		t.Errorf("check: %s", err)
+	}
+	if diff := cmp.Diff(sut.Algorithms("127.0.0.1:2222"),
+		[]string{ssh.KeyAlgoED25519}); diff != "" {
+		t.Errorf("\nalgorithms mismatch (-have, +want)\n%s", diff)
+	}
+}
+
+func TestHostKeyCheckerInvalidMode(t *testing.T) {
+	host := Host{"stricthostkeychecking": {"maybe"}}
+
+	_, err := newHostKeyChecker(host, hclog.NewNullLogger())
+
+	have := "<no error>"
+	if err != nil {
+		have = err.Error()
+	}
+	if want := "StrictHostKeyChecking=maybe: unsupported value"; have != want {
+		t.Fatalf("error: have: %s; want: %s", have, want)
+	}
+}
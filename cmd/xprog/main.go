@@ -7,6 +7,8 @@ import (
 	"os"
 	"os/exec"
 	"runtime/debug"
+	"strings"
+	"syscall"
 
 	"github.com/alexflint/go-arg"
 	"github.com/hashicorp/go-hclog"
@@ -16,11 +18,15 @@ import (
 var version = "(devel)" // to match the default from runtime/debug
 
 type Opts struct {
-	Verbose bool `arg:"-v,--verbose" help:"verbosity level"`
+	Verbose bool   `arg:"-v,--verbose" help:"verbosity level"`
+	Target  string `arg:"--target,env:XPROG_TARGET" help:"target of xprog.yaml, by name or labels such as distro=alpine (overrides the routes)"`
+	Matrix  bool   `arg:"--matrix,env:XPROG_MATRIX" help:"run on all the selected targets of xprog.yaml, concurrently"`
 	//
 	Help   *HelpCmd   `arg:"subcommand:help" help:"display extensive help"`
 	Direct *DirectCmd `arg:"subcommand:direct" help:"run the test binary directly on the host"`
 	Ssh    *SshCmd    `arg:"subcommand:ssh" help:"upload and run the test binary on SSH target"`
+	Cover  *CoverCmd  `arg:"subcommand:cover" help:"coverprofile utilities"`
+	Mux    *MuxCmd    `arg:"subcommand:mux" help:"SSH connection multiplexing daemon, started by ssh (see ControlMaster)"`
 	// proposed new API for go-arg:
 	// Extra   []string `arg:"end-of-options"`
 	// instead of:
@@ -33,6 +39,17 @@ type Opts struct {
 type CommonArgs struct {
 	TestBinary string   `arg:"required,positional" help:"path to the test binary created by go test"`
 	GoTestFlag []string `arg:"positional" help:"flags for go test; put '-- ' before the first one (to signal end of options)"`
+	Env        []string `arg:"--env,separate" help:"environment variable KEY=VALUE for the test binary (repeatable)"`
+}
+
+// checkEnv verifies that each element of Env is in the form KEY=VALUE.
+func (self CommonArgs) checkEnv() error {
+	for _, kv := range self.Env {
+		if key, _, ok := strings.Cut(kv, "="); !ok || key == "" {
+			return fmt.Errorf("env %s: want KEY=VALUE", kv)
+		}
+	}
+	return nil
 }
 
 type DirectCmd struct {
@@ -68,13 +85,25 @@ func main() {
 
 func mainInt(out io.Writer, args []string) int {
 	var opts Opts
-	err := parse(out, args, arg.Config{}, &opts)
+	conf, err := projectConfig()
+	if err != nil {
+		fmt.Fprintln(out, "xprog:", err)
+		return exitInfra
+	}
+	if conf != nil {
+		args = conf.Args(args)
+		if err := conf.Apply(&opts, args); err != nil {
+			fmt.Fprintln(out, "xprog:", err)
+			return exitInfra
+		}
+	}
+	err = parse(out, args, arg.Config{}, &opts)
 	if err == parseOK {
 		return 0
 	}
 	if err != nil {
 		fmt.Fprintln(out, "xprog:", err)
-		return 1
+		return exitInfra
 	}
 
 	opts.out = out
@@ -85,15 +114,69 @@ func mainInt(out io.Writer, args []string) int {
 	if opts.Verbose {
 		opts.logger.SetLevel(hclog.Debug)
 	}
+	if conf != nil {
+		opts.logger.Debug("config", "path", conf.path, "target", conf.target)
+	} else if opts.Target != "" || opts.Matrix {
+		fmt.Fprintf(out, "xprog: --target, --matrix: no %s with targets\n", configName)
+		return exitInfra
+	}
 
 	if err := runCommand(opts); err != nil {
 		fmt.Fprintln(out, "xprog:", err)
-		return 1
+		var testErr *testExitError
+		if errors.As(err, &testErr) {
+			return testErr.code
+		}
+		return exitInfra
 	}
 
 	return 0
 }
 
+// projectConfig returns the project configuration, nil if there is none.
+func projectConfig() (*Config, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("get cwd: %s", err)
+	}
+	path, err := findConfig(cwd)
+	if err != nil || path == "" {
+		return nil, err
+	}
+	return loadConfig(path)
+}
+
+// Exit codes of xprog, besides the exit code of the test binary.
+const (
+	// xprog itself failed (bad usage, connection, upload, ...): the test
+	// binary did not run or its outcome is unknown.
+	exitInfra = 125
+	// Added to the signal number when the test binary is killed by a signal,
+	// as done by the shell.
+	exitSignal = 128
+)
+
+// testExitError means that the test binary ran and terminated unsuccessfully,
+// as opposed to xprog failing to run it. xprog exits with code.
+type testExitError struct {
+	code int
+	msg  string
+}
+
+func (self *testExitError) Error() string {
+	return self.msg
+}
+
+// signalExitError returns the testExitError for a test binary killed by
+// signal sig, where code is exitSignal plus the signal number.
+func signalExitError(where string, sig string, code int) *testExitError {
+	msg := fmt.Sprintf("test binary %s: killed by signal %s", where, sig)
+	if sig == "KILL" {
+		msg += " (out of memory?)"
+	}
+	return &testExitError{code: code, msg: msg}
+}
+
 var parseOK = errors.New("parse OK")
 
 func parse(out io.Writer, args []string, config arg.Config, dests ...interface{}) error {
@@ -150,13 +233,17 @@ func runCommand(opts Opts) error {
 		return opts.Direct.Run(opts)
 	case opts.Ssh != nil:
 		return opts.Ssh.Run(opts)
+	case opts.Cover != nil:
+		return opts.Cover.Run(opts)
+	case opts.Mux != nil:
+		return opts.Mux.Run(opts)
 	default:
 		return fmt.Errorf("unwired command")
 	}
 }
 
 func (self HelpCmd) Run(opts Opts) error {
-	fmt.Fprintln(opts.out, help)
+	fmt.Fprint(opts.out, help)
 	return nil
 }
 
@@ -164,14 +251,55 @@ func (self DirectCmd) Run(opts Opts) error {
 	self.opts = opts
 	self.opts.logger.Debug("direct", "testbinary:", self.TestBinary,
 		"gotestflag:", self.GoTestFlag)
+	logTestFlags(self.opts.logger, parseTestFlags(self.GoTestFlag))
+	if err := self.checkEnv(); err != nil {
+		return fmt.Errorf("direct: %s", err)
+	}
 
 	cmd := exec.Command(self.TestBinary, self.GoTestFlag...)
+	cmd.Env = append(os.Environ(), self.Env...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	if err := cmd.Run(); err != nil {
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		where := "on host"
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return signalExitError(where, signalName(status.Signal()),
+				exitSignal+int(status.Signal()))
+		}
+		return &testExitError{
+			code: exitErr.ExitCode(),
+			msg:  fmt.Sprintf("test binary %s: exit status %d", where, exitErr.ExitCode()),
+		}
+	}
+	if err != nil {
 		return fmt.Errorf("direct: %s", err)
 	}
 	return nil
 }
+
+// signalName returns the name of sig as used by the SSH protocol (RFC 4254),
+// for example "KILL".
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return sig.String()
+}
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+}
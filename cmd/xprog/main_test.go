@@ -2,12 +2,23 @@ package main
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 )
 
+func TestMain(m *testing.M) {
+	// The ssh tests start the multiplexing daemon, running the test binary as
+	// xprog.
+	if os.Getenv("XPROG_TEST_MAIN") == "1" {
+		os.Exit(mainInt(os.Stderr, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
 func TestCmdlineParsing(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -18,9 +29,9 @@ func TestCmdlineParsing(t *testing.T) {
 		{
 			name:     "missing subcommand",
 			cmdline:  "",
-			wantCode: 1,
+			wantCode: exitInfra,
 			wantOut: `
-Usage: xprog.test [--verbose] <command> [<args>]
+Usage: xprog.test [--verbose] [--target TARGET] [--matrix] <command> [<args>]
 xprog: missing subcommand
 `,
 		},
@@ -29,16 +40,20 @@ xprog: missing subcommand
 			cmdline:  "-h",
 			wantCode: 0,
 			wantOut: `
-Usage: xprog.test [--verbose] <command> [<args>]
+Usage: xprog.test [--verbose] [--target TARGET] [--matrix] <command> [<args>]
 
 Options:
   --verbose, -v          verbosity level
+  --target TARGET        target of xprog.yaml, by name or labels such as distro=alpine (overrides the routes) [env: XPROG_TARGET]
+  --matrix               run on all the selected targets of xprog.yaml, concurrently [env: XPROG_MATRIX]
   --help, -h             display this help and exit
 
 Commands:
   help                   display extensive help
   direct                 run the test binary directly on the host
   ssh                    upload and run the test binary on SSH target
+  cover                  coverprofile utilities
+  mux                    SSH connection multiplexing daemon, started by ssh (see ControlMaster)
 `,
 		},
 		{
@@ -46,23 +61,28 @@ Commands:
 			cmdline:  "direct -h",
 			wantCode: 0,
 			wantOut: `
-Usage: xprog.test direct TESTBINARY [GOTESTFLAG [GOTESTFLAG ...]]
+Usage: xprog.test direct [--env ENV] TESTBINARY [GOTESTFLAG [GOTESTFLAG ...]]
 
 Positional arguments:
   TESTBINARY             path to the test binary created by go test
   GOTESTFLAG             flags for go test; put '-- ' before the first one (to signal end of options)
 
+Options:
+  --env ENV              environment variable KEY=VALUE for the test binary (repeatable)
+
 Global options:
   --verbose, -v          verbosity level
+  --target TARGET        target of xprog.yaml, by name or labels such as distro=alpine (overrides the routes) [env: XPROG_TARGET]
+  --matrix               run on all the selected targets of xprog.yaml, concurrently [env: XPROG_MATRIX]
   --help, -h             display this help and exit
 `,
 		},
 		{
 			name:     "unknown command",
 			cmdline:  "foo",
-			wantCode: 1,
+			wantCode: exitInfra,
 			wantOut: `
-Usage: xprog.test [--verbose] <command> [<args>]
+Usage: xprog.test [--verbose] [--target TARGET] [--matrix] <command> [<args>]
 xprog: invalid subcommand: foo
 `,
 		},
@@ -103,9 +123,9 @@ func TestRunCommand(t *testing.T) {
 			wantCode: 0,
 		},
 		{
-			name:     "failure",
+			name:     "xprog failure",
 			cmdline:  "direct nonexisting",
-			wantCode: 1,
+			wantCode: exitInfra,
 		},
 	}
 
@@ -121,3 +141,51 @@ func TestRunCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestDirectExitStatus(t *testing.T) {
+	testCases := []struct {
+		name     string
+		script   string
+		wantCode int
+		wantOut  string
+	}{
+		{
+			name:     "success",
+			script:   "exit 0",
+			wantCode: 0,
+			wantOut:  "",
+		},
+		{
+			name:     "test failure",
+			script:   "exit 3",
+			wantCode: 3,
+			wantOut:  "xprog: test binary on host: exit status 3\n",
+		},
+		{
+			name:     "killed by signal",
+			script:   "kill -KILL $$",
+			wantCode: exitSignal + 9,
+			wantOut:  "xprog: test binary on host: killed by signal KILL (out of memory?)\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			script := filepath.Join(t.TempDir(), "script")
+			contents := "#!/bin/sh\n" + tc.script + "\n"
+			if err := os.WriteFile(script, []byte(contents), 0o700); err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			have := mainInt(&out, []string{"direct", script})
+
+			if want := tc.wantCode; have != want {
+				t.Errorf("\nstatus code: have: %d; want: %d", have, want)
+			}
+			if diff := cmp.Diff(out.String(), tc.wantOut); diff != "" {
+				t.Errorf("\noutput mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
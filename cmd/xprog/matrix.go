@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// matrixTarget is a target of xprog.yaml, with its ssh settings.
+type matrixTarget struct {
+	name string
+	host string // alias in the ssh_config file
+	cfg  string // path of the ssh_config file
+	sudo bool
+}
+
+// matrixResult is the outcome of the run on a target of the matrix.
+type matrixResult struct {
+	target  string
+	addr    string
+	err     error
+	elapsed time.Duration
+}
+
+// runMatrix runs the test binary on all the targets of the matrix
+// concurrently. It fails if any target fails and writes a summary table at
+// the end. Each target writes its output files (profiles) to the host path
+// with suffix ".<target>"; the coverprofiles are then merged into the path
+// expected by go test.
+func (self SshCmd) runMatrix() error {
+	log := self.opts.logger
+	switch self.MatrixOutput {
+	case "", "group", "prefix":
+	default:
+		return fmt.Errorf("sshRun: --matrix-output %s: want group or prefix",
+			self.MatrixOutput)
+	}
+	if len(self.SyncBack) > 0 {
+		return fmt.Errorf("sshRun: --sync-back is not supported with a matrix of targets")
+	}
+	flags := parseTestFlags(self.GoTestFlag)
+	if fuzz, _ := flags.Lookup("fuzz"); fuzz != "" {
+		return fmt.Errorf("sshRun: -fuzz is not supported with a matrix of targets")
+	}
+	// The target headers or prefixes would corrupt the stream parsed by
+	// test2json.
+	if v, _ := flags.Lookup("v"); v == "test2json" {
+		return fmt.Errorf("sshRun: go test -json is not supported with a matrix of targets")
+	}
+	// Only the host paths matter here.
+	outputs := rewriteOutputFlags(flags, "")
+
+	var names []string
+	for _, target := range self.matrix {
+		names = append(names, target.name)
+	}
+	log.Info("matrix", "targets", strings.Join(names, ","))
+
+	var mu sync.Mutex // serializes the writes to stdout
+	results := make([]matrixResult, len(self.matrix))
+	var wg sync.WaitGroup
+	for i, target := range self.matrix {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = self.runTarget(target, &mu)
+		}()
+	}
+	wg.Wait()
+
+	self.writeSummary(results)
+	for _, out := range outputs {
+		if err := self.mergeOutput(out, names); err != nil {
+			return fmt.Errorf("sshRun: %s", err)
+		}
+	}
+	if self.GoCoverProfile != "" && self.GoCoverDir != "" {
+		if err := convertCoverDir(self.GoCoverDir, self.GoCoverProfile, log); err != nil {
+			return fmt.Errorf("sshRun: %s", err)
+		}
+	}
+	return matrixError(results)
+}
+
+// runTarget runs the test binary on target, as the single-target case.
+func (self SshCmd) runTarget(target matrixTarget, mu *sync.Mutex) matrixResult {
+	sub := self
+	sub.matrix = nil
+	sub.Host = target.host
+	sub.SshConfig = target.cfg
+	sub.Sudo = self.Sudo || target.sudo
+	sub.outputSuffix = "." + target.name
+	// Converted once all the targets are done.
+	sub.GoCoverProfile = ""
+	sub.opts.logger = self.opts.logger.Named(target.name)
+	// The terminal cannot be shared among the targets.
+	sub.stdin = nil
+	if self.MatrixOutput == "prefix" {
+		w := &prefixWriter{out: self.stdout, prefix: "[" + target.name + "] ", mu: mu}
+		defer w.Flush()
+		sub.stdout, sub.stderr = w, w
+	} else {
+		w := &groupWriter{}
+		defer func() {
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintf(self.stdout, "=== xprog target %s\n", target.name)
+			self.stdout.Write(w.buf.Bytes())
+		}()
+		sub.stdout, sub.stderr = w, w
+	}
+
+	start := time.Now()
+	err := sub.prepare()
+	if err == nil {
+		err = sub.execute()
+		sub.target.Close()
+	}
+	return matrixResult{
+		target:  target.name,
+		addr:    sub.addr,
+		err:     err,
+		elapsed: time.Since(start),
+	}
+}
+
+// writeSummary writes the table of the results of each target.
+func (self SshCmd) writeSummary(results []matrixResult) {
+	fmt.Fprintln(self.opts.out, "xprog: matrix summary")
+	w := tabwriter.NewWriter(self.opts.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tADDRESS\tRESULT\tTIME")
+	for _, res := range results {
+		var testErr *testExitError
+		result := "ok"
+		switch {
+		case errors.As(res.err, &testErr):
+			result = fmt.Sprintf("FAIL (exit %d)", testErr.code)
+		case res.err != nil:
+			result = "ERROR: " + res.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", res.target, res.addr, result,
+			res.elapsed.Round(10*time.Millisecond))
+	}
+	w.Flush()
+}
+
+// mergeOutput merges the coverprofiles of the targets into the path expected
+// by go test and removes them. The other output files stay per target.
+func (self SshCmd) mergeOutput(out outputFile, targets []string) error {
+	log := self.opts.logger
+	var srcs []string
+	for _, target := range targets {
+		src := out.local + "." + target
+		if _, err := os.Stat(src); err == nil {
+			srcs = append(srcs, src)
+		}
+	}
+	if out.flag != "coverprofile" {
+		log.Info("output file per target", "flag", out.flag, "paths", srcs)
+		return nil
+	}
+	log.Debug("merge coverprofiles", "srcs", srcs, "dst", out.local)
+	if err := mergeCoverProfiles(out.local, srcs); err != nil {
+		return err
+	}
+	for _, src := range srcs {
+		os.Remove(src)
+	}
+	return nil
+}
+
+// matrixError returns the combined outcome of the targets: nil if all passed,
+// a testExitError with the exit code of the first failed target if all ran,
+// else an error.
+func matrixError(results []matrixResult) error {
+	var failed []string
+	var code int
+	var infra bool
+	for _, res := range results {
+		if res.err == nil {
+			continue
+		}
+		failed = append(failed, res.target)
+		var testErr *testExitError
+		if errors.As(res.err, &testErr) {
+			if code == 0 {
+				code = testErr.code
+			}
+		} else {
+			infra = true
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("matrix: %d of %d targets failed: %s", len(failed),
+		len(results), strings.Join(failed, ", "))
+	if infra {
+		return errors.New("sshRun: " + msg)
+	}
+	return &testExitError{code: code, msg: msg}
+}
+
+// groupWriter accumulates the output of a target, written concurrently by
+// the stdout and stderr of the session.
+type groupWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (self *groupWriter) Write(p []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.buf.Write(p)
+}
+
+// prefixWriter writes each complete line to out, prefixed, holding mu so that
+// the lines of the targets do not mix.
+type prefixWriter struct {
+	out    io.Writer
+	prefix string
+	mu     *sync.Mutex
+	//
+	lineMu sync.Mutex // stdout and stderr of the session write concurrently
+	line   []byte
+}
+
+func (self *prefixWriter) Write(p []byte) (int, error) {
+	self.lineMu.Lock()
+	defer self.lineMu.Unlock()
+	self.line = append(self.line, p...)
+	for {
+		i := bytes.IndexByte(self.line, '\n')
+		if i == -1 {
+			break
+		}
+		self.writeLine(self.line[:i+1])
+		self.line = self.line[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes the last line, if not terminated by a newline.
+func (self *prefixWriter) Flush() {
+	self.lineMu.Lock()
+	defer self.lineMu.Unlock()
+	if len(self.line) > 0 {
+		self.writeLine(append(self.line, '\n'))
+		self.line = nil
+	}
+}
+
+func (self *prefixWriter) writeLine(line []byte) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	io.WriteString(self.out, self.prefix)
+	self.out.Write(line)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestSshCmdRunMatrix(t *testing.T) {
+	sshConfigA, homeA := startShellServer(t)
+	sshConfigB, homeB := startShellServer(t)
+	writeFiles(t, homeA, map[string]string{"name": "a"})
+	writeFiles(t, homeB, map[string]string{"name": "b"})
+	testBinary := writeTestBinary(t, `
+name=$(cat "$HOME/name")
+echo "out $name"
+for arg; do
+  case $arg in
+  -test.coverprofile=*)
+    printf 'mode: set\nx.go:1.1,2.2 1 1\n' > "${arg#*=}" ;;
+  -test.run=fail) [ "$name" = b ] && exit 3 ;;
+  esac
+done
+exit 0
+`)
+
+	testCases := []struct {
+		name       string
+		output     string // --matrix-output
+		flags      []string
+		host       string // of target b
+		wantErr    string
+		wantCode   int    // of testExitError
+		wantStdout string // sorted lines
+		wantResult map[string]string
+		wantCover  string
+	}{
+		{
+			name:       "group",
+			wantStdout: "=== xprog target a\n=== xprog target b\nout a\nout b\n",
+			wantResult: map[string]string{"a": "ok", "b": "ok"},
+		},
+		{
+			name:       "prefix",
+			output:     "prefix",
+			wantStdout: "[a] out a\n[b] out b\n",
+			wantResult: map[string]string{"a": "ok", "b": "ok"},
+		},
+		{
+			name:       "any failure fails",
+			output:     "prefix",
+			flags:      []string{"-test.run=fail"},
+			wantErr:    "matrix: 1 of 2 targets failed: b",
+			wantCode:   3,
+			wantStdout: "[a] out a\n[b] out b\n",
+			wantResult: map[string]string{"a": "ok", "b": "FAIL (exit 3)"},
+		},
+		{
+			name:       "coverprofiles are merged",
+			output:     "prefix",
+			flags:      []string{"-test.coverprofile=HOSTDIR/cover.out"},
+			wantStdout: "[a] out a\n[b] out b\n",
+			wantResult: map[string]string{"a": "ok", "b": "ok"},
+			wantCover:  "mode: set\nx.go:1.1,2.2 1 1\n",
+		},
+		{
+			name:       "infrastructure failure",
+			output:     "prefix",
+			host:       "unknown",
+			wantErr:    "sshRun: matrix: 1 of 2 targets failed: b",
+			wantStdout: "[a] out a\n",
+			wantResult: map[string]string{"a": "ok", "b": "ERROR:"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hostDir := t.TempDir()
+			var flags []string
+			for _, flag := range tc.flags {
+				flags = append(flags, strings.Replace(flag, "HOSTDIR", hostDir, 1))
+			}
+			hostB := tc.host
+			if hostB == "" {
+				hostB = "target"
+			}
+			var stdout, out bytes.Buffer
+			sut := SshCmd{
+				CommonArgs:   CommonArgs{TestBinary: testBinary, GoTestFlag: flags},
+				MatrixOutput: tc.output,
+				opts:         Opts{logger: hclog.NewNullLogger(), out: &out},
+				matrix: []matrixTarget{
+					{name: "a", host: "target", cfg: sshConfigA},
+					{name: "b", host: hostB, cfg: sshConfigB},
+				},
+				stdout: &stdout,
+			}
+
+			err := sut.Run(sut.opts)
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			want := tc.wantErr
+			if want == "" {
+				want = "<no error>"
+			}
+			if have != want {
+				t.Errorf("error: have: %s; want: %s", have, want)
+			}
+			var testErr *testExitError
+			if errors.As(err, &testErr) != (tc.wantCode != 0) {
+				t.Errorf("testExitError: have: %v; want: %v", testErr != nil, tc.wantCode != 0)
+			} else if testErr != nil && testErr.code != tc.wantCode {
+				t.Errorf("exit code: have: %d; want: %d", testErr.code, tc.wantCode)
+			}
+
+			lines := strings.SplitAfter(stdout.String(), "\n")
+			sort.Strings(lines)
+			if diff := cmp.Diff(strings.Join(lines, ""), tc.wantStdout); diff != "" {
+				t.Errorf("\nstdout mismatch (-have, +want)\n%s", diff)
+			}
+
+			haveResult := map[string]string{}
+			row := regexp.MustCompile(`^(\w+) +\S* +(ok|FAIL \(exit \d+\)|ERROR:)`)
+			for _, line := range strings.Split(out.String(), "\n") {
+				if m := row.FindStringSubmatch(line); m != nil {
+					haveResult[m[1]] = m[2]
+				}
+			}
+			if diff := cmp.Diff(haveResult, tc.wantResult); diff != "" {
+				t.Errorf("\nsummary mismatch (-have, +want)\n%s\n%s", diff, out.String())
+			}
+
+			if tc.wantCover != "" {
+				haveFiles := readFiles(t, hostDir)
+				wantFiles := map[string]string{"cover.out": tc.wantCover}
+				if diff := cmp.Diff(haveFiles, wantFiles); diff != "" {
+					t.Errorf("\noutput files mismatch (-have, +want)\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	var mu sync.Mutex
+	sut := &prefixWriter{out: &out, prefix: "[a] ", mu: &mu}
+
+	for _, s := range []string{"one\ntw", "o\n", "\nthree"} {
+		if _, err := sut.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sut.Flush()
+
+	if have, want := out.String(), "[a] one\n[a] two\n[a] \n[a] three\n"; have != want {
+		t.Errorf("have: %q; want: %q", have, want)
+	}
+}
+
+func TestSshCmdRunMatrixUnsupported(t *testing.T) {
+	testCases := []struct {
+		name    string
+		sut     SshCmd
+		wantErr string
+	}{
+		{
+			name:    "sync-back",
+			sut:     SshCmd{SyncBack: []string{"testdata"}},
+			wantErr: "sshRun: --sync-back is not supported with a matrix of targets",
+		},
+		{
+			name: "fuzz",
+			sut: SshCmd{CommonArgs: CommonArgs{
+				GoTestFlag: []string{"-test.fuzz=FuzzX"}}},
+			wantErr: "sshRun: -fuzz is not supported with a matrix of targets",
+		},
+		{
+			name: "go test -json",
+			sut: SshCmd{CommonArgs: CommonArgs{
+				GoTestFlag: []string{"-test.v=test2json"}}},
+			wantErr: "sshRun: go test -json is not supported with a matrix of targets",
+		},
+		{
+			name:    "matrix output",
+			sut:     SshCmd{MatrixOutput: "mixed"},
+			wantErr: "sshRun: --matrix-output mixed: want group or prefix",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.sut.matrix = []matrixTarget{{name: "a"}, {name: "b"}}
+			tc.sut.opts = Opts{logger: hclog.NewNullLogger()}
+
+			err := tc.sut.runMatrix()
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			if have != tc.wantErr {
+				t.Errorf("error: have: %s; want: %s", have, tc.wantErr)
+			}
+		})
+	}
+}
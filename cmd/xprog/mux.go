@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+)
+
+// Connection multiplexing. go test ./... runs an xprog process per package, in
+// parallel: each one would connect, do the SSH handshake and authenticate, and
+// a target with a low MaxStartups resets some of them. As the ControlMaster of
+// OpenSSH, a daemon keeps a single connection to the target, and the xprog
+// processes open their channels over it, connecting to the daemon via a Unix
+// socket. On the socket the daemon speaks SSH too, so that sessions, SFTP and
+// signals work unchanged.
+
+const (
+	// Appended to ControlPath, so that the socket of the daemon does not clash
+	// with the one of a master connection of ssh, speaking another protocol.
+	muxSocketSuffix = ".xprog"
+	// Time given to the daemon, besides the connect timeout, to start; also
+	// the minimum time it waits for its first client.
+	muxStartGrace = 10 * time.Second
+	// Global request of a client, answered with the fingerprint of the host
+	// key of the target.
+	muxHostKeyRequest = "hostkey@xprog"
+)
+
+// muxConfig is the multiplexing configuration of a target, from the keys
+// ControlMaster, ControlPath and ControlPersist of the ssh_config file.
+type muxConfig struct {
+	master  string        // yes, no, ask, auto or autoask
+	socket  string        // ControlPath plus muxSocketSuffix
+	persist time.Duration // idle time before the daemon exits; < 0 forever
+}
+
+// newMuxConfig returns the multiplexing configuration of host, nil if it has
+// no ControlPath.
+func newMuxConfig(host Host) (*muxConfig, error) {
+	path := host.GetDef("ControlPath", "none")
+	if path == "none" {
+		return nil, nil
+	}
+	master := strings.ToLower(host.GetDef("ControlMaster", "no"))
+	switch master {
+	case "yes", "no", "ask", "auto", "autoask":
+	default:
+		return nil, fmt.Errorf("ssh_config: ControlMaster %s: want yes, no, ask, auto or autoask",
+			master)
+	}
+	val := host.GetDef("ControlPersist", "no")
+	persist, err := parseControlPersist(val)
+	if err != nil {
+		return nil, fmt.Errorf("ssh_config: ControlPersist %s: want yes, no or a time such as 10m",
+			val)
+	}
+	return &muxConfig{master: master, socket: path + muxSocketSuffix, persist: persist}, nil
+}
+
+// parseControlPersist parses the value of ControlPersist: yes or 0 (forever),
+// no, or a time in the format of sshd_config(5), such as 90, 10m or 1h30m.
+func parseControlPersist(val string) (time.Duration, error) {
+	switch strings.ToLower(val) {
+	case "yes":
+		return -1, nil
+	case "no":
+		return 0, nil
+	}
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+	var total time.Duration
+	for rest := strings.ToLower(val); rest != ""; {
+		i := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+		if i == -1 {
+			i = len(rest)
+		}
+		num, err := strconv.Atoi(rest[:i])
+		if err != nil {
+			return 0, err
+		}
+		unit := time.Second
+		if i < len(rest) {
+			var ok bool
+			if unit, ok = units[rest[i]]; !ok {
+				return 0, fmt.Errorf("unknown unit %c", rest[i])
+			}
+			i++
+		}
+		total += time.Duration(num) * unit
+		rest = rest[i:]
+	}
+	if total == 0 {
+		return -1, nil
+	}
+	return total, nil
+}
+
+// dialMux connects to the target through the multiplexing daemon, starting it
+// if not running, unless ControlMaster is no: then it connects directly.
+// ControlMaster ask and autoask behave as yes and auto, since xprog cannot ask
+// for confirmation; yes uses a running daemon as auto, so that the concurrent
+// xprog processes share it.
+func (self *sshTarget) dialMux() (*ssh.Client, error) {
+	timeout := self.cfg.Timeout + muxStartGrace
+	client, err := self.mux.connect(timeout)
+	if err == nil {
+		self.hostKey = muxHostKey(client)
+		self.log.Debug("mux: shared connection", "socket", self.mux.socket)
+		return client, nil
+	}
+	if self.mux.master == "no" {
+		self.log.Debug("mux: no daemon, connecting directly", "socket", self.mux.socket,
+			"err", err)
+		return self.dial(0)
+	}
+	self.log.Debug("mux: starting daemon", "socket", self.mux.socket,
+		"persist", self.mux.persist)
+	if err := self.startMux(timeout); err != nil {
+		return nil, fmt.Errorf("mux: %s", err)
+	}
+	client, err = self.mux.connect(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("mux: %s: %s", self.mux.socket, err)
+	}
+	self.hostKey = muxHostKey(client)
+	self.log.Debug("mux: shared connection", "socket", self.mux.socket)
+	return client, nil
+}
+
+// muxHostKey returns the fingerprint of the host key of the target, as seen by
+// the daemon of client; empty if the daemon does not tell.
+func muxHostKey(client *ssh.Client) string {
+	ok, fingerprint, err := client.SendRequest(muxHostKeyRequest, true, nil)
+	if err != nil || !ok {
+		return ""
+	}
+	return string(fingerprint)
+}
+
+// connect connects to the daemon listening on the socket.
+func (self *muxConfig) connect(timeout time.Duration) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("unix", self.socket, timeout)
+	if err != nil {
+		return nil, err
+	}
+	// The daemon accepts once connected to the target.
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, self.socket, &ssh.ClientConfig{
+		User: "xprog",
+		// As for ControlMaster, the socket, accessible only by its owner, is
+		// the authentication. The host key of the daemon is ephemeral.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// startMux starts the daemon, detached, and waits for it to be connected to
+// the target. Its output, until it prints "ready", is the reason of failure.
+func (self *sshTarget) startMux(timeout time.Duration) error {
+	if self.sshConf.path == "" {
+		return errors.New("no ssh_config file for the daemon")
+	}
+	cfg, err := filepath.Abs(self.sshConf.path)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, "mux", "--cfg", cfg, "--host", self.alias,
+		"--connect-timeout", self.cfg.Timeout.String())
+	// Not in the package directory, which could be removed, and without the
+	// project configuration.
+	cmd.Dir = "/"
+	detachProcess(cmd)
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	cmd.Stdout = wr
+	cmd.Stderr = wr
+	err = cmd.Start()
+	wr.Close()
+	if err != nil {
+		return err
+	}
+
+	readyCh := make(chan error, 1)
+	go func() {
+		var out []string
+		scanner := bufio.NewScanner(rd)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "ready" {
+				readyCh <- nil
+				return
+			}
+			out = append(out, strings.TrimPrefix(line, "xprog: mux: "))
+		}
+		if len(out) == 0 {
+			out = append(out, "daemon exited before being ready")
+		}
+		readyCh <- errors.New(strings.Join(out, "; "))
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-readyCh:
+		if err != nil {
+			cmd.Wait()
+			return err
+		}
+		return cmd.Process.Release()
+	case <-timer.C:
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("daemon not ready after %s", timeout)
+	}
+}
+
+type MuxCmd struct {
+	SshConfig      string        `arg:"--cfg,required" help:"path to the ssh_config file"`
+	Host           string        `arg:"--host,required" help:"host alias in the ssh_config file"`
+	ConnectTimeout time.Duration `arg:"--connect-timeout" help:"timeout to connect to the target (default: ConnectTimeout of ssh_config, else 10s)"`
+	//
+	stdout io.Writer
+}
+
+// Run is the multiplexing daemon, started by xprog ssh: it connects to the
+// target and serves the xprog processes connecting to its socket, until the
+// connection drops or it is idle for ControlPersist. It prints "ready" once
+// connected, and nothing after.
+func (self MuxCmd) Run(opts Opts) error {
+	log := opts.logger
+	if self.stdout == nil {
+		self.stdout = os.Stdout
+	}
+	sshConf, err := loadSshConfig(self.SshConfig)
+	if err != nil {
+		return fmt.Errorf("mux: %s", err)
+	}
+	target, err := newSshTarget(sshConf, jumpHost{alias: self.Host}, log)
+	if err != nil {
+		return fmt.Errorf("mux: %s", err)
+	}
+	defer target.Close()
+	mux := target.mux
+	if mux == nil {
+		return fmt.Errorf("mux: ssh_config %s: host %s: missing ControlPath",
+			self.SshConfig, self.Host)
+	}
+	// The daemon connects directly.
+	target.mux = nil
+	if self.ConnectTimeout > 0 {
+		target.cfg.Timeout = self.ConnectTimeout
+	}
+
+	listener, err := mux.listen()
+	if errors.Is(err, errMuxRunning) {
+		fmt.Fprintln(self.stdout, "ready")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("mux: %s", err)
+	}
+	conn, err := target.Dial()
+	if err != nil {
+		os.Remove(mux.socket)
+		listener.Close()
+		return fmt.Errorf("mux: %s", err)
+	}
+	server, err := newMuxServer(conn, mux, target.hostKey, hclog.NewNullLogger())
+	if err != nil {
+		os.Remove(mux.socket)
+		listener.Close()
+		return fmt.Errorf("mux: %s", err)
+	}
+	fmt.Fprintln(self.stdout, "ready")
+	server.Serve(listener)
+	return nil
+}
+
+var errMuxRunning = errors.New("daemon already running")
+
+// listen creates the socket, unless another daemon listens on it. As OpenSSH,
+// it binds a temporary name and links it to the socket path, so that only one
+// of the concurrent daemons wins.
+func (self *muxConfig) listen() (*net.UnixListener, error) {
+	tmp := fmt.Sprintf("%s.%d", self.socket, os.Getpid())
+	os.Remove(tmp)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	defer os.Remove(tmp)
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		err := os.Link(tmp, self.socket)
+		if err == nil {
+			return listener, nil
+		}
+		if !errors.Is(err, fs.ErrExist) || attempt > 0 {
+			listener.Close()
+			return nil, err
+		}
+		if conn, err := net.Dial("unix", self.socket); err == nil {
+			conn.Close()
+			listener.Close()
+			return nil, errMuxRunning
+		}
+		// Left by a daemon that was killed.
+		os.Remove(self.socket)
+	}
+}
+
+// muxServer forwards the channels opened by its clients to the connection to
+// the target.
+type muxServer struct {
+	upstream *ssh.Client
+	hostKey  string // fingerprint of the host key of the target
+	socket   string
+	persist  time.Duration
+	config   *ssh.ServerConfig
+	log      hclog.Logger
+	//
+	mu       sync.Mutex
+	clients  int
+	idle     *time.Timer
+	listener net.Listener
+	closed   bool
+}
+
+func newMuxServer(upstream *ssh.Client, mux *muxConfig, hostKey string,
+	log hclog.Logger) (*muxServer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	return &muxServer{
+		upstream: upstream,
+		hostKey:  hostKey,
+		socket:   mux.socket,
+		persist:  mux.persist,
+		config:   config,
+		log:      log,
+	}, nil
+}
+
+// Serve accepts clients on listener until the connection to the target drops
+// or no client is connected for the persist time.
+func (self *muxServer) Serve(listener net.Listener) {
+	self.mu.Lock()
+	self.listener = listener
+	if self.persist >= 0 {
+		self.idle = time.AfterFunc(max(self.persist, muxStartGrace), self.expire)
+	}
+	self.mu.Unlock()
+	go func() {
+		err := self.upstream.Wait()
+		self.log.Debug("mux: connection to target closed", "err", err)
+		self.shutdown()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go self.serveConn(conn)
+	}
+	self.shutdown()
+}
+
+// shutdown removes the socket, first, so that new clients start a new daemon,
+// then closes the connection to the target.
+func (self *muxServer) shutdown() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return
+	}
+	self.closed = true
+	os.Remove(self.socket)
+	self.listener.Close()
+	self.upstream.Close()
+}
+
+// track counts the connected clients, arming the idle timer when none is.
+func (self *muxServer) track(delta int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.clients += delta
+	if self.idle != nil {
+		self.idle.Stop()
+		self.idle = nil
+	}
+	if self.clients == 0 && self.persist >= 0 && !self.closed {
+		self.idle = time.AfterFunc(self.persist, self.expire)
+	}
+}
+
+func (self *muxServer) expire() {
+	self.mu.Lock()
+	idle := self.clients == 0
+	self.mu.Unlock()
+	if idle {
+		self.log.Debug("mux: idle, exiting", "persist", self.persist)
+		self.shutdown()
+	}
+}
+
+func (self *muxServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, self.config)
+	if err != nil {
+		self.log.Debug("mux: client handshake", "err", err)
+		return
+	}
+	defer sconn.Close()
+	self.track(1)
+	defer self.track(-1)
+	go self.serveRequests(reqs)
+	for newCh := range chans {
+		go self.forwardChannel(newCh)
+	}
+}
+
+// serveRequests answers the global requests of a client, rejecting the ones
+// other than muxHostKeyRequest.
+func (self *muxServer) serveRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type == muxHostKeyRequest {
+			req.Reply(true, []byte(self.hostKey))
+			continue
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// forwardChannel opens on the target the channel requested by a client, and
+// proxies data and requests between the two.
+func (self *muxServer) forwardChannel(newCh ssh.NewChannel) {
+	remote, remoteReqs, err := self.upstream.OpenChannel(newCh.ChannelType(),
+		newCh.ExtraData())
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			newCh.Reject(openErr.Reason, openErr.Message)
+		} else {
+			newCh.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	local, localReqs, err := newCh.Accept()
+	if err != nil {
+		remote.Close()
+		return
+	}
+
+	go func() {
+		io.Copy(remote, local)
+		remote.CloseWrite()
+	}()
+	go io.Copy(remote.Stderr(), local.Stderr())
+	// The replies to the requests of the client, such as exec, must precede
+	// the close of its channel.
+	var replying sync.Mutex
+	go func() {
+		for req := range localReqs {
+			replying.Lock()
+			forwardRequest(remote, req)
+			replying.Unlock()
+		}
+		// The client closed the channel, for example to stop a command.
+		remote.Close()
+	}()
+
+	// The exit status comes as a request before the target closes the
+	// channel: the client channel is closed after forwarding it.
+	var toLocal sync.WaitGroup
+	toLocal.Add(2)
+	go func() {
+		defer toLocal.Done()
+		var output sync.WaitGroup
+		output.Add(1)
+		go func() {
+			defer output.Done()
+			io.Copy(local.Stderr(), remote.Stderr())
+		}()
+		io.Copy(local, remote)
+		output.Wait()
+		local.CloseWrite()
+	}()
+	go func() {
+		defer toLocal.Done()
+		for req := range remoteReqs {
+			forwardRequest(local, req)
+		}
+	}()
+	toLocal.Wait()
+	replying.Lock()
+	local.Close()
+	replying.Unlock()
+}
+
+// forwardRequest sends req to dst, relaying the reply.
+func forwardRequest(dst ssh.Channel, req *ssh.Request) {
+	ok, err := dst.SendRequest(req.Type, req.WantReply, req.Payload)
+	if req.WantReply {
+		req.Reply(ok && err == nil, nil)
+	}
+}
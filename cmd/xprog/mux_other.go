@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// detachProcess makes cmd outlive xprog.
+func detachProcess(cmd *exec.Cmd) {}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestParseControlPersist(t *testing.T) {
+	testCases := []struct {
+		val     string
+		want    time.Duration
+		wantErr string
+	}{
+		{val: "no", want: 0},
+		{val: "yes", want: -1},
+		{val: "0", want: -1},
+		{val: "90", want: 90 * time.Second},
+		{val: "10m", want: 10 * time.Minute},
+		{val: "1h30M", want: 90 * time.Minute},
+		{val: "1w2d", want: 9 * 24 * time.Hour},
+		{val: "10y", wantErr: "unknown unit y"},
+		{val: "m", wantErr: `strconv.Atoi: parsing "": invalid syntax`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.val, func(t *testing.T) {
+			have, err := parseControlPersist(tc.val)
+
+			haveErr := "<no error>"
+			if err != nil {
+				haveErr = err.Error()
+			}
+			wantErr := tc.wantErr
+			if wantErr == "" {
+				wantErr = "<no error>"
+			}
+			if haveErr != wantErr {
+				t.Fatalf("error: have: %s; want: %s", haveErr, wantErr)
+			}
+			if have != tc.want {
+				t.Errorf("have: %s; want: %s", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewSshTargetMux(t *testing.T) {
+	testCases := []struct {
+		name    string
+		conf    string
+		want    *muxConfig
+		wantErr string
+	}{
+		{
+			name: "no ControlPath",
+			conf: "  ControlMaster auto\n",
+		},
+		{
+			name: "ControlPath none",
+			conf: "  ControlMaster auto\n  ControlPath none\n",
+		},
+		{
+			name: "defaults",
+			conf: "  ControlPath /tmp/%n-%p\n",
+			want: &muxConfig{master: "no", socket: "/tmp/target-22.xprog"},
+		},
+		{
+			name: "auto and persist",
+			conf: "  ControlMaster Auto\n  ControlPath /tmp/%r@%h\n  ControlPersist 5m\n",
+			want: &muxConfig{
+				master:  "auto",
+				socket:  "/tmp/tester@127.0.0.1.xprog",
+				persist: 5 * time.Minute,
+			},
+		},
+		{
+			name:    "invalid ControlMaster",
+			conf:    "  ControlMaster maybe\n  ControlPath /tmp/x\n",
+			wantErr: "ssh_config: ControlMaster maybe: want yes, no, ask, auto or autoask",
+		},
+		{
+			name:    "invalid ControlPersist",
+			conf:    "  ControlPath /tmp/x\n  ControlPersist forever\n",
+			wantErr: "ssh_config: ControlPersist forever: want yes, no or a time such as 10m",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestSshConfig(t, "Host target\n"+tc.conf)
+			sshConf, err := loadSshConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sut, err := newSshTarget(sshConf, jumpHost{alias: "target"},
+				hclog.NewNullLogger())
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			wantErr := tc.wantErr
+			if wantErr == "" {
+				wantErr = "<no error>"
+			}
+			if have != wantErr {
+				t.Fatalf("error: have: %s; want: %s", have, wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer sut.Close()
+			if diff := cmp.Diff(sut.mux, tc.want, cmp.AllowUnexported(muxConfig{})); diff != "" {
+				t.Errorf("mux mismatch (-have, +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+// startCountingProxy forwards the TCP connections to the port of the ssh_config
+// file sshConfig, counting them. It returns the ssh_config file for the proxy,
+// with the lines of conf.
+func startCountingProxy(t *testing.T, sshConfig string, conf string) (string, func() int) {
+	t.Helper()
+	sshConf, err := loadSshConfig(sshConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := sshConf.Resolve("target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := host.Get("Port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var mu sync.Mutex
+	var count int
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			count++
+			mu.Unlock()
+			go func() {
+				defer conn.Close()
+				server, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+				if err != nil {
+					return
+				}
+				defer server.Close()
+				go func() {
+					io.Copy(server, conn)
+					server.Close()
+				}()
+				io.Copy(conn, server)
+			}()
+		}
+	}()
+	_, proxyPort, _ := net.SplitHostPort(listener.Addr().String())
+
+	return writeTestSshConfig(t, "Host target\n  Port "+proxyPort+"\n"+conf),
+		func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return count
+		}
+}
+
+func TestSshCmdRunMux(t *testing.T) {
+	// The daemon is the test binary, see TestMain.
+	t.Setenv("XPROG_TEST_MAIN", "1")
+	shellConfig, _ := startShellServer(t)
+	socketDir := t.TempDir()
+	sshConfig, connections := startCountingProxy(t, shellConfig,
+		"  ControlMaster auto\n  ControlPath "+socketDir+"/%n\n  ControlPersist 1\n")
+	testBinary := writeTestBinary(t, "echo shared\n")
+	const runs = 4
+
+	var wg sync.WaitGroup
+	errs := make([]error, runs)
+	stdouts := make([]strings.Builder, runs)
+	for i := range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sut := SshCmd{
+				CommonArgs: CommonArgs{TestBinary: testBinary},
+				SshConfig:  sshConfig,
+				NoBinCache: true,
+				opts:       Opts{logger: hclog.NewNullLogger()},
+				stdout:     &stdouts[i],
+				stderr:     io.Discard,
+			}
+			errs[i] = sut.Run(sut.opts)
+		}()
+	}
+	wg.Wait()
+
+	for i := range runs {
+		if errs[i] != nil {
+			t.Errorf("run %d: %s", i, errs[i])
+		}
+		if have, want := stdouts[i].String(), "shared\n"; have != want {
+			t.Errorf("run %d: stdout: have: %q; want: %q", i, have, want)
+		}
+	}
+	if have, want := connections(), 1; have != want {
+		t.Errorf("connections to target: have: %d; want: %d", have, want)
+	}
+	// After ControlPersist, the daemon exits, removing its socket.
+	socket := filepath.Join(socketDir, "target"+muxSocketSuffix)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(socket); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("daemon still running: socket %s exists", socket)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSshCmdRunMuxErrors(t *testing.T) {
+	t.Setenv("XPROG_TEST_MAIN", "1")
+	shellConfig, _ := startShellServer(t)
+	testCases := []struct {
+		name    string
+		conf    string
+		wantLog string
+		wantErr string
+	}{
+		{
+			name:    "ControlMaster no, without daemon",
+			conf:    "  ControlMaster no\n  ControlPath " + t.TempDir() + "/%n\n",
+			wantLog: "mux: no daemon, connecting directly",
+		},
+		{
+			name:    "daemon fails",
+			conf:    "  ControlMaster auto\n  ControlPath /nonexistent/%n\n",
+			wantErr: "sshRun: mux: listen unix /nonexistent/target.xprog.",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sshConfig, _ := startCountingProxy(t, shellConfig, tc.conf)
+			var logs strings.Builder
+			sut := SshCmd{
+				CommonArgs: CommonArgs{TestBinary: writeTestBinary(t, "true\n")},
+				SshConfig:  sshConfig,
+				NoBinCache: true,
+				opts: Opts{logger: hclog.New(&hclog.LoggerOptions{
+					Output: &logs,
+					Level:  hclog.Debug,
+				})},
+				stdout: io.Discard,
+				stderr: io.Discard,
+			}
+
+			err := sut.Run(sut.opts)
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("error: have: %s; want: <no error>", have)
+			}
+			if !strings.HasPrefix(have, tc.wantErr) {
+				t.Errorf("error: have: %s; want prefix: %s", have, tc.wantErr)
+			}
+			if !strings.Contains(logs.String(), tc.wantLog) {
+				t.Errorf("want log %q; logs:\n%s", tc.wantLog, logs.String())
+			}
+		})
+	}
+}
+
+func TestSshTargetMuxHostKey(t *testing.T) {
+	t.Setenv("XPROG_TEST_MAIN", "1")
+	shellConfig, _ := startShellServer(t)
+	sshConfig, _ := startCountingProxy(t, shellConfig,
+		"  ControlMaster auto\n  ControlPath "+t.TempDir()+"/%n\n  ControlPersist 1\n")
+	dialHostKey := func(path string) string {
+		t.Helper()
+		sshConf, err := loadSshConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sut, err := newSshTarget(sshConf, jumpHost{alias: "target"}, hclog.NewNullLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sut.Close()
+		conn, err := sut.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		return sut.hostKey
+	}
+
+	direct := dialHostKey(shellConfig)
+	// The daemon tells the host key of the target, not its own.
+	viaMux := dialHostKey(sshConfig)
+
+	if !strings.HasPrefix(direct, "SHA256:") {
+		t.Fatalf("direct: have: %q; want: SHA256 fingerprint", direct)
+	}
+	if viaMux != direct {
+		t.Errorf("via mux: have: %q; want: %q", viaMux, direct)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+)
+
+// outputFlags are the flags of the test binary naming a file that it writes.
+// On the target they are rewritten to a remote path and the files are then
+// downloaded to where go test expects them.
+var outputFlags = []string{
+	"coverprofile",
+	"cpuprofile",
+	"memprofile",
+	"blockprofile",
+	"mutexprofile",
+	"trace",
+}
+
+// outputFile is a file written by the test binary on the target.
+type outputFile struct {
+	flag   string // for example "cpuprofile"
+	local  string // path on the host, where go test expects it
+	remote string // path on the target
+}
+
+// rewriteOutputFlags rewrites the output flags and -test.outputdir to point
+// to remoteDir and returns the files to download after the run.
+//
+// As the testing package, a relative path is relative to -test.outputdir if
+// given (go test passes it, absolute, when a profile is requested), else to
+// the working directory.
+func rewriteOutputFlags(flags *testFlags, remoteDir string) []outputFile {
+	outputDir, _ := flags.Lookup("outputdir")
+	var files []outputFile
+	for _, name := range outputFlags {
+		remotePath := func(val string) string {
+			if val == "" {
+				return val
+			}
+			return path.Join(remoteDir, name+"-"+filepath.Base(val))
+		}
+		// As with the flag package, the last occurrence wins.
+		val, ok := flags.Lookup(name)
+		if !ok || val == "" {
+			continue
+		}
+		local := val
+		if outputDir != "" && !filepath.IsAbs(val) {
+			local = filepath.Join(outputDir, val)
+		}
+		files = append(files, outputFile{
+			flag:   name,
+			local:  local,
+			remote: remotePath(val),
+		})
+		flags.Rewrite(name, remotePath)
+	}
+	flags.Rewrite("outputdir", func(string) string { return remoteDir })
+	return files
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRewriteOutputFlags(t *testing.T) {
+	testCases := []struct {
+		name      string
+		flags     []string
+		wantFlags []string
+		wantFiles []outputFile
+	}{
+		{
+			name:      "no output flags",
+			flags:     []string{"-test.v=true", "-test.run", "TestFoo"},
+			wantFlags: []string{"-test.v=true", "-test.run", "TestFoo"},
+		},
+		{
+			name:      "absolute coverprofile, as passed by go test",
+			flags:     []string{"-test.coverprofile=/tmp/go-build1/b001/_cover_.out"},
+			wantFlags: []string{"-test.coverprofile=/R/coverprofile-_cover_.out"},
+			wantFiles: []outputFile{
+				{flag: "coverprofile", local: "/tmp/go-build1/b001/_cover_.out",
+					remote: "/R/coverprofile-_cover_.out"},
+			},
+		},
+		{
+			name: "all the output flags, relative to outputdir",
+			flags: []string{
+				"-test.cpuprofile=cpu.out",
+				"-test.memprofile=mem.out",
+				"-test.blockprofile=block.out",
+				"-test.mutexprofile=mutex.out",
+				"-test.trace=trace.out",
+				"-test.outputdir=/home/me/pkg",
+			},
+			wantFlags: []string{
+				"-test.cpuprofile=/R/cpuprofile-cpu.out",
+				"-test.memprofile=/R/memprofile-mem.out",
+				"-test.blockprofile=/R/blockprofile-block.out",
+				"-test.mutexprofile=/R/mutexprofile-mutex.out",
+				"-test.trace=/R/trace-trace.out",
+				"-test.outputdir=/R",
+			},
+			wantFiles: []outputFile{
+				{flag: "cpuprofile", local: "/home/me/pkg/cpu.out", remote: "/R/cpuprofile-cpu.out"},
+				{flag: "memprofile", local: "/home/me/pkg/mem.out", remote: "/R/memprofile-mem.out"},
+				{flag: "blockprofile", local: "/home/me/pkg/block.out", remote: "/R/blockprofile-block.out"},
+				{flag: "mutexprofile", local: "/home/me/pkg/mutex.out", remote: "/R/mutexprofile-mutex.out"},
+				{flag: "trace", local: "/home/me/pkg/trace.out", remote: "/R/trace-trace.out"},
+			},
+		},
+		{
+			name:      "relative without outputdir: working directory",
+			flags:     []string{"-test.cpuprofile=prof/cpu.out"},
+			wantFlags: []string{"-test.cpuprofile=/R/cpuprofile-cpu.out"},
+			wantFiles: []outputFile{
+				{flag: "cpuprofile", local: "prof/cpu.out", remote: "/R/cpuprofile-cpu.out"},
+			},
+		},
+		{
+			name:      "absolute path ignores outputdir",
+			flags:     []string{"-test.outputdir=/home/me/pkg", "-test.trace=/tmp/trace.out"},
+			wantFlags: []string{"-test.outputdir=/R", "-test.trace=/R/trace-trace.out"},
+			wantFiles: []outputFile{
+				{flag: "trace", local: "/tmp/trace.out", remote: "/R/trace-trace.out"},
+			},
+		},
+		{
+			name: "space form, double dash, '=' in path",
+			flags: []string{"-test.coverprofile", "/tmp/a=b/cover.out",
+				"--test.cpuprofile=/tmp/x=y.out", "-test.v"},
+			wantFlags: []string{"-test.coverprofile=/R/coverprofile-cover.out",
+				"-test.cpuprofile=/R/cpuprofile-x=y.out", "-test.v"},
+			wantFiles: []outputFile{
+				{flag: "coverprofile", local: "/tmp/a=b/cover.out", remote: "/R/coverprofile-cover.out"},
+				{flag: "cpuprofile", local: "/tmp/x=y.out", remote: "/R/cpuprofile-x=y.out"},
+			},
+		},
+		{
+			name:      "after the end of the flags, left alone",
+			flags:     []string{"-test.v", "--", "-test.cpuprofile=cpu.out"},
+			wantFlags: []string{"-test.v", "--", "-test.cpuprofile=cpu.out"},
+		},
+		{
+			name:      "last occurrence wins",
+			flags:     []string{"-test.cpuprofile=a.out", "-test.cpuprofile=b.out"},
+			wantFlags: []string{"-test.cpuprofile=/R/cpuprofile-a.out", "-test.cpuprofile=/R/cpuprofile-b.out"},
+			wantFiles: []outputFile{
+				{flag: "cpuprofile", local: "b.out", remote: "/R/cpuprofile-b.out"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			flags := parseTestFlags(tc.flags)
+			files := rewriteOutputFlags(flags, "/R")
+
+			if diff := cmp.Diff(flags.Args(), tc.wantFlags); diff != "" {
+				t.Errorf("\nflags mismatch (-have, +want)\n%s", diff)
+			}
+			if diff := cmp.Diff(files, tc.wantFiles,
+				cmp.AllowUnexported(outputFile{})); diff != "" {
+				t.Errorf("\nfiles mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// platform is an operating system and architecture, as GOOS and GOARCH.
+type platform struct {
+	goos   string
+	goarch string
+}
+
+func (self platform) String() string {
+	return self.goos + "/" + self.goarch
+}
+
+func (self platform) known() bool {
+	return self.goos != "" && self.goarch != ""
+}
+
+// canRun reports whether a binary for bin runs on self. As the kernels usually
+// allow, a 64-bit x86 or ARM machine runs also the 32-bit binaries.
+func (self platform) canRun(bin platform) bool {
+	if self.goos != bin.goos {
+		return false
+	}
+	switch {
+	case self.goarch == bin.goarch:
+		return true
+	case self.goarch == "amd64" && bin.goarch == "386":
+		return true
+	case self.goarch == "arm64" && bin.goarch == "arm":
+		return true
+	}
+	return false
+}
+
+// binaryPlatform returns the platform of the executable at path, from its ELF,
+// Mach-O or PE header. The zero platform means an unknown format, for example
+// a script, or an unknown architecture.
+func binaryPlatform(path string) (platform, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return platform{}, err
+	}
+	defer fi.Close()
+	var magic [4]byte
+	if _, err := fi.ReadAt(magic[:], 0); err != nil {
+		return platform{}, nil
+	}
+
+	switch {
+	case string(magic[:]) == elf.ELFMAG:
+		f, err := elf.NewFile(fi)
+		if err != nil {
+			return platform{}, err
+		}
+		return elfPlatform(f), nil
+	case string(magic[:2]) == "MZ":
+		f, err := pe.NewFile(fi)
+		if err != nil {
+			return platform{}, err
+		}
+		return platform{goos: "windows", goarch: peArchs[f.Machine]}, nil
+	default:
+		f, err := macho.NewFile(fi)
+		if err != nil {
+			// Not a Mach-O either.
+			return platform{}, nil
+		}
+		return platform{goos: "darwin", goarch: machoArchs[f.Cpu]}, nil
+	}
+}
+
+func elfPlatform(f *elf.File) platform {
+	p := platform{goos: "linux"}
+	switch {
+	case f.OSABI == elf.ELFOSABI_FREEBSD:
+		p.goos = "freebsd"
+	case f.Section(".note.netbsd.ident") != nil:
+		p.goos = "netbsd"
+	case f.Section(".note.openbsd.ident") != nil:
+		p.goos = "openbsd"
+	}
+	is64 := f.Class == elf.ELFCLASS64
+	isLE := f.Data == elf.ELFDATA2LSB
+	switch f.Machine {
+	case elf.EM_X86_64:
+		p.goarch = "amd64"
+	case elf.EM_386:
+		p.goarch = "386"
+	case elf.EM_AARCH64:
+		p.goarch = "arm64"
+	case elf.EM_ARM:
+		p.goarch = "arm"
+	case elf.EM_RISCV:
+		if is64 {
+			p.goarch = "riscv64"
+		}
+	case elf.EM_PPC64:
+		p.goarch = "ppc64"
+		if isLE {
+			p.goarch = "ppc64le"
+		}
+	case elf.EM_S390:
+		p.goarch = "s390x"
+	case elf.EM_LOONGARCH:
+		p.goarch = "loong64"
+	case elf.EM_MIPS:
+		switch {
+		case is64 && isLE:
+			p.goarch = "mips64le"
+		case is64:
+			p.goarch = "mips64"
+		case isLE:
+			p.goarch = "mipsle"
+		default:
+			p.goarch = "mips"
+		}
+	}
+	return p
+}
+
+var peArchs = map[uint16]string{
+	pe.IMAGE_FILE_MACHINE_AMD64: "amd64",
+	pe.IMAGE_FILE_MACHINE_I386:  "386",
+	pe.IMAGE_FILE_MACHINE_ARM64: "arm64",
+	pe.IMAGE_FILE_MACHINE_ARMNT: "arm",
+}
+
+var machoArchs = map[macho.Cpu]string{
+	macho.CpuAmd64: "amd64",
+	macho.CpuArm64: "arm64",
+}
+
+// parseUname returns the platform described by the output of uname -sm, for
+// example "Linux x86_64". The zero platform means unknown.
+func parseUname(uname string) platform {
+	fields := strings.Fields(uname)
+	if len(fields) != 2 {
+		return platform{}
+	}
+	sys, machine := fields[0], fields[1]
+	var p platform
+	switch {
+	case sys == "Linux":
+		p.goos = "linux"
+	case sys == "Darwin":
+		p.goos = "darwin"
+	case sys == "FreeBSD", sys == "NetBSD", sys == "OpenBSD":
+		p.goos = strings.ToLower(sys)
+	case strings.HasPrefix(sys, "MINGW"), strings.HasPrefix(sys, "MSYS"),
+		strings.HasPrefix(sys, "CYGWIN"):
+		p.goos = "windows"
+	default:
+		return platform{}
+	}
+	switch {
+	case machine == "x86_64" || machine == "amd64":
+		p.goarch = "amd64"
+	case machine == "i386" || machine == "i486" || machine == "i586" || machine == "i686":
+		p.goarch = "386"
+	case machine == "aarch64" || machine == "arm64":
+		p.goarch = "arm64"
+	case strings.HasPrefix(machine, "arm"):
+		p.goarch = "arm"
+	case machine == "loongarch64":
+		p.goarch = "loong64"
+	case machine == "riscv64", machine == "ppc64le", machine == "ppc64",
+		machine == "s390x", machine == "mips", machine == "mipsle",
+		machine == "mips64", machine == "mips64le":
+		p.goarch = machine
+	default:
+		return platform{}
+	}
+	return p
+}
+
+// checkPlatform verifies that the test binary can run on the target, before
+// uploading it, to report a forgotten GOOS or GOARCH instead of a cryptic
+// "cannot execute binary file". The output of uname -sm is cached per host key
+// of the target, not per address, that another machine can take over; on
+// mismatch it is asked again, in case the target was reinstalled.
+func (self SshCmd) checkPlatform(conn *ssh.Client) error {
+	log := self.opts.logger
+	bin, err := binaryPlatform(self.TestBinary)
+	if err != nil {
+		return fmt.Errorf("test binary %s: %s", self.TestBinary, err)
+	}
+	if !bin.known() {
+		log.Debug("test binary: unknown platform, not checking it",
+			"path", self.TestBinary)
+		return nil
+	}
+
+	cache := unameCachePath(self.target.hostKey)
+	uname, err := readUnameCache(cache)
+	fromCache := err == nil
+	for {
+		if !fromCache {
+			if uname, err = self.remoteOutput(conn, "uname -sm"); err != nil {
+				return fmt.Errorf("target platform: %s", err)
+			}
+			writeUnameCache(cache, uname)
+		}
+		target := parseUname(uname)
+		log.Debug("platform", "testbinary", bin, "target", target, "uname", uname,
+			"cached", fromCache)
+		switch {
+		case !target.known():
+			log.Debug("target: unknown platform, not checking it", "uname", uname)
+			return nil
+		case target.canRun(bin):
+			return nil
+		case fromCache:
+			fromCache = false
+			continue
+		}
+		return fmt.Errorf(
+			"test binary %s is for %s, target %s is %s (uname: %s): build with GOOS=%s GOARCH=%s",
+			filepath.Base(self.TestBinary), bin, self.addr, target, uname,
+			target.goos, target.goarch)
+	}
+}
+
+// unameCachePath returns the path of the cached uname -sm of the target with
+// host key fingerprint hostKey, empty if the host key or the cache directory
+// is unknown.
+func unameCachePath(hostKey string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil || hostKey == "" {
+		return ""
+	}
+	return filepath.Join(dir, "xprog", "uname", targetCacheName(hostKey))
+}
+
+// targetCacheName returns key, a target address or host key fingerprint, as a
+// file name.
+func targetCacheName(key string) string {
+	return strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(key)
+}
+
+func readUnameCache(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("no cache")
+	}
+	buf, err := os.ReadFile(path)
+	return strings.TrimSpace(string(buf)), err
+}
+
+// writeUnameCache writes the cache, ignoring errors: it is only an
+// optimization.
+func writeUnameCache(path string, uname string) {
+	if path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+	tmp := fmt.Sprintf("%s.%d", path, os.Getpid())
+	if err := os.WriteFile(tmp, []byte(uname+"\n"), 0o644); err != nil {
+		return
+	}
+	os.Rename(tmp, path)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// writeExecHeader writes a file with only the header of an executable of
+// format elf, macho or pe, for machine, and returns its path.
+func writeExecHeader(t *testing.T, format string, machine uint32, osabi elf.OSABI) string {
+	t.Helper()
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	switch format {
+	case "elf":
+		hdr := elf.Header64{
+			Type:      uint16(elf.ET_EXEC),
+			Machine:   uint16(machine),
+			Version:   uint32(elf.EV_CURRENT),
+			Ehsize:    64,
+			Phentsize: 56,
+			Shentsize: 64,
+		}
+		copy(hdr.Ident[:], elf.ELFMAG)
+		hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+		hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+		hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+		hdr.Ident[elf.EI_OSABI] = byte(osabi)
+		binary.Write(&buf, le, hdr)
+	case "macho":
+		binary.Write(&buf, le, macho.FileHeader{
+			Magic: macho.Magic64,
+			Cpu:   macho.Cpu(machine),
+			Type:  macho.TypeExec,
+		})
+		binary.Write(&buf, le, uint32(0)) // reserved
+	case "pe":
+		dos := make([]byte, 0x40)
+		copy(dos, "MZ")
+		le.PutUint32(dos[0x3c:], 0x40)
+		buf.Write(dos)
+		buf.WriteString("PE\x00\x00")
+		binary.Write(&buf, le, pe.FileHeader{Machine: uint16(machine)})
+	}
+	buf.Write(make([]byte, 512)) // as if followed by the rest
+	path := filepath.Join(t.TempDir(), "foo.test")
+	if err := os.WriteFile(path, buf.Bytes(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBinaryPlatform(t *testing.T) {
+	testCases := []struct {
+		name    string
+		format  string
+		machine uint32
+		osabi   elf.OSABI
+		want    platform
+	}{
+		{
+			name:    "linux/amd64",
+			format:  "elf",
+			machine: uint32(elf.EM_X86_64),
+			want:    platform{goos: "linux", goarch: "amd64"},
+		},
+		{
+			name:    "linux/arm64",
+			format:  "elf",
+			machine: uint32(elf.EM_AARCH64),
+			want:    platform{goos: "linux", goarch: "arm64"},
+		},
+		{
+			name:    "freebsd/riscv64",
+			format:  "elf",
+			machine: uint32(elf.EM_RISCV),
+			osabi:   elf.ELFOSABI_FREEBSD,
+			want:    platform{goos: "freebsd", goarch: "riscv64"},
+		},
+		{
+			name:    "darwin/arm64",
+			format:  "macho",
+			machine: uint32(macho.CpuArm64),
+			want:    platform{goos: "darwin", goarch: "arm64"},
+		},
+		{
+			name:    "windows/amd64",
+			format:  "pe",
+			machine: pe.IMAGE_FILE_MACHINE_AMD64,
+			want:    platform{goos: "windows", goarch: "amd64"},
+		},
+		{
+			name:    "unknown architecture",
+			format:  "elf",
+			machine: uint32(elf.EM_SPARCV9),
+			want:    platform{goos: "linux"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeExecHeader(t, tc.format, tc.machine, tc.osabi)
+
+			have, err := binaryPlatform(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != tc.want {
+				t.Errorf("have: %s; want: %s", have, tc.want)
+			}
+		})
+	}
+
+	t.Run("script", func(t *testing.T) {
+		have, err := binaryPlatform(writeTestBinary(t, "exit 0\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have.known() {
+			t.Errorf("have: %s; want: unknown", have)
+		}
+	})
+
+	t.Run("this test binary", func(t *testing.T) {
+		have, err := binaryPlatform(os.Args[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (platform{runtime.GOOS, runtime.GOARCH}); have != want {
+			t.Errorf("have: %s; want: %s", have, want)
+		}
+	})
+}
+
+func TestParseUname(t *testing.T) {
+	testCases := []struct {
+		uname string
+		want  platform
+	}{
+		{uname: "Linux x86_64", want: platform{"linux", "amd64"}},
+		{uname: "Linux aarch64", want: platform{"linux", "arm64"}},
+		{uname: "Linux armv7l", want: platform{"linux", "arm"}},
+		{uname: "Linux i686", want: platform{"linux", "386"}},
+		{uname: "Linux ppc64le", want: platform{"linux", "ppc64le"}},
+		{uname: "Darwin arm64", want: platform{"darwin", "arm64"}},
+		{uname: "FreeBSD amd64", want: platform{"freebsd", "amd64"}},
+		{uname: "MINGW64_NT-10.0-19045 x86_64", want: platform{"windows", "amd64"}},
+		{uname: "Plan9 x86_64", want: platform{}},
+		{uname: "Linux sparc64", want: platform{}},
+		{uname: "", want: platform{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.uname, func(t *testing.T) {
+			if have := parseUname(tc.uname); have != tc.want {
+				t.Errorf("have: %s; want: %s", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestPlatformCanRun(t *testing.T) {
+	testCases := []struct {
+		target platform
+		bin    platform
+		want   bool
+	}{
+		{target: platform{"linux", "amd64"}, bin: platform{"linux", "amd64"}, want: true},
+		{target: platform{"linux", "amd64"}, bin: platform{"linux", "386"}, want: true},
+		{target: platform{"linux", "arm64"}, bin: platform{"linux", "arm"}, want: true},
+		{target: platform{"linux", "arm64"}, bin: platform{"linux", "amd64"}, want: false},
+		{target: platform{"linux", "386"}, bin: platform{"linux", "amd64"}, want: false},
+		{target: platform{"linux", "amd64"}, bin: platform{"darwin", "amd64"}, want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.target.String()+" "+tc.bin.String(), func(t *testing.T) {
+			if have := tc.target.canRun(tc.bin); have != tc.want {
+				t.Errorf("have: %v; want: %v", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestSshCmdRunPlatformMismatch(t *testing.T) {
+	out, err := exec.Command("uname", "-sm").Output()
+	if err != nil {
+		t.Skip("skip: uname:", err)
+	}
+	uname := strings.TrimSpace(string(out))
+	target := parseUname(uname)
+	if !target.known() || target.goos == "windows" {
+		t.Skipf("skip: unknown platform of the host: %s", uname)
+	}
+	sshConfig, home := startShellServer(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	testBinary := writeExecHeader(t, "pe", pe.IMAGE_FILE_MACHINE_AMD64, 0)
+	sut := SshCmd{
+		CommonArgs: CommonArgs{TestBinary: testBinary},
+		SshConfig:  sshConfig,
+		opts:       Opts{logger: hclog.NewNullLogger()},
+	}
+	if err := sut.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := sut.target.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	sut.target.Close()
+	// A stale cache is verified before failing.
+	cache := unameCachePath(sut.target.hostKey)
+	if cache == "" {
+		t.Fatal("no uname cache path: host key not recorded")
+	}
+	writeUnameCache(cache, "Linux s390x")
+
+	err = sut.Run(sut.opts)
+
+	have := "<no error>"
+	if err != nil {
+		have = err.Error()
+	}
+	want := "sshRun: test binary foo.test is for windows/amd64, target " + sut.addr +
+		" is " + target.String() + " (uname: " + uname + "): build with GOOS=" +
+		target.goos + " GOARCH=" + target.goarch
+	if have != want {
+		t.Errorf("error:\nhave: %s\nwant: %s", have, want)
+	}
+	if cached, _ := readUnameCache(cache); cached != uname {
+		t.Errorf("cache: have: %q; want: %q", cached, uname)
+	}
+	if dirs := remoteWorkDirs(t, home); len(dirs) > 0 {
+		t.Errorf("something uploaded: %s", dirs)
+	}
+}
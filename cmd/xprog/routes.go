@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Target is a named target of the project configuration.
+type Target struct {
+	// Host alias in the ssh_config file (default: the target name).
+	Host string `yaml:"host"`
+	// ssh_config file (default: ssh.cfg), relative to the configuration file.
+	Cfg string `yaml:"cfg"`
+	// Run the test binary with sudo, in addition to ssh.sudo.
+	Sudo bool `yaml:"sudo"`
+	// For example os: linux, distro: debian, arch: amd64, destructive-ok: true.
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Route sends the packages matching an import path pattern to the targets
+// matching a selector.
+type Route struct {
+	// Import path pattern, as understood by go test: "example.com/mod/x/...",
+	// or relative to the configuration file: "./x/...".
+	Packages string `yaml:"packages"`
+	// Target selector, see parseSelector.
+	Target string `yaml:"target"`
+	// Run on all the selected targets instead of one of them.
+	Matrix bool `yaml:"matrix"`
+}
+
+// selector selects targets by name and labels. All its terms must match.
+type selector struct {
+	name   string
+	labels map[string]string
+}
+
+// parseSelector parses a comma-separated list of terms: "key=value" matches
+// the targets with label key equal to value, a term without "=" matches the
+// target with that name. For example "distro=debian,destructive-ok=true".
+func parseSelector(s string) (selector, error) {
+	sel := selector{labels: map[string]string{}}
+	if strings.TrimSpace(s) == "" {
+		return sel, fmt.Errorf("target selector: empty")
+	}
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		key, val, isLabel := strings.Cut(term, "=")
+		switch {
+		case term == "" || (isLabel && key == ""):
+			return sel, fmt.Errorf("target selector '%s': invalid term '%s'", s, term)
+		case isLabel:
+			sel.labels[key] = val
+		case sel.name != "" && sel.name != term:
+			return sel, fmt.Errorf("target selector '%s': more than one name", s)
+		default:
+			sel.name = term
+		}
+	}
+	return sel, nil
+}
+
+func (self selector) matches(name string, target Target) bool {
+	if self.name != "" && self.name != name {
+		return false
+	}
+	for key, val := range self.labels {
+		if have, ok := target.Labels[key]; !ok || have != val {
+			return false
+		}
+	}
+	return true
+}
+
+// selectTargets returns the names of the targets matching selector s, sorted.
+func (self *Config) selectTargets(s string) ([]string, error) {
+	sel, err := parseSelector(s)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name, target := range self.Targets {
+		if sel.matches(name, target) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("target selector '%s': no matching target", s)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// TargetsFor returns the names of the targets for the package in directory dir,
+// selected by sel if not empty, else by the first route matching the package.
+// It returns nil if no route matches.
+//
+// The targets matching a selector form a pool: each package goes to one of
+// them, always the same, so that the packages are spread over the pool. With
+// matrix, or with a matrix route, it goes to all of them.
+func (self *Config) TargetsFor(sel string, matrix bool, dir string) ([]string, error) {
+	pkg, rel, err := self.packagePaths(dir)
+	if err != nil {
+		return nil, err
+	}
+	if sel == "" {
+		for _, route := range self.Routes {
+			if matchPackage(route.Packages, pkg, rel) {
+				sel = route.Target
+				matrix = matrix || route.Matrix
+				break
+			}
+		}
+	}
+	if sel == "" {
+		return nil, nil
+	}
+	pool, err := self.selectTargets(sel)
+	if err != nil {
+		return nil, err
+	}
+	if matrix {
+		return pool, nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(pkg))
+	return pool[h.Sum32()%uint32(len(pool)):][:1], nil
+}
+
+// targetOptions returns the ssh settings of target name.
+func (self *Config) targetOptions(name string) matrixTarget {
+	target := self.Targets[name]
+	opts := matrixTarget{
+		name: name,
+		host: target.Host,
+		cfg:  self.Ssh.Cfg,
+		sudo: self.Ssh.Sudo || target.Sudo,
+	}
+	if opts.host == "" {
+		opts.host = name
+	}
+	if target.Cfg != "" {
+		opts.cfg = target.Cfg
+	}
+	return opts
+}
+
+// packagePaths returns the import path of the package in directory dir (empty
+// if not in a module) and its path relative to the configuration file, in the
+// form "./x/y".
+func (self *Config) packagePaths(dir string) (string, string, error) {
+	rel, err := filepath.Rel(filepath.Dir(self.path), dir)
+	if err != nil {
+		return "", "", fmt.Errorf("config: %s", err)
+	}
+	rel = "./" + filepath.ToSlash(rel)
+	if rel == "./." {
+		rel = "."
+	}
+	root, modPath, err := findModule(dir)
+	if err != nil || root == "" {
+		return "", rel, err
+	}
+	pkgRel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", "", fmt.Errorf("config: %s", err)
+	}
+	if pkgRel == "." {
+		return modPath, rel, nil
+	}
+	return modPath + "/" + filepath.ToSlash(pkgRel), rel, nil
+}
+
+// findModule returns the directory holding the go.mod of the module containing
+// dir and the module path. It returns the empty string if not in a module.
+func findModule(dir string) (string, string, error) {
+	for {
+		fi, err := os.Open(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			defer fi.Close()
+			scanner := bufio.NewScanner(fi)
+			for scanner.Scan() {
+				line, _, _ := strings.Cut(scanner.Text(), "//")
+				fields := strings.Fields(line)
+				if len(fields) == 2 && fields[0] == "module" {
+					modPath, err := strconv.Unquote(fields[1])
+					if err != nil {
+						modPath = fields[1]
+					}
+					return dir, modPath, nil
+				}
+			}
+			return "", "", fmt.Errorf("config: %s: no module directive",
+				filepath.Join(dir, "go.mod"))
+		}
+		if !os.IsNotExist(err) {
+			return "", "", fmt.Errorf("config: %s", err)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", nil
+		}
+		dir = parent
+	}
+}
+
+// matchPackage reports whether the package with import path pkg and path rel
+// relative to the configuration file matches pattern. As with go test, "..."
+// matches any string and "x/..." matches also x. A pattern starting with "."
+// is matched against rel, any other against pkg.
+func matchPackage(pattern, pkg, rel string) bool {
+	name := pkg
+	if pattern == "." || strings.HasPrefix(pattern, "./") {
+		name = rel
+	}
+	if name == "" {
+		return false
+	}
+	re := regexp.QuoteMeta(pattern)
+	re = strings.ReplaceAll(re, `\.\.\.`, `.*`)
+	// Special case: "x/..." matches also "x".
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	return regexp.MustCompile("^" + re + "$").MatchString(name)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSelector(t *testing.T) {
+	testCases := []struct {
+		sel     string
+		want    selector
+		wantErr string
+	}{
+		{
+			sel:  "vm1",
+			want: selector{name: "vm1", labels: map[string]string{}},
+		},
+		{
+			sel: "distro=debian, destructive-ok=true",
+			want: selector{labels: map[string]string{
+				"distro": "debian", "destructive-ok": "true"}},
+		},
+		{
+			sel:  "vm1,arch=arm64",
+			want: selector{name: "vm1", labels: map[string]string{"arch": "arm64"}},
+		},
+		{
+			sel:     "",
+			wantErr: "target selector: empty",
+		},
+		{
+			sel:     "os=linux,,arch=arm64",
+			wantErr: "target selector 'os=linux,,arch=arm64': invalid term ''",
+		},
+		{
+			sel:     "=linux",
+			wantErr: "target selector '=linux': invalid term '=linux'",
+		},
+		{
+			sel:     "vm1,vm2",
+			wantErr: "target selector 'vm1,vm2': more than one name",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.sel, func(t *testing.T) {
+			sel, err := parseSelector(tc.sel)
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			want := tc.wantErr
+			if want == "" {
+				want = "<no error>"
+			}
+			if have != want {
+				t.Fatalf("error: have: %s; want: %s", have, want)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(sel, tc.want, cmp.AllowUnexported(selector{})); diff != "" {
+				t.Errorf("\nselector mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMatchPackage(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		pkg     string
+		rel     string
+		want    bool
+	}{
+		{pattern: "./...", pkg: "example.com/mod", rel: ".", want: true},
+		{pattern: "./...", pkg: "example.com/mod/a/b", rel: "./a/b", want: true},
+		{pattern: "./netlink/...", pkg: "example.com/mod/netlink", rel: "./netlink", want: true},
+		{pattern: "./netlink/...", pkg: "example.com/mod/netlink/x", rel: "./netlink/x", want: true},
+		{pattern: "./netlink/...", pkg: "example.com/mod/netlinkx", rel: "./netlinkx", want: false},
+		{pattern: "./netlink", pkg: "example.com/mod/netlink/x", rel: "./netlink/x", want: false},
+		{pattern: "example.com/mod/...", pkg: "example.com/mod/a", rel: "./a", want: true},
+		{pattern: "example.com/.../b", pkg: "example.com/mod/a/b", rel: "./a/b", want: true},
+		{pattern: "example.com/mod", pkg: "example.com/mod/a", rel: "./a", want: false},
+		{pattern: "example.com/mod/...", pkg: "", rel: "./a", want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pattern+" "+tc.pkg, func(t *testing.T) {
+			if have := matchPackage(tc.pattern, tc.pkg, tc.rel); have != tc.want {
+				t.Errorf("have: %v; want: %v", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigTargetsFor(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"go.mod": "module example.com/mod // comment\n",
+		"xprog.yaml": `
+targets:
+  privileged:
+    labels: {os: linux, distro: debian, destructive-ok: true}
+  cheap1:
+    labels: {os: linux, distro: alpine}
+  cheap2:
+    labels: {os: linux, distro: alpine}
+routes:
+  - packages: ./netlink/...
+    target: destructive-ok=true
+  - packages: ./portable/...
+    target: os=linux
+    matrix: true
+  - packages: example.com/mod/...
+    target: distro=alpine
+`,
+	})
+	conf, err := loadConfig(filepath.Join(root, configName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		sel     string
+		matrix  bool
+		dir     string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "first matching route",
+			dir:  "netlink/route",
+			want: []string{"privileged"},
+		},
+		{
+			name: "pool",
+			dir:  "a",
+			want: []string{"cheap2"},
+		},
+		{
+			name: "pool, another package",
+			dir:  "b",
+			want: []string{"cheap1"},
+		},
+		{
+			name: "matrix route",
+			dir:  "portable",
+			want: []string{"cheap1", "cheap2", "privileged"},
+		},
+		{
+			name:   "matrix flag",
+			matrix: true,
+			dir:    "a",
+			want:   []string{"cheap1", "cheap2"},
+		},
+		{
+			name: "override by name",
+			sel:  "cheap1",
+			dir:  "netlink",
+			want: []string{"cheap1"},
+		},
+		{
+			name: "override by labels",
+			sel:  "os=linux,distro=debian",
+			dir:  "a",
+			want: []string{"privileged"},
+		},
+		{
+			name:   "override by labels, matrix",
+			sel:    "os=linux",
+			matrix: true,
+			dir:    "a",
+			want:   []string{"cheap1", "cheap2", "privileged"},
+		},
+		{
+			name:    "override without match",
+			sel:     "distro=fedora",
+			dir:     "a",
+			wantErr: "target selector 'distro=fedora': no matching target",
+		},
+		{
+			name: "no matching route",
+			dir:  "../elsewhere",
+			want: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			have, err := conf.TargetsFor(tc.sel, tc.matrix, filepath.Join(root, tc.dir))
+
+			haveErr := "<no error>"
+			if err != nil {
+				haveErr = err.Error()
+			}
+			wantErr := tc.wantErr
+			if wantErr == "" {
+				wantErr = "<no error>"
+			}
+			if haveErr != wantErr {
+				t.Fatalf("error: have: %s; want: %s", haveErr, wantErr)
+			}
+			if diff := cmp.Diff(have, tc.want); diff != "" {
+				t.Errorf("\ntargets mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFindModule(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"go.mod":        "// comment\nmodule \"example.com/mod\"\n\ngo 1.23\n",
+		"a/b/x.go":      "",
+		"bad/go.mod":    "go 1.23\n",
+		"bad/pkg/x.go":  "",
+		"none/readme":   "",
+		"other/go.mod":  "module example.com/other\n",
+		"other/pkg/x.g": "",
+	})
+
+	testCases := []struct {
+		dir      string
+		wantRoot string
+		wantPath string
+		wantErr  string
+	}{
+		{dir: "a/b", wantRoot: ".", wantPath: "example.com/mod"},
+		{dir: "other/pkg", wantRoot: "other", wantPath: "example.com/other"},
+		{dir: "bad/pkg", wantErr: "config: DIR/bad/go.mod: no module directive"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.dir, func(t *testing.T) {
+			haveRoot, havePath, err := findModule(filepath.Join(root, tc.dir))
+
+			have := "<no error>"
+			if err != nil {
+				have = strings.ReplaceAll(err.Error(), root, "DIR")
+			}
+			want := tc.wantErr
+			if want == "" {
+				want = "<no error>"
+			}
+			if have != want {
+				t.Fatalf("error: have: %s; want: %s", have, want)
+			}
+			if err != nil {
+				return
+			}
+			if want := filepath.Join(root, tc.wantRoot); haveRoot != want {
+				t.Errorf("root: have: %s; want: %s", haveRoot, want)
+			}
+			if havePath != tc.wantPath {
+				t.Errorf("module path: have: %s; want: %s", havePath, tc.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpTransfer copies files with the SFTP subsystem of the target, instead of
+// the scp and tar programs, missing on minimal images or disabled on recent
+// OpenSSH servers. File modes and modification times are preserved.
+type sftpTransfer struct {
+	client *sftp.Client
+	log    hclog.Logger
+}
+
+// checkTransport validates --transport.
+func (self SshCmd) checkTransport() error {
+	switch self.Transport {
+	case "", "auto", "scp", "sftp":
+		return nil
+	}
+	return fmt.Errorf("--transport %s: want auto, scp or sftp", self.Transport)
+}
+
+// openTransport returns the SFTP transfer if selected by --transport, nil for
+// scp. With auto, SFTP is used if the target lacks scp or tar.
+func (self SshCmd) openTransport(conn *ssh.Client, tools map[string]bool) (*sftpTransfer, error) {
+	log := self.opts.logger
+	switch {
+	case self.Transport == "scp":
+		return nil, nil
+	case self.Transport == "sftp":
+	case tools == nil, tools["scp"] && tools["tar"]:
+		return nil, nil
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		if self.Transport == "sftp" {
+			return nil, fmt.Errorf("sftp: %s", err)
+		}
+		log.Warn("transport: target lacks scp or tar and sftp is not available",
+			"err", err, "scp", tools["scp"], "tar", tools["tar"])
+		return nil, nil
+	}
+	log.Debug("transport: sftp", "target", self.addr)
+	return &sftpTransfer{client: client, log: log}, nil
+}
+
+// sftpTestBinary copies the test binary to dst on the target via SFTP, with a
+// deadline depending on its size.
+func (self SshCmd) sftpTestBinary(sf *sftpTransfer, dst string) error {
+	info, err := os.Stat(self.TestBinary)
+	if err != nil {
+		return fmt.Errorf("sftp TestBinary: %s", err)
+	}
+	timeout := self.transferTimeout(false, info.Size())
+	self.opts.logger.Debug("sftp TestBinary host -> target", "src", self.TestBinary,
+		"dst", dst, "size", formatByteSize(info.Size()), "timeout", timeout)
+	if err := sf.UploadFile(self.TestBinary, dst, timeout); err != nil {
+		return fmt.Errorf("sftp copy TestBinary (%s, timeout %s): %s",
+			formatByteSize(info.Size()), timeout, err)
+	}
+	return nil
+}
+
+func (self *sftpTransfer) Close() error {
+	return self.client.Close()
+}
+
+// withTimeout runs fn, closing the client, thus failing fn, if it does not
+// return in timeout.
+func (self *sftpTransfer) withTimeout(timeout time.Duration, fn func() error) error {
+	timer := time.AfterFunc(timeout, func() { self.client.Close() })
+	err := fn()
+	if !timer.Stop() {
+		return fmt.Errorf("timeout %s expired", timeout)
+	}
+	return err
+}
+
+// UploadFile copies local file src to dst on the target, with the mode and
+// modification time of src.
+func (self *sftpTransfer) UploadFile(src, dst string, timeout time.Duration) error {
+	fi, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	info, err := fi.Stat()
+	if err != nil {
+		return err
+	}
+	return self.withTimeout(timeout, func() error {
+		return self.putFile(newProgressReader(self.log, path.Base(dst), fi, info.Size()),
+			dst, info)
+	})
+}
+
+// putFile writes r to dst on the target, with the mode and modification time of
+// info.
+func (self *sftpTransfer) putFile(r io.Reader, dst string, info fs.FileInfo) error {
+	f, err := self.client.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return self.remoteError("create", dst, err, info.Size())
+	}
+	_, err = f.ReadFrom(r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return self.remoteError("write", dst, err, info.Size())
+	}
+	if err := self.client.Chmod(dst, info.Mode().Perm()); err != nil {
+		return self.remoteError("chmod", dst, err, 0)
+	}
+	if err := self.client.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		return self.remoteError("chtimes", dst, err, 0)
+	}
+	return nil
+}
+
+// UploadTree copies paths to directory dir on the target, as uploadTree, in at
+// most timeout.
+func (self *sftpTransfer) UploadTree(dir string, paths []uploadPath, timeout time.Duration) error {
+	return self.withTimeout(timeout, func() error {
+		return self.uploadTree(dir, paths)
+	})
+}
+
+func (self *sftpTransfer) uploadTree(dir string, paths []uploadPath) error {
+	for _, up := range paths {
+		// As tar, create the parents of the destination.
+		parent := path.Dir(path.Join(dir, up.dst))
+		if err := self.client.MkdirAll(parent); err != nil {
+			return fmt.Errorf("upload: %s", self.remoteError("mkdir", parent, err, 0))
+		}
+		err := filepath.WalkDir(up.src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(up.src, p)
+			if err != nil {
+				return err
+			}
+			return self.uploadEntry(p, path.Join(dir, up.dst, filepath.ToSlash(rel)))
+		})
+		if err != nil {
+			return fmt.Errorf("upload: %s", err)
+		}
+	}
+	return nil
+}
+
+func (self *sftpTransfer) uploadEntry(src string, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch mode := info.Mode(); {
+	case mode&fs.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := self.client.Symlink(link, dst); err != nil {
+			return self.remoteError("symlink", dst, err, 0)
+		}
+		return nil
+	case mode.IsDir():
+		if err := self.client.MkdirAll(dst); err != nil {
+			return self.remoteError("mkdir", dst, err, 0)
+		}
+		if err := self.client.Chmod(dst, mode.Perm()); err != nil {
+			return self.remoteError("chmod", dst, err, 0)
+		}
+		return nil
+	case mode.IsRegular():
+		fi, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer fi.Close()
+		return self.putFile(fi, dst, info)
+	default:
+		return fmt.Errorf("%s: unsupported file type %s", src, mode.Type())
+	}
+}
+
+// DownloadFile copies src on the target to local file dst, with the mode and
+// modification time of src.
+func (self *sftpTransfer) DownloadFile(src, dst string, timeout time.Duration) error {
+	return self.withTimeout(timeout, func() error {
+		return self.getFile(src, dst)
+	})
+}
+
+func (self *sftpTransfer) getFile(src, dst string) error {
+	f, err := self.client.Open(src)
+	if err != nil {
+		return self.remoteError("open", src, err, 0)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return self.remoteError("stat", src, err, 0)
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, newProgressReader(self.log, path.Base(src), f, info.Size()))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", src, err)
+	}
+	if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// DownloadTree copies files, relative to directory remoteDir on the target, to
+// directory localDir on the host, as downloadTree, in at most timeout.
+func (self *sftpTransfer) DownloadTree(remoteDir string, files []remoteFile, localDir string,
+	timeout time.Duration) error {
+	return self.withTimeout(timeout, func() error {
+		return self.downloadTree(remoteDir, files, localDir)
+	})
+}
+
+func (self *sftpTransfer) downloadTree(remoteDir string, files []remoteFile, localDir string) error {
+	for _, rf := range files {
+		file := rf.name
+		name := filepath.FromSlash(path.Clean(file))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("download: %s: path outside of destination", file)
+		}
+		if err := checkNoSymlink(localDir, name); err != nil {
+			return fmt.Errorf("download: %s: %s", file, err)
+		}
+		dst := filepath.Join(localDir, name)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return fmt.Errorf("download: %s", err)
+		}
+		if err := self.getFile(path.Join(remoteDir, file), dst); err != nil {
+			return fmt.Errorf("download: %s", err)
+		}
+	}
+	return nil
+}
+
+// Size returns the size of file p on the target.
+func (self *sftpTransfer) Size(p string) (int64, error) {
+	info, err := self.client.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Files returns the regular files below directory dir on the target, as
+// remoteFiles.
+func (self *sftpTransfer) Files(dir string) ([]remoteFile, error) {
+	dir = path.Clean(dir)
+	var files []remoteFile
+	err := self.walk(dir, func(p string, info fs.FileInfo) error {
+		files = append(files, remoteFile{
+			name: strings.TrimPrefix(p, dir+"/"),
+			size: info.Size(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// Checksums returns the checksums of the regular files below paths in
+// directory dir on the target, as remoteChecksums, reading the files.
+func (self *sftpTransfer) Checksums(dir string, paths []string) (checksums, error) {
+	dir = path.Clean(dir)
+	sums := checksums{sums: map[string]checksum{}}
+	for _, p := range paths {
+		err := self.walk(path.Join(dir, filepath.ToSlash(p)), func(file string, _ fs.FileInfo) error {
+			f, err := self.client.Open(file)
+			if err != nil {
+				return self.remoteError("open", file, err, 0)
+			}
+			defer f.Close()
+			sum, err := cksum(bufio.NewReader(f))
+			if err != nil {
+				return fmt.Errorf("%s: %s", file, err)
+			}
+			name := strings.TrimPrefix(file, dir+"/")
+			if _, ok := sums.sums[name]; !ok {
+				sums.names = append(sums.names, name)
+			}
+			sums.sums[name] = sum
+			return nil
+		})
+		if err != nil {
+			return sums, fmt.Errorf("sync-back: %s", err)
+		}
+	}
+	return sums, nil
+}
+
+// walk calls fn with the path and information of each regular file below root
+// on the target, not following symlinks, as find -type f. A missing root has no
+// files.
+func (self *sftpTransfer) walk(root string, fn func(p string, info fs.FileInfo) error) error {
+	walker := self.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if walker.Path() == root && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return self.remoteError("walk", walker.Path(), err, 0)
+		}
+		if !walker.Stat().Mode().IsRegular() {
+			continue
+		}
+		if err := fn(walker.Path(), walker.Stat()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteError explains err, of operation op on file p on the target. SFTP (v3)
+// reports a full disk as a generic failure: if writing size bytes, the free
+// space of the filesystem tells.
+func (self *sftpTransfer) remoteError(op string, p string, err error, size int64) error {
+	var status *sftp.StatusError
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%s %s: permission denied on target", op, p)
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("%s %s: no such file or directory on target", op, p)
+	case errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxFailure && size > 0:
+		vfs, vfsErr := self.client.StatVFS(path.Dir(p))
+		if vfsErr == nil && vfs.FreeSpace() < uint64(size) {
+			return fmt.Errorf("%s %s: target filesystem full (%s free, %s needed)", op, p,
+				formatByteSize(int64(vfs.FreeSpace())), formatByteSize(size))
+		}
+	}
+	return fmt.Errorf("%s %s: %s", op, p, err)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestSshCmdRunUploadSftp(t *testing.T) {
+	testSshCmdRunUpload(t, "sftp")
+}
+
+func TestSshCmdCheckTransport(t *testing.T) {
+	sut := SshCmd{Transport: "rsync"}
+
+	err := sut.checkTransport()
+
+	want := "--transport rsync: want auto, scp or sftp"
+	if err == nil || err.Error() != want {
+		t.Errorf("error: have: %v; want: %s", err, want)
+	}
+}
+
+func TestSshCmdOpenTransportScp(t *testing.T) {
+	all := map[string]bool{"scp": true, "tar": true}
+	testCases := []struct {
+		name      string
+		transport string
+		tools     map[string]bool
+	}{
+		{name: "scp", transport: "scp", tools: map[string]bool{}},
+		{name: "auto with scp and tar", transport: "auto", tools: all},
+		{name: "default with scp and tar", transport: "", tools: all},
+		{name: "auto without probe", transport: "auto", tools: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sut := SshCmd{Transport: tc.transport, opts: Opts{logger: hclog.NewNullLogger()}}
+
+			// A nil connection: the SFTP client must not be opened.
+			sf, err := sut.openTransport(nil, tc.tools)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sf != nil {
+				t.Errorf("have: sftp; want: scp")
+			}
+		})
+	}
+}
+
+func TestSshCmdRunSftpOutputs(t *testing.T) {
+	sshConfig, _ := startShellServer(t)
+	// With SFTP, the files are listed and measured without these tools.
+	shims := t.TempDir()
+	for _, tool := range []string{"wc", "find", "cksum"} {
+		writeFiles(t, shims, map[string]string{tool: "#!/bin/sh\nexit 3\n"})
+		if err := os.Chmod(filepath.Join(shims, tool), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", shims+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	testBinary := writeTestBinary(t, `
+for arg in "$@"; do
+	case "$arg" in
+	-test.coverprofile=*) echo "mode: set" > "${arg#*=}" ;;
+	esac
+done
+echo new > testdata/golden.txt
+echo counters > "$GOCOVERDIR/covcounters.1"
+echo sftp
+`)
+	pkgDir := t.TempDir()
+	writeFiles(t, pkgDir, map[string]string{"testdata/golden.txt": "old\n"})
+	chdir(t, pkgDir)
+	outDir := t.TempDir()
+	coverDir := t.TempDir()
+	var logs, stdout strings.Builder
+	sut := SshCmd{
+		CommonArgs: CommonArgs{
+			TestBinary: testBinary,
+			GoTestFlag: []string{
+				"-test.coverprofile=" + filepath.Join(outDir, "cover.out"),
+				"-test.cpuprofile=" + filepath.Join(outDir, "cpu.out"),
+			},
+		},
+		SshConfig:  sshConfig,
+		NoBinCache: true,
+		Transport:  "sftp",
+		SyncBack:   []string{"testdata"},
+		GoCoverDir: coverDir,
+		opts: Opts{logger: hclog.New(&hclog.LoggerOptions{
+			Output: &logs,
+			Level:  hclog.Debug,
+		})},
+		stdout: &stdout,
+		stderr: io.Discard,
+	}
+
+	if err := sut.Run(sut.opts); err != nil {
+		t.Fatalf("%s\nlogs:\n%s", err, logs.String())
+	}
+
+	if !strings.Contains(logs.String(), "transport: sftp") {
+		t.Errorf("want the sftp transport; logs:\n%s", logs.String())
+	}
+	if have, want := stdout.String(), "sftp\n"; have != want {
+		t.Errorf("stdout: have: %q; want: %q", have, want)
+	}
+	cover, err := os.ReadFile(filepath.Join(outDir, "cover.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(cover), "mode: set\n"; have != want {
+		t.Errorf("coverprofile: have: %q; want: %q", have, want)
+	}
+	if !strings.Contains(logs.String(), "output file not produced by test binary: flag=cpuprofile") {
+		t.Errorf("want the missing cpuprofile reported; logs:\n%s", logs.String())
+	}
+	want := map[string]string{"testdata/golden.txt": "new\n"}
+	if diff := cmp.Diff(readFiles(t, pkgDir), want); diff != "" {
+		t.Errorf("\nsync-back mismatch (-have, +want)\n%s", diff)
+	}
+	want = map[string]string{"covcounters.1": "counters\n"}
+	if diff := cmp.Diff(readFiles(t, coverDir), want); diff != "" {
+		t.Errorf("\ngocoverdir mismatch (-have, +want)\n%s", diff)
+	}
+}
+
+func TestSftpTransferRemoteError(t *testing.T) {
+	sshConfig, home := startShellServer(t)
+	sut := SshCmd{SshConfig: sshConfig, opts: Opts{logger: hclog.NewNullLogger()}}
+	if err := sut.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	defer sut.target.Close()
+	conn, err := sut.target.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sf, err := SshCmd{Transport: "sftp", opts: sut.opts}.openTransport(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Close()
+	if err := os.Mkdir(filepath.Join(home, "ro"), 0o555); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "src")
+	writeFiles(t, filepath.Dir(src), map[string]string{"src": "data"})
+	testCases := []struct {
+		name     string
+		dst      string
+		wantErr  string
+		needUser bool
+	}{
+		{
+			name:    "no such directory",
+			dst:     "missing/dst",
+			wantErr: "create HOME/missing/dst: no such file or directory on target",
+		},
+		{
+			name:     "permission denied",
+			dst:      "ro/dst",
+			wantErr:  "create HOME/ro/dst: permission denied on target",
+			needUser: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.needUser && os.Geteuid() == 0 {
+				t.Skip("skip: root ignores file permissions")
+			}
+
+			err := sf.UploadFile(src, home+"/"+tc.dst, time.Minute)
+
+			have := "<no error>"
+			if err != nil {
+				have = strings.ReplaceAll(err.Error(), home, "HOME")
+			}
+			if have != tc.wantErr {
+				t.Errorf("error: have: %s; want: %s", have, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSftpTransferDownloadTreeSymlink(t *testing.T) {
+	sshConfig, home := startShellServer(t)
+	sut := SshCmd{SshConfig: sshConfig, opts: Opts{logger: hclog.NewNullLogger()}}
+	if err := sut.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	defer sut.target.Close()
+	conn, err := sut.target.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sf, err := SshCmd{Transport: "sftp", opts: sut.opts}.openTransport(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Close()
+	writeFiles(t, filepath.Join(home, "remote"), map[string]string{"a.txt": "evil"})
+	outside := t.TempDir()
+	writeFiles(t, outside, map[string]string{"victim.txt": "original"})
+	localDir := t.TempDir()
+	err = os.Symlink(filepath.Join(outside, "victim.txt"), filepath.Join(localDir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sf.DownloadTree(home+"/remote", []remoteFile{{name: "a.txt", size: 4}}, localDir,
+		time.Minute)
+
+	have := "<no error>"
+	if err != nil {
+		have = err.Error()
+	}
+	want := "download: a.txt: a.txt is a symlink on host, not writing through it"
+	if have != want {
+		t.Errorf("error: have: %s; want: %s", have, want)
+	}
+	wantOutside := map[string]string{"victim.txt": "original"}
+	if diff := cmp.Diff(readFiles(t, outside), wantOutside); diff != "" {
+		t.Errorf("\noutside files mismatch (-have, +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "strings"
+
+// shellQuote quotes s for a POSIX shell, so that the shell passes it verbatim
+// as a single argument. Strings made only of safe characters are left as is,
+// to keep the command readable in the logs.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for i := 0; i < len(s); i++ {
+		if !isShellSafe(s[i]) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	// Within single quotes, everything is literal except the single quote
+	// itself, which must be closed, escaped and reopened: ' -> '\''
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellJoin quotes each element of args and joins them with spaces, to form a
+// command line for a POSIX shell.
+func shellJoin(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+func isShellSafe(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("@%+=:,./-_", c) != -1
+}
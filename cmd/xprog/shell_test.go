@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestShellQuote(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want string
+	}{
+		{s: "", want: "''"},
+		{s: "-test.v", want: "-test.v"},
+		{s: "-test.coverprofile=/tmp/cover.out", want: "-test.coverprofile=/tmp/cover.out"},
+		{s: "XPROG_SYS_TARGET=127.0.0.1:22", want: "XPROG_SYS_TARGET=127.0.0.1:22"},
+		{s: "with space", want: "'with space'"},
+		{s: "-test.run=A|B$", want: "'-test.run=A|B$'"},
+		{s: "it's", want: `'it'\''s'`},
+		{s: "'", want: `''\'''`},
+		{s: "~", want: "'~'"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.s, func(t *testing.T) {
+			if have := shellQuote(tc.s); have != tc.want {
+				t.Errorf("have: %s; want: %s", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestShellJoinRoundTrip(t *testing.T) {
+	// All the bytes except NUL, which cannot be part of an argument.
+	var all strings.Builder
+	for c := 1; c < 256; c++ {
+		all.WriteByte(byte(c))
+	}
+
+	testCases := []struct {
+		name string
+		args []string
+	}{
+		{
+			name: "go test flags",
+			args: []string{"-test.run", "TestFoo/with space", "-test.v=true"},
+		},
+		{
+			name: "regex metacharacters",
+			args: []string{"-test.run=^(TestA|TestB)$", "-test.skip=.*Slow[0-9]?"},
+		},
+		{
+			name: "quotes and expansions",
+			args: []string{`"double"`, "'single'", "`date`", "$(date)", "${HOME}", "~", "a\\b"},
+		},
+		{
+			name: "shell syntax",
+			args: []string{";", "&&", "|", ">", "<", "#comment", "a=b", "!", "{a,b}", "*"},
+		},
+		{
+			name: "empty and whitespace",
+			args: []string{"", " ", "\t", "\n", "a\nb"},
+		},
+		{
+			name: "all bytes",
+			args: []string{all.String()},
+		},
+		{
+			name: "UTF-8 and invalid UTF-8",
+			args: []string{"héllo wörld", "\xff\xfe", "日本語"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			script := `for arg; do printf '%s\0' "$arg"; done`
+			cmd := "set -- " + shellJoin(tc.args) + "; " + script
+			out, err := exec.Command("/bin/sh", "-c", cmd).Output()
+			if err != nil {
+				t.Fatalf("sh -c %s: %s", cmd, err)
+			}
+
+			have := strings.Split(string(bytes.TrimSuffix(out, []byte{0})), "\x00")
+			if diff := cmp.Diff(have, tc.args); diff != "" {
+				t.Errorf("\nargs mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"os/signal"
 	"path"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bramvdbogaerde/go-scp"
@@ -17,19 +21,54 @@ import (
 
 type SshCmd struct {
 	CommonArgs
-	SshConfig string `arg:"--cfg,required" help:"path to a ssh_config file"`
-	Sudo      bool   `help:"run the test binary with sudo"`
+	SshConfig       string        `arg:"--cfg" help:"path to a ssh_config file (required, unless in xprog.yaml)"`
+	Host            string        `arg:"env:XPROG_HOST" help:"host alias in the ssh_config file (default: the first Host block)"`
+	Sudo            bool          `help:"run the test binary with sudo"`
+	Upload          []string      `arg:"--upload,separate" help:"file or directory to upload to the remote working directory, in addition to testdata (repeatable)"`
+	KeepRemote      bool          `arg:"--keep-remote" help:"do not remove the remote working directory at the end, for post-mortem debugging"`
+	SyncBack        []string      `arg:"--sync-back,separate" help:"after the run, copy back to the package directory the new or modified files below this relative path, for example testdata (repeatable)"`
+	GoCoverDir      string        `arg:"--gocoverdir" help:"host directory where to collect the coverage data of the binaries built with -cover run by the tests, via GOCOVERDIR on the target"`
+	GoCoverProfile  string        `arg:"--gocoverprofile" help:"with --gocoverdir, convert the collected coverage data to this text coverprofile (needs go tool covdata)"`
+	MatrixOutput    string        `arg:"--matrix-output" help:"with a matrix of targets, show the output of each target grouped at its end (group, default) or as it comes, each line prefixed by the target (prefix)"`
+	ConnectTimeout  time.Duration `arg:"--connect-timeout" help:"timeout to connect to the target (default: ConnectTimeout of ssh_config, else 10s)"`
+	UploadTimeout   time.Duration `arg:"--upload-timeout" help:"base timeout of each upload, such as the test binary, plus its size at --min-throughput (default: 10s)"`
+	DownloadTimeout time.Duration `arg:"--download-timeout" help:"base timeout of each download, such as an output file, plus its size at --min-throughput (default: 10s)"`
+	RunTimeout      time.Duration `arg:"--run-timeout" help:"timeout of the run of the test binary, then sent SIGQUIT (default: none, as go test -timeout applies)"`
+	MinThroughput   string        `arg:"--min-throughput" help:"minimum throughput of the transfers, for example 1MiB (default: 256KiB)"`
+	BinCacheSize    string        `arg:"--bin-cache-size" help:"size of the cache of test binaries on the target, and of the delta bases on the host, least recently used evicted (default: 1GiB)"`
+	NoBinCache      bool          `arg:"--no-bin-cache" help:"always upload the test binary, without using the cache of the target"`
+	NoDelta         bool          `arg:"--no-delta" help:"upload the test binary in full, not as a delta against the previous version"`
+	Compress        string        `arg:"--compress" help:"compression of the uploads: auto (zstd or gzip, as available on the target), zstd, gzip or none (default: auto)"`
+	Transport       string        `arg:"--transport" help:"file transfers: auto (sftp if the target lacks scp or tar), scp (scp and tar) or sftp (default: auto)"`
 	//
 	opts   Opts
-	sshCfg ssh.ClientConfig
+	target *sshTarget
 	addr   string
+	// Set by Config.Apply when running on several targets.
+	matrix []matrixTarget
+	// Standard streams of the test binary, default the ones of xprog.
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	// Appended to the host path of the output files.
+	outputSuffix string
+	// Parsed MinThroughput, bytes per second.
+	minThroughput int64
+	// Parsed BinCacheSize, bytes.
+	binCacheSize int64
 }
 
 func (self SshCmd) Run(opts Opts) error {
 	self.opts = opts
+	if self.stdout == nil {
+		self.stdin, self.stdout, self.stderr = os.Stdin, os.Stdout, os.Stderr
+	}
+	if len(self.matrix) > 0 {
+		return self.runMatrix()
+	}
 	if err := self.prepare(); err != nil {
 		return err
 	}
+	defer self.target.Close()
 	return self.execute()
 }
 
@@ -37,111 +76,140 @@ func (self *SshCmd) prepare() error {
 	log := self.opts.logger
 	log.Debug("ssh", "testbinary:", self.TestBinary,
 		"gotestflag:", self.GoTestFlag)
-	rd, err := os.Open(self.SshConfig)
-	if err != nil {
-		return fmt.Errorf("sshRun: ssh_config: %s", err)
+	if self.SshConfig == "" {
+		return fmt.Errorf("sshRun: missing --cfg (or ssh.cfg in %s)", configName)
 	}
-	defer rd.Close()
-	sshConf, err := parseSshConfig(rd)
-	if err != nil {
+	if err := self.checkEnv(); err != nil {
 		return fmt.Errorf("sshRun: %s", err)
 	}
-	// Currently we always take the first Host block.
-	host := sshConf[0]
-
-	privateKeyPath, err := host.Get("IdentityFile")
-	if err != nil {
-		return fmt.Errorf("sshRun: %s", err)
-	}
-
-	key, err := os.ReadFile(privateKeyPath)
-	if err != nil {
-		return fmt.Errorf("sshRun: unable to read private key: %s", err)
+	if self.GoCoverProfile != "" && self.GoCoverDir == "" {
+		return fmt.Errorf("sshRun: --gocoverprofile requires --gocoverdir")
 	}
-
-	// Create the Signer for this private key.
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		return fmt.Errorf("sshRun: unable to parse private key: %s", err)
+	if err := self.checkTimeouts(); err != nil {
+		return fmt.Errorf("sshRun: %s", err)
 	}
-
-	user, err := host.Get("User")
-	if err != nil {
+	if err := self.checkCompress(); err != nil {
 		return fmt.Errorf("sshRun: %s", err)
 	}
-
-	strictHostKeyChecking, err := host.Get("StrictHostKeyChecking")
-	if err != nil {
+	if err := self.checkTransport(); err != nil {
 		return fmt.Errorf("sshRun: %s", err)
 	}
-	if strictHostKeyChecking != "no" {
-		return fmt.Errorf("sshRun: StrictHostKeyChecking=%s but we support only 'no'",
-			strictHostKeyChecking)
+	binCacheSize := self.BinCacheSize
+	if binCacheSize == "" {
+		binCacheSize = defaultBinCacheSize
 	}
-
-	self.sshCfg = ssh.ClientConfig{
-		Timeout: 1 * time.Second,
-		User:    user,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	size, err := parseByteSize(binCacheSize)
+	if err != nil {
+		return fmt.Errorf("sshRun: --bin-cache-size: %s", err)
 	}
-
-	hostName, err := host.Get("HostName")
+	self.binCacheSize = size
+	sshConf, err := loadSshConfig(self.SshConfig)
 	if err != nil {
 		return fmt.Errorf("sshRun: %s", err)
 	}
-	port, err := host.Get("Port")
+	aliases := sshConf.Aliases()
+	alias := self.Host
+	switch {
+	case alias == "" && len(aliases) == 0:
+		return fmt.Errorf("sshRun: ssh_config %s: no Host blocks", self.SshConfig)
+	case alias == "":
+		alias = aliases[0]
+	case !sshConf.HasHost(alias):
+		return fmt.Errorf("sshRun: ssh_config %s: unknown host '%s' (available: %s)",
+			self.SshConfig, alias, strings.Join(aliases, ", "))
+	}
+	log.Debug("ssh_config", "host", alias)
+	self.target, err = newSshTarget(sshConf, jumpHost{alias: alias}, log)
 	if err != nil {
 		return fmt.Errorf("sshRun: %s", err)
 	}
-
-	self.addr = fmt.Sprintf("%s:%s", hostName, port)
+	self.addr = self.target.addr
+	if self.ConnectTimeout > 0 {
+		self.target.cfg.Timeout = self.ConnectTimeout
+	}
 
 	return nil
 }
 
 func (self SshCmd) execute() error {
 	log := self.opts.logger
+	if err := checkSyncBackPaths(self.SyncBack, self.TestBinary); err != nil {
+		return fmt.Errorf("sshRun: %s", err)
+	}
 
-	log.Debug("ssh.Dial", "addr", self.addr)
-	conn, err := ssh.Dial("tcp", self.addr, &self.sshCfg)
+	conn, err := self.target.Dial()
 	if err != nil {
 		return fmt.Errorf("sshRun: %s", err)
 	}
 	defer conn.Close()
-
-	log.Debug("create scp session 1")
-	scpClient, err := scp.NewClientBySSH(conn)
+	if err := self.checkPlatform(conn); err != nil {
+		return fmt.Errorf("sshRun: %s", err)
+	}
+	tools, err := self.remoteTools(conn)
+	if err != nil {
+		log.Warn("target tools", "err", err)
+	}
+	sf, err := self.openTransport(conn, tools)
 	if err != nil {
-		return fmt.Errorf("sshRun: create scp session 1: %s", err)
+		return fmt.Errorf("sshRun: %s", err)
+	}
+	if sf != nil {
+		defer sf.Close()
 	}
 
-	dstTestBinary := "./" + path.Base(self.TestBinary)
-	log.Debug("scp TestBinary host -> target",
-		"src", self.TestBinary, "dst", dstTestBinary)
-	fi, err := os.Open(self.TestBinary)
+	// The remote working directory, where the test binary runs, holds the
+	// binary and the testdata directory, as the package directory on the host.
+	// It is unique to this run, so that concurrent runs do not collide.
+	baseTestBinary := path.Base(self.TestBinary)
+	workDir, err := self.remoteOutput(conn, `mktemp -d "${TMPDIR:-/tmp}"/`+
+		shellQuote("xprog-"+baseTestBinary+".XXXXXXXX"))
 	if err != nil {
-		return fmt.Errorf("sshRun: scp TestBinary: %s", err)
+		return fmt.Errorf("sshRun: create remote working directory: %s", err)
 	}
-	defer fi.Close()
-	{
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := scpClient.CopyFromFile(ctx, *fi, dstTestBinary, "0755"); err != nil {
-			return fmt.Errorf("sshRun: scp copy TestBinary: %s", err)
+	log.Debug("remote working directory", "dir", workDir, "target", self.addr)
+	defer self.removeWorkDir(conn, workDir)
+	uploads, err := uploadPaths(self.Upload)
+	if err != nil {
+		return fmt.Errorf("sshRun: %s", err)
+	}
+	if len(uploads) > 0 {
+		log.Debug("upload host -> target", "paths", uploads, "dst", workDir)
+		if err := uploadTree(conn, sf, workDir, uploads, self.uploadDeadline); err != nil {
+			return fmt.Errorf("sshRun: %s", err)
+		}
+	}
+
+	dstTestBinary := workDir + "/" + baseTestBinary
+	if err := self.uploadTestBinary(conn, sf, tools, dstTestBinary); err != nil {
+		return fmt.Errorf("sshRun: %s", err)
+	}
+	// Files written by the test binary, such as profiles, go to outputDir and
+	// are downloaded at the end.
+	outputDir := workDir + "/output"
+	flags := parseTestFlags(self.GoTestFlag)
+	logTestFlags(log, flags)
+	outputs := rewriteOutputFlags(flags, outputDir)
+	if len(outputs) > 0 {
+		if err := self.remoteRun(conn, "mkdir "+shellQuote(outputDir)); err != nil {
+			return fmt.Errorf("sshRun: create output directory: %s", err)
+		}
+	}
+	coverDir := newGoCoverDir(self.GoCoverDir, workDir, log)
+	if coverDir != nil {
+		if err := self.remoteRun(conn, "mkdir "+shellQuote(coverDir.remote)); err != nil {
+			return fmt.Errorf("sshRun: create GOCOVERDIR: %s", err)
+		}
+	}
+	testCoverDir := newTestGoCoverDir(flags, workDir, log)
+	if testCoverDir != nil {
+		if err := testCoverDir.Upload(conn, sf, self.uploadDeadline); err != nil {
+			return fmt.Errorf("sshRun: %s", err)
 		}
 	}
-	// If "go test -coverprofile", adapt accordingly
-	var coverprofile, tgtCoverprofile string
-	for i, flag := range self.GoTestFlag {
-		tokens := strings.Split(flag, "=")
-		if tokens[0] == "-test.coverprofile" {
-			coverprofile = tokens[1]
-			tgtCoverprofile = path.Base(coverprofile)
-			self.GoTestFlag[i] = "-test.coverprofile=" + tgtCoverprofile
-			break
+	fuzz := newFuzzSync(flags, workDir, log)
+	if fuzz != nil {
+		if err := fuzz.Upload(conn, sf, self.uploadDeadline); err != nil {
+			return fmt.Errorf("sshRun: %s", err)
 		}
 	}
 
@@ -154,136 +222,355 @@ func (self SshCmd) execute() error {
 		return fmt.Errorf("sshRun: create ssh session: %s", err)
 	}
 	defer sess.Close()
-	sess.Stdin = os.Stdin
-	sess.Stdout = os.Stdout
-	sess.Stderr = os.Stderr
-
-	cmd := []string{"XPROG_SYS_TARGET=" + self.addr}
+	sess.Stdin = self.stdin
+	sess.Stdout = self.stdout
+	sess.Stderr = self.stderr
+
+	// Record the PID to be able to forward signals. Thanks to exec, it is the
+	// PID of the test binary or of sudo, which relays signals to it.
+	pidFile := dstTestBinary + ".pid"
+	env := []string{"XPROG_SYS_TARGET=" + self.addr}
+	// As go test, export the -test.gocoverdir directory as GOCOVERDIR, for the
+	// binaries built with -cover run by the tests, unless --gocoverdir says
+	// otherwise.
+	switch {
+	case coverDir != nil:
+		env = append(env, coverDir.Env())
+	case testCoverDir != nil:
+		env = append(env, testCoverDir.Env())
+	}
+	env = append(env, self.Env...)
+	argv := append([]string{"env"}, env...)
 	if self.Sudo {
-		cmd = append(cmd, "sudo", " --preserve-env=XPROG_SYS_TARGET")
-	}
-	cmd = append(cmd, dstTestBinary)
-	cmd = append(cmd, self.GoTestFlag...)
-	log.Debug("ssh execute TestBinary", "cmd", cmd)
-	if err := sess.Run(strings.Join(cmd, " ")); err != nil {
+		var keys []string
+		for _, kv := range env {
+			key, _, _ := strings.Cut(kv, "=")
+			keys = append(keys, key)
+		}
+		argv = append(argv, "sudo", "--preserve-env="+strings.Join(keys, ","))
+	}
+	argv = append(argv, "./"+baseTestBinary)
+	argv = append(argv, flags.Args()...)
+	cmd := fmt.Sprintf("echo $$ > %s && cd %s && exec %s",
+		shellQuote(pidFile), shellQuote(workDir), shellJoin(argv))
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	done := make(chan struct{})
+	go self.forwardSignals(conn, pidFile, sigs, done)
+
+	log.Debug("ssh execute TestBinary", "cmd", cmd, "timeout", self.RunTimeout)
+	if err := sess.Start(cmd); err != nil {
+		signal.Stop(sigs)
+		close(done)
 		return fmt.Errorf("sshRun: execute TestBinary: %s", err)
 	}
+	runErr := self.waitRun(conn, sess, pidFile)
+	signal.Stop(sigs)
+	close(done)
 
-	// If no coverprofile, we are done.
-	if coverprofile == "" {
-		return nil
+	var testErr *testExitError
+	if runErr != nil && !errors.As(runErr, &testErr) {
+		return runErr
 	}
 
-	// Copy the coverprofile from target to host
+	if coverDir != nil {
+		if err := coverDir.Download(conn, sf, self.downloadDeadline); err != nil {
+			return fmt.Errorf("sshRun: %s", err)
+		}
+		if self.GoCoverProfile != "" {
+			if err := convertCoverDir(self.GoCoverDir, self.GoCoverProfile, log); err != nil {
+				return fmt.Errorf("sshRun: %s", err)
+			}
+		}
+	}
+	if testCoverDir != nil {
+		if err := testCoverDir.Download(conn, sf, self.downloadDeadline); err != nil {
+			return fmt.Errorf("sshRun: %s", err)
+		}
+	}
+	// Fuzzing finds failing inputs by failing.
+	if fuzz != nil {
+		if err := fuzz.Download(conn, sf, self.downloadDeadline); err != nil {
+			return fmt.Errorf("sshRun: %s", err)
+		}
+	}
+	if len(self.SyncBack) > 0 {
+		changes, err := syncBack(conn, sf, workDir, self.SyncBack, self.downloadDeadline)
+		if err != nil {
+			return fmt.Errorf("sshRun: %s", err)
+		}
+		self.logChanges(changes)
+	}
+	// Note that a failed test still produces its output files.
+	if err := self.download(conn, sf, outputs); err != nil {
+		return err
+	}
+	return runErr
+}
 
-	log.Debug("scp coverprofile target -> host",
-		"src", tgtCoverprofile, "dst", coverprofile)
-	fi, err = os.Create(coverprofile)
+// scpTestBinary copies the test binary to dst on the target, with a deadline
+// depending on its size.
+func (self SshCmd) scpTestBinary(conn *ssh.Client, dst string) error {
+	log := self.opts.logger
+	log.Debug("create scp session 1")
+	scpClient, err := scp.NewClientBySSH(conn)
 	if err != nil {
-		return fmt.Errorf("sshRun: coverprofile: %s", err)
+		return fmt.Errorf("create scp session 1: %s", err)
 	}
-	defer fi.Close()
-	log.Debug("create scp session 2")
-	scpClient2, err := scp.NewClientBySSH(conn)
+	log.Debug("scp TestBinary host -> target", "src", self.TestBinary, "dst", dst)
+	fi, err := os.Open(self.TestBinary)
 	if err != nil {
-		return fmt.Errorf("sshRun: create scp session 2: %s", err)
+		return fmt.Errorf("scp TestBinary: %s", err)
 	}
-	{
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := scpClient2.CopyFromRemote(ctx, fi, tgtCoverprofile); err != nil {
-			return fmt.Errorf("sshRun: scp copy coverprofile: %s", err)
-		}
+	defer fi.Close()
+	stat, err := fi.Stat()
+	if err != nil {
+		return fmt.Errorf("scp TestBinary: %s", err)
+	}
+	timeout := self.transferTimeout(false, stat.Size())
+	log.Debug("scp TestBinary", "size", formatByteSize(stat.Size()), "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = scpClient.CopyFromFilePassThru(ctx, *fi, dst, "0755",
+		newProgress(log, "TestBinary"))
+	if err != nil {
+		return fmt.Errorf("scp copy TestBinary (%s, timeout %s): %s",
+			formatByteSize(stat.Size()), timeout, err)
 	}
 	return nil
 }
 
-// Host is a `Host` block in a ssh_config file.
-type Host map[string]string
-
-// Get returns self[key] if found or error if not found.
-func (self Host) Get(key string) (string, error) {
-	val := self[key]
-	if val != "" {
-		return val, nil
+// sendTestBinary uploads the whole test binary to dst on the target, compressed
+// with comp if not nil, else via SFTP if sf is not nil, else via scp.
+func (self SshCmd) sendTestBinary(conn *ssh.Client, sf *sftpTransfer, dst string,
+	comp *compression) error {
+	log := self.opts.logger
+	if comp == nil && sf != nil {
+		return self.sftpTestBinary(sf, dst)
 	}
-	return "", fmt.Errorf("ssh_config: missing key %s", key)
-}
-
-// GetDef returns self[key] if found or def if not found.
-func (self Host) GetDef(key string, def string) string {
-	val := self[key]
-	if val != "" {
-		return val
+	if comp == nil {
+		return self.scpTestBinary(conn, dst)
+	}
+	fi, err := os.Open(self.TestBinary)
+	if err != nil {
+		return fmt.Errorf("upload TestBinary: %s", err)
 	}
-	return def
+	defer fi.Close()
+	stat, err := fi.Stat()
+	if err != nil {
+		return fmt.Errorf("upload TestBinary: %s", err)
+	}
+	timeout := self.transferTimeout(false, stat.Size())
+	log.Debug("upload TestBinary host -> target", "src", self.TestBinary, "dst", dst,
+		"size", formatByteSize(stat.Size()), "compress", comp.name, "timeout", timeout)
+	tmp := dst + ".tmp"
+	err = remoteWrite(conn, tmp, newProgressReader(log, "TestBinary", fi, stat.Size()),
+		comp, timeout)
+	if err == nil {
+		err = self.remoteRun(conn, fmt.Sprintf("chmod 755 %s && mv -f %[1]s %s",
+			shellQuote(tmp), shellQuote(dst)))
+	}
+	if err != nil {
+		return fmt.Errorf("upload TestBinary (%s, %s, timeout %s): %s",
+			formatByteSize(stat.Size()), comp.name, timeout, err)
+	}
+	return nil
 }
 
-// parseSshConfig is a simplistic and partial parser of ssh_config files.
-// It knows only about `Host` blocks.
-func parseSshConfig(rd io.Reader) ([]Host, error) {
-	var hosts []Host
-	host := Host{}
-	scanner := bufio.NewScanner(rd)
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
+// download copies the output files of the test binary from the target to the
+// host. A file not produced is reported but is not an error: go test will
+// complain if it needs it.
+func (self SshCmd) download(conn *ssh.Client, sf *sftpTransfer, outputs []outputFile) error {
+	log := self.opts.logger
+	if len(outputs) == 0 {
+		return nil
+	}
+	var scpClient scp.Client
+	via := "sftp"
+	if sf == nil {
+		log.Debug("create scp session 2")
+		var err error
+		if scpClient, err = scp.NewClientBySSH(conn); err != nil {
+			return fmt.Errorf("sshRun: create scp session 2: %s", err)
+		}
+		via = "scp"
+	}
+	for _, out := range outputs {
+		// The size gives the timeout of the transfer.
+		size, err := self.remoteSize(conn, sf, out.remote)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Warn("output file not produced by test binary", "flag", out.flag,
+				"path", out.remote)
 			continue
 		}
-
-		tokens := strings.Fields(line)
-		if have, want := len(tokens), 2; have != want {
-			return nil, fmt.Errorf("parseSshConfig: line '%s': %d tokens instead of %d",
-				line, have, want)
+		if err != nil {
+			return fmt.Errorf("sshRun: %s", err)
 		}
-		k, v := tokens[0], tokens[1]
-
-		if len(host) == 0 && k != "Host" {
-			return nil,
-				fmt.Errorf("parseSshConfig: line '%s': block must begin with 'Host'",
-					line)
+		local := out.local + self.outputSuffix
+		timeout := self.transferTimeout(true, size)
+		log.Debug(via+" output file target -> host", "flag", out.flag,
+			"src", out.remote, "dst", local, "size", formatByteSize(size),
+			"timeout", timeout)
+		if sf != nil {
+			err = sf.DownloadFile(out.remote, local, timeout)
+		} else {
+			err = self.downloadFile(scpClient, out.remote, local, timeout)
+		}
+		if err != nil {
+			return fmt.Errorf("sshRun: %s copy %s (%s, timeout %s): %s", via, out.flag,
+				formatByteSize(size), timeout, err)
 		}
+	}
+	return nil
+}
 
-		if len(host) > 0 && k == "Host" {
-			// beginning of new block
+// remoteSize returns the size of file p on the target, with SFTP if sf is not
+// nil, else with wc. A missing file is fs.ErrNotExist.
+func (self SshCmd) remoteSize(conn *ssh.Client, sf *sftpTransfer, p string) (int64, error) {
+	if sf != nil {
+		return sf.Size(p)
+	}
+	out, err := self.remoteOutput(conn, "wc -c < "+shellQuote(p))
+	if err != nil {
+		// The shell cannot open it.
+		return 0, fs.ErrNotExist
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("size of %s: %q", p, out)
+	}
+	return size, nil
+}
 
-			hosts = append(hosts, host)
-			host = Host{}
-		}
+func (self SshCmd) downloadFile(scpClient scp.Client, src, dst string,
+	timeout time.Duration) error {
+	fi, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = scpClient.CopyFromRemotePassThru(ctx, fi, src,
+		newProgress(self.opts.logger, path.Base(dst)))
+	if err != nil {
+		return err
+	}
+	return fi.Close()
+}
 
-		if old, ok := host[k]; ok {
-			return nil,
-				fmt.Errorf("parseSshConfig: block 'Host %s': duplicated k/v: '%s %s', previous: '%s %s'",
-					host["Host"], k, v, k, old)
+// forwardSignals forwards the signals received by xprog to the test binary on
+// the target, until done is closed. Otherwise, on Ctrl-C or when go test
+// -timeout kills xprog, the test binary would keep running. On SIGQUIT, sent
+// by go test on timeout, the test binary prints the goroutine dump, that
+// reaches us via the session.
+func (self SshCmd) forwardSignals(conn *ssh.Client, pidFile string,
+	sigs <-chan os.Signal, done <-chan struct{}) {
+	log := self.opts.logger
+	for {
+		select {
+		case <-done:
+			return
+		case sig := <-sigs:
+			name := signalName(sig.(syscall.Signal))
+			log.Info("forwarding signal to test binary", "signal", name,
+				"target", self.addr)
+			if err := self.signalRemote(conn, pidFile, name); err != nil {
+				log.Warn("forwarding signal", "signal", name, "err", err)
+			}
 		}
-
-		host[k] = v
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+}
+
+// signalRemote sends signal name to the test binary, whose PID is in pidFile.
+func (self SshCmd) signalRemote(conn *ssh.Client, pidFile string, name string) error {
+	cmd := fmt.Sprintf(`kill -s %s "$(cat %s)"`, name, shellQuote(pidFile))
+	if self.Sudo {
+		cmd = "sudo " + cmd
 	}
+	return self.remoteRun(conn, cmd)
+}
 
-	if len(host) == 1 {
-		return nil, fmt.Errorf("parseSshConfig: empty 'Host' block: %v", host)
+// logChanges prints the summary of the files copied back by --sync-back.
+func (self SshCmd) logChanges(changes []fileChange) {
+	log := self.opts.logger
+	var created int
+	for _, change := range changes {
+		what := "modified"
+		if change.isNew {
+			what = "new"
+			created++
+		}
+		log.Info("sync-back: "+what, "path", change.path)
 	}
+	log.Info("sync-back: copied back to host", "modified", len(changes)-created,
+		"new", created)
+}
 
-	if len(host) > 0 {
-		hosts = append(hosts, host)
+// removeWorkDir removes the remote working directory, unless --keep-remote.
+func (self SshCmd) removeWorkDir(conn *ssh.Client, workDir string) {
+	log := self.opts.logger
+	if self.KeepRemote {
+		log.Info("keeping remote working directory", "dir", workDir,
+			"target", self.addr)
+		return
+	}
+	// With sudo, the test binary might have created files owned by root.
+	cmd := "rm -rf " + shellQuote(workDir)
+	if self.Sudo {
+		cmd = "sudo " + cmd
+	}
+	if err := self.remoteRun(conn, cmd); err != nil {
+		log.Warn("removing remote working directory", "err", err)
 	}
+}
+
+// remoteRun runs the helper command cmd on the target.
+func (self SshCmd) remoteRun(conn *ssh.Client, cmd string) error {
+	_, err := self.remoteOutput(conn, cmd)
+	return err
+}
 
-	if len(hosts) == 0 {
-		return nil, errors.New("parseSshConfig: empty file")
+// remoteOutput runs the helper command cmd on the target and returns its
+// standard output, without the trailing newline.
+func (self SshCmd) remoteOutput(conn *ssh.Client, cmd string) (string, error) {
+	sess, err := conn.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", cmd, err)
 	}
+	defer sess.Close()
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	out, err := sess.Output(cmd)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s: %s", cmd, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
 
-	seen := map[string]bool{}
-	for _, host := range hosts {
-		h := host["Host"]
-		if seen[h] {
-			return nil, fmt.Errorf("parseSshConfig: duplicated block 'Host %s'", h)
+// remoteExitError converts the error of running the test binary on target to
+// a testExitError, unless the outcome of the test binary is unknown (for
+// example, the connection has been lost).
+func remoteExitError(err error, target string) error {
+	if err == nil {
+		return nil
+	}
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) {
+		return fmt.Errorf("sshRun: execute TestBinary: %s", err)
+	}
+	where := "on " + target
+	if sig := exitErr.Signal(); sig != "" {
+		// ExitStatus is already exitSignal plus the signal number.
+		testErr := signalExitError(where, sig, exitErr.ExitStatus())
+		if msg := exitErr.Msg(); msg != "" {
+			testErr.msg += ": " + msg
 		}
-		seen[h] = true
+		return testErr
+	}
+	return &testExitError{
+		code: exitErr.ExitStatus(),
+		msg:  fmt.Sprintf("test binary %s: exit status %d", where, exitErr.ExitStatus()),
 	}
-
-	return hosts, nil
 }
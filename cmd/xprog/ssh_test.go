@@ -1,173 +1,205 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/alexflint/go-arg"
 	gliderssh "github.com/gliderlabs/ssh"
 	"github.com/google/go-cmp/cmp"
 	"github.com/hashicorp/go-hclog"
-
-	"github.com/marco-m/xprog"
+	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
 )
 
-func TestParseSshConfigSuccess(t *testing.T) {
+func TestSshCmdPrepareHost(t *testing.T) {
+	keyPath, err := filepath.Abs("../../testdata/client_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgPath := filepath.Join(t.TempDir(), "ssh_config")
+	contents := fmt.Sprintf(`
+Host debian
+  HostName 127.0.0.1
+  Port 2222
+
+Host alpine
+  HostName 127.0.0.1
+  Port 2200
+
+Host *
+  User vagrant
+  StrictHostKeyChecking no
+  IdentityFile %s
+`, keyPath)
+	if err := os.WriteFile(cfgPath, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
 	testCases := []struct {
-		name       string
-		contents   string
-		wantConfig []Host
+		name     string
+		host     string
+		wantAddr string
+		wantErr  string
 	}{
 		{
-			name: "smallest possible",
-			contents: `
-Host foobar
-  HostName 127.0.0.1
-`,
-			wantConfig: []Host{
-				{
-					"Host":     "foobar",
-					"HostName": "127.0.0.1",
-				},
-			},
+			name:     "default is first Host block",
+			wantAddr: "127.0.0.1:2222",
 		},
 		{
-			name: "as generated by vagrant ssh-config",
-			contents: `
-Host foobar
-  HostName 127.0.0.1
-  User vagrant
-  Port 2222
-  UserKnownHostsFile /dev/null
-  StrictHostKeyChecking no
-  PasswordAuthentication no
-  IdentityFile private_key
-  IdentitiesOnly yes
-`,
-			wantConfig: []Host{
-				{
-					"Host":                   "foobar",
-					"HostName":               "127.0.0.1",
-					"User":                   "vagrant",
-					"Port":                   "2222",
-					"UserKnownHostsFile":     "/dev/null",
-					"StrictHostKeyChecking":  "no",
-					"PasswordAuthentication": "no",
-					"IdentityFile":           "private_key",
-					"IdentitiesOnly":         "yes",
-				},
-			},
+			name:     "select by name",
+			host:     "alpine",
+			wantAddr: "127.0.0.1:2200",
 		},
 		{
-			name: "two hosts",
-			contents: `
-Host foobar
-  HostName 127.0.0.1
-
-Host zoo
-  HostName 1.2.3.4
-`,
-			wantConfig: []Host{
-				{
-					"Host":     "foobar",
-					"HostName": "127.0.0.1",
-				},
-				{
-					"Host":     "zoo",
-					"HostName": "1.2.3.4",
-				},
-			},
+			name: "unknown name",
+			host: "fedora",
+			wantErr: fmt.Sprintf(
+				"sshRun: ssh_config %s: unknown host 'fedora' (available: debian, alpine)",
+				cfgPath),
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			rd := strings.NewReader(tc.contents)
+			sut := SshCmd{
+				SshConfig: cfgPath,
+				Host:      tc.host,
+				opts:      Opts{logger: hclog.NewNullLogger()},
+			}
 
-			config, err := parseSshConfig(rd)
+			err := sut.prepare()
 
+			have := "<no error>"
 			if err != nil {
-				t.Fatalf("error: have: %s; want: <no error>", err)
+				have = err.Error()
 			}
-
-			if diff := cmp.Diff(config, tc.wantConfig); diff != "" {
-				t.Fatalf("\noutput mismatch (-have, +want)\n%s", diff)
+			want := tc.wantErr
+			if want == "" {
+				want = "<no error>"
+			}
+			if have != want {
+				t.Fatalf("error: have: %s; want: %s", have, want)
+			}
+			if have, want := sut.addr, tc.wantAddr; have != want {
+				t.Errorf("addr: have: %s; want: %s", have, want)
 			}
 		})
 	}
 }
 
-func TestParseSshConfigFailure(t *testing.T) {
+func TestSshCmdHostFromEnv(t *testing.T) {
+	t.Setenv("XPROG_HOST", "alpine")
+	var opts Opts
+	var out bytes.Buffer
+	args := []string{"ssh", "--cfg", "ssh_config", "--", "foo.test"}
+	if err := parse(&out, args, arg.Config{}, &opts); err != nil {
+		t.Fatalf("parse: %s\n%s", err, out.String())
+	}
+
+	if have, want := opts.Ssh.Host, "alpine"; have != want {
+		t.Errorf("host: have: %s; want: %s", have, want)
+	}
+}
+
+func TestRemoteExitError(t *testing.T) {
+	server := &gliderssh.Server{
+		Handler: func(sess gliderssh.Session) {
+			switch sess.RawCommand() {
+			case "exit 0":
+				sess.Exit(0)
+			case "exit 3":
+				sess.Exit(3)
+			case "signal":
+				payload := struct {
+					Signal     string
+					CoreDumped bool
+					Error      string
+					Lang       string
+				}{Signal: "KILL", Error: "oom-kill"}
+				sess.SendRequest("exit-signal", false, gossh.Marshal(payload))
+				sess.Close()
+			case "drop":
+				// Close without exit status.
+				sess.Close()
+			}
+		},
+		PublicKeyHandler: func(ctx gliderssh.Context, key gliderssh.PublicKey) bool {
+			return true
+		},
+	}
+	if err := gliderssh.HostKeyFile("../../testdata/host_key")(server); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	sshConf, err := loadSshConfig(writeTestSshConfig(t, "Host target\n  Port "+port+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := newSshTarget(sshConf, jumpHost{alias: "target"}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	client, err := target.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
 	testCases := []struct {
-		name     string
-		contents string
+		command  string
+		wantTest bool // want a testExitError
+		wantCode int
 		wantErr  string
 	}{
 		{
-			name:     "empty file",
-			contents: "",
-			wantErr:  "parseSshConfig: empty file",
-		},
-		{
-			name: "more than 2 tokens",
-			contents: `
-Host foobar
-  HostName A B
-`,
-			wantErr: "parseSshConfig: line 'HostName A B': 3 tokens instead of 2",
-		},
-		{
-			name:     "block must begin with Host",
-			contents: "User vagrant",
-			wantErr:  "parseSshConfig: line 'User vagrant': block must begin with 'Host'",
+			command: "exit 0",
+			wantErr: "<no error>",
 		},
 		{
-			name:     "empty Host block at beginning of file",
-			contents: "Host A",
-			wantErr:  "parseSshConfig: empty 'Host' block: map[Host:A]",
+			command:  "exit 3",
+			wantTest: true,
+			wantCode: 3,
+			wantErr:  "test binary on T: exit status 3",
 		},
 		{
-			name: "empty Host block in the middle of file",
-			contents: `
-Host A
-  HostName B
-
-Host C
-`,
-			wantErr: "parseSshConfig: empty 'Host' block: map[Host:C]",
+			command:  "signal",
+			wantTest: true,
+			wantCode: exitSignal + 9,
+			wantErr:  "test binary on T: killed by signal KILL (out of memory?): oom-kill",
 		},
 		{
-			name: "duplicated key in same block",
-			contents: `
-Host A
-  HostName B
-  User vagrant
-  HostName C
-`,
-			wantErr: "parseSshConfig: block 'Host A': duplicated k/v: 'HostName C', previous: 'HostName B'",
-		},
-		{
-			name: "duplicated Host",
-			contents: `
-Host A
-  HostName B
-
-Host X
-  HostName Y
-
-Host A
-  HostName C
-`,
-			wantErr: "parseSshConfig: duplicated block 'Host A'",
+			command: "drop",
+			wantErr: "sshRun: execute TestBinary: wait: remote command exited without exit status or exit signal",
 		},
 	}
 
 	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			rd := strings.NewReader(tc.contents)
+		t.Run(tc.command, func(t *testing.T) {
+			sess, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sess.Close()
 
-			_, err := parseSshConfig(rd)
+			err = remoteExitError(sess.Run(tc.command), "T")
 
 			have := "<no error>"
 			if err != nil {
@@ -176,105 +208,339 @@ Host A
 			if have != tc.wantErr {
 				t.Fatalf("error: have: %s; want: %s", have, tc.wantErr)
 			}
+			var testErr *testExitError
+			if have, want := errors.As(err, &testErr), tc.wantTest; have != want {
+				t.Fatalf("is testExitError: have: %v; want: %v", have, want)
+			}
+			if tc.wantTest && testErr.code != tc.wantCode {
+				t.Errorf("code: have: %d; want: %d", testErr.code, tc.wantCode)
+			}
 		})
 	}
 }
 
-func TestHostGet(t *testing.T) {
-	host := Host{
-		"K": "V",
+// startShellServer starts a SSH server on localhost that runs each command with
+// /bin/sh in a temporary directory, standing for the home directory on the
+// target (and also its TMPDIR; its XDG_CACHE_HOME is .cache below it). It
+// returns the path of a ssh_config file for host "target" and the home
+// directory.
+func startShellServer(t *testing.T) (string, string) {
+	t.Helper()
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("skip: scp not found")
 	}
-
-	{
-		have, err := host.Get("K")
-		want := "V"
-		if err != nil {
-			t.Fatalf("get existing key: error: %s", err)
-		}
-		if have != want {
-			t.Errorf("get existing key: have: %s; want: %s", have, want)
-		}
+	home := t.TempDir()
+	// The host caches of xprog, such as the base of the deltas.
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	server := &gliderssh.Server{
+		Handler: func(sess gliderssh.Session) {
+			cmd := exec.Command("/bin/sh", "-c", sess.RawCommand())
+			cmd.Dir = home
+			cmd.Env = append(os.Environ(), "HOME="+home, "TMPDIR="+home,
+				"XDG_CACHE_HOME="+home+"/.cache")
+			cmd.Stdout = sess
+			cmd.Stderr = sess.Stderr()
+			// As sshd, do not wait for the end of stdin once the command exits.
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			go func() {
+				io.Copy(stdin, sess)
+				stdin.Close()
+			}()
+			err = cmd.Run()
+			var exitErr *exec.ExitError
+			switch {
+			case err == nil:
+				sess.Exit(0)
+			case errors.As(err, &exitErr):
+				sess.Exit(exitErr.ExitCode())
+			default:
+				fmt.Fprintln(sess.Stderr(), err)
+				sess.Exit(255)
+			}
+		},
+		PublicKeyHandler: func(ctx gliderssh.Context, key gliderssh.PublicKey) bool {
+			return true
+		},
+		SubsystemHandlers: map[string]gliderssh.SubsystemHandler{
+			"sftp": func(sess gliderssh.Session) {
+				server, err := sftp.NewServer(sess)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				server.Serve()
+				server.Close()
+			},
+		},
 	}
-
-	{
-		if _, err := host.Get("X"); err == nil {
-			t.Fatal("get non-existing key: want: error; have: <no error>")
-		}
+	if err := gliderssh.HostKeyFile("../../testdata/host_key")(server); err != nil {
+		t.Fatal(err)
 	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	return writeTestSshConfig(t, "Host target\n  Port "+port+"\n"), home
 }
 
-func TestHostGetDef(t *testing.T) {
-	host := Host{
-		"K": "V",
+// writeTestBinary writes a shell script standing for the test binary and
+// returns its path.
+func writeTestBinary(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "foo.test")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
 	}
+	return path
+}
 
-	if have, want := host.GetDef("K", "default"), "V"; have != want {
-		t.Errorf("get existing key: have: %s; want: %s", have, want)
+func TestSshCmdRun(t *testing.T) {
+	sshConfig, home := startShellServer(t)
+	// The test binary writes the name of the output flags, except memprofile.
+	testBinary := writeTestBinary(t, `
+echo "${XPROG_SYS_TARGET%:*}${FOO:+ FOO=$FOO} $*" | sed "s|$(pwd)|WORKDIR|g" > "$HOME/args.txt"
+for arg; do
+  case $arg in
+  -test.coverprofile=*|-test.cpuprofile=*|-test.trace=*)
+    name=${arg#-test.}
+    echo "${name%%=*}" > "${arg#*=}" ;;
+  -test.run=fail) exit 1 ;;
+  esac
+done
+`)
+
+	testCases := []struct {
+		name      string
+		flags     []string // HOSTDIR is replaced with a directory on the host
+		env       []string
+		wantArgs  string
+		wantCode  int               // of testExitError; 0 means no error
+		wantFiles map[string]string // in HOSTDIR: name -> contents
+	}{
+		{
+			name:     "success",
+			flags:    []string{"-test.v"},
+			wantArgs: "-test.v",
+		},
+		{
+			name:     "arguments reach the test binary verbatim",
+			flags:    []string{"-test.run", "TestFoo/with space|$HOME*", "-test.v"},
+			wantArgs: "-test.run TestFoo/with space|$HOME* -test.v",
+		},
+		{
+			name:     "environment",
+			flags:    []string{"-test.v"},
+			env:      []string{"FOO=a b"},
+			wantArgs: "FOO=a b -test.v",
+		},
+		{
+			name:     "failure",
+			flags:    []string{"-test.run=fail"},
+			wantArgs: "-test.run=fail",
+			wantCode: 1,
+		},
+		{
+			name:      "failure still downloads the coverprofile",
+			flags:     []string{"-test.coverprofile=HOSTDIR/cover.out", "-test.run=fail"},
+			wantArgs:  "-test.coverprofile=WORKDIR/output/coverprofile-cover.out -test.run=fail",
+			wantCode:  1,
+			wantFiles: map[string]string{"cover.out": "coverprofile\n"},
+		},
+		{
+			name: "profiles relative to outputdir",
+			flags: []string{"-test.outputdir=HOSTDIR", "-test.cpuprofile=cpu.out",
+				"-test.trace=trace.out"},
+			wantArgs: "-test.outputdir=WORKDIR/output" +
+				" -test.cpuprofile=WORKDIR/output/cpuprofile-cpu.out" +
+				" -test.trace=WORKDIR/output/trace-trace.out",
+			wantFiles: map[string]string{
+				"cpu.out":   "cpuprofile\n",
+				"trace.out": "trace\n",
+			},
+		},
+		{
+			name:      "output file not produced is not an error",
+			flags:     []string{"-test.memprofile=HOSTDIR/mem.out"},
+			wantArgs:  "-test.memprofile=WORKDIR/output/memprofile-mem.out",
+			wantFiles: map[string]string{},
+		},
 	}
 
-	if have, want := host.GetDef("X", "default"), "default"; have != want {
-		t.Errorf("get non-existing key: have: %s; want: %s", have, want)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hostDir := t.TempDir()
+			var flags []string
+			for _, flag := range tc.flags {
+				flags = append(flags, strings.Replace(flag, "HOSTDIR", hostDir, 1))
+			}
+			sut := SshCmd{
+				CommonArgs: CommonArgs{TestBinary: testBinary, GoTestFlag: flags,
+					Env: tc.env},
+				SshConfig: sshConfig,
+				opts:      Opts{logger: hclog.NewNullLogger()},
+			}
+
+			err := sut.Run(sut.opts)
+
+			haveCode := 0
+			var testErr *testExitError
+			if errors.As(err, &testErr) {
+				haveCode = testErr.code
+			} else if err != nil {
+				t.Fatalf("error: have: %s; want: <no error> or testExitError", err)
+			}
+			if haveCode != tc.wantCode {
+				t.Errorf("exit code: have: %d; want: %d", haveCode, tc.wantCode)
+			}
+			args, err := os.ReadFile(filepath.Join(home, "args.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have, want := string(args), "127.0.0.1 "+tc.wantArgs+"\n"; have != want {
+				t.Errorf("args: have: %q; want: %q", have, want)
+			}
+			if tc.wantFiles != nil {
+				haveFiles := map[string]string{}
+				entries, err := os.ReadDir(hostDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, entry := range entries {
+					buf, err := os.ReadFile(filepath.Join(hostDir, entry.Name()))
+					if err != nil {
+						t.Fatal(err)
+					}
+					haveFiles[entry.Name()] = string(buf)
+				}
+				if diff := cmp.Diff(haveFiles, tc.wantFiles); diff != "" {
+					t.Errorf("\noutput files mismatch (-have, +want)\n%s", diff)
+				}
+			}
+			if dirs := remoteWorkDirs(t, home); len(dirs) > 0 {
+				t.Errorf("remote working directory not removed: %s", dirs)
+			}
+		})
 	}
 }
 
-func TestSshCmdRunMock(t *testing.T) {
-	t.Skip("broken")
-	if xprog.Absent() {
-		t.Skip("skip: cannot run under xprog")
+func TestSshCmdRunUpload(t *testing.T) {
+	testSshCmdRunUpload(t, "scp")
+}
+
+// testSshCmdRunUpload checks the upload of the test data with transport.
+func testSshCmdRunUpload(t *testing.T, transport string) {
+	sshConfig, home := startShellServer(t)
+	testBinary := writeTestBinary(t, `
+cat testdata/link > seen.txt
+`)
+	pkgDir := t.TempDir()
+	for _, dir := range []string{"testdata", "extra"} {
+		if err := os.Mkdir(filepath.Join(pkgDir, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]os.FileMode{
+		"testdata/data.txt": 0o640,
+		"testdata/run.sh":   0o755,
+		"extra/x.txt":       0o644,
+	}
+	for name, mode := range files {
+		if err := os.WriteFile(filepath.Join(pkgDir, name), []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("data.txt", filepath.Join(pkgDir, "testdata/link")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(pkgDir, "testdata/data.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
 	}
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	if err := os.WriteFile(outside, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, pkgDir)
 
-	server := gliderssh.Server{}
-	if err := gliderssh.HostKeyFile("../../testdata/host_key")(&server); err != nil {
+	sut := SshCmd{
+		CommonArgs: CommonArgs{TestBinary: testBinary},
+		SshConfig:  sshConfig,
+		Upload:     []string{"extra/x.txt", outside},
+		KeepRemote: true,
+		Transport:  transport,
+		opts:       Opts{logger: hclog.NewNullLogger()},
+	}
+	if err := sut.Run(sut.opts); err != nil {
 		t.Fatal(err)
 	}
-	listener, err := net.Listen("tcp", "127.0.0.1:")
+
+	dirs := remoteWorkDirs(t, home)
+	if len(dirs) != 1 {
+		t.Fatalf("remote working directories: have: %s; want: 1", dirs)
+	}
+	workDir := dirs[0]
+	seen, err := os.ReadFile(filepath.Join(workDir, "seen.txt"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	server.Handler = func(sess gliderssh.Session) {
-		t.Log("raw command:", sess.RawCommand())
-		if err := sess.Exit(0); err != nil {
-			t.Log("sess.Exit:", err)
-		}
+	if have, want := string(seen), "testdata/data.txt"; have != want {
+		t.Errorf("seen: have: %q; want: %q", have, want)
 	}
-	defer server.Close()
-
-	done := make(chan bool)
-	go func() {
-		err, want := server.Serve(listener), gliderssh.ErrServerClosed
-		if err != want {
-			t.Errorf("ssh server termination: have: %s; want: %s", err, want)
+	files["outside.txt"] = 0o600
+	for name, want := range files {
+		fi, err := os.Stat(filepath.Join(workDir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have := fi.Mode().Perm(); have != want {
+			t.Errorf("%s: mode: have: %s; want: %s", name, have, want)
 		}
-		done <- true
-	}()
-
-	var opts Opts
-	opts.out = os.Stderr
-	opts.logger = hclog.New(&hclog.LoggerOptions{
-		Name:   "xprog",
-		Output: opts.out,
-	})
-	if testing.Verbose() {
-		opts.logger.SetLevel(hclog.Debug)
 	}
-
-	sut := SshCmd{
-		CommonArgs: CommonArgs{TestBinary: "../../testdata/testbinary"},
-		SshConfig:  "../../testdata/ssh_config",
-		opts:       opts,
+	link, err := os.Readlink(filepath.Join(workDir, "testdata/link"))
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	if err := sut.prepare(); err != nil {
+	if have, want := link, "data.txt"; have != want {
+		t.Errorf("symlink: have: %s; want: %s", have, want)
+	}
+	fi, err := os.Stat(filepath.Join(workDir, "testdata/data.txt"))
+	if err != nil {
 		t.Fatal(err)
 	}
+	if have := fi.ModTime(); !have.Equal(mtime) {
+		t.Errorf("mtime: have: %s; want: %s", have, mtime)
+	}
+}
 
-	// Override the address with the test server.
-	sut.addr = listener.Addr().String()
-
-	if err := sut.execute(); err != nil {
+// remoteWorkDirs returns the remote working directories of foo.test created by
+// xprog in home, the TMPDIR of startShellServer.
+func remoteWorkDirs(t *testing.T, home string) []string {
+	t.Helper()
+	dirs, err := filepath.Glob(filepath.Join(home, "xprog-foo.test.*"))
+	if err != nil {
 		t.Fatal(err)
 	}
+	return dirs
+}
 
-	server.Close()
-	<-done
+// chdir changes the working directory to dir for the duration of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
 }
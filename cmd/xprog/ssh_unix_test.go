@@ -0,0 +1,47 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestSshCmdRunForwardsSignal(t *testing.T) {
+	sshConfig, home := startShellServer(t)
+	testBinary := writeTestBinary(t, `
+trap 'echo got TERM >&2; exit 7' TERM
+touch "$HOME/ready"
+while true; do sleep 0.1; done
+`)
+	sut := SshCmd{
+		CommonArgs: CommonArgs{TestBinary: testBinary},
+		SshConfig:  sshConfig,
+		opts:       Opts{logger: hclog.NewNullLogger()},
+	}
+	go func() {
+		for {
+			if _, err := os.Stat(filepath.Join(home, "ready")); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+
+	err := sut.Run(sut.opts)
+
+	var testErr *testExitError
+	if !errors.As(err, &testErr) {
+		t.Fatalf("error: have: %v; want: testExitError", err)
+	}
+	if have, want := testErr.code, 7; have != want {
+		t.Errorf("exit code: have: %d; want: %d", have, want)
+	}
+}
@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Host holds the effective settings of a host, as resolved from a ssh_config
+// file. Keys are lower-case, since ssh_config keys are case-insensitive.
+type Host map[string][]string
+
+// Get returns the first value of key if found or error if not found.
+func (self Host) Get(key string) (string, error) {
+	vals := self[strings.ToLower(key)]
+	if len(vals) > 0 && vals[0] != "" {
+		return vals[0], nil
+	}
+	return "", fmt.Errorf("ssh_config: missing key %s", key)
+}
+
+// GetDef returns the first value of key if found or def if not found.
+func (self Host) GetDef(key string, def string) string {
+	val, err := self.Get(key)
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+// GetAll returns all the values of key, in order of appearance. Useful for keys
+// that can be repeated, such as IdentityFile.
+func (self Host) GetAll(key string) []string {
+	return self[strings.ToLower(key)]
+}
+
+// SshConfig is a parsed ssh_config file. Use Resolve to obtain the settings of
+// a given host.
+type SshConfig struct {
+	entries []sshEntry
+	path    string // empty if not read from a file
+}
+
+// sshEntry is a directive of a ssh_config file. An Include directive carries
+// the entries of the included files.
+type sshEntry struct {
+	key      string // lower-case
+	args     []string
+	pos      string // file:line, for error messages
+	included []sshEntry
+}
+
+// Keys that accumulate values instead of following the first-match-wins rule.
+var multiValueKeys = map[string]bool{
+	"certificatefile": true,
+	"dynamicforward":  true,
+	"identityfile":    true,
+	"localforward":    true,
+	"remoteforward":   true,
+	"sendenv":         true,
+	"setenv":          true,
+}
+
+// Keys whose arguments form a single value (a forwarding specification).
+var joinedKeys = map[string]bool{
+	"dynamicforward": true,
+	"localforward":   true,
+	"remoteforward":  true,
+}
+
+// Keys whose value is the rest of the line, passed verbatim to a shell.
+var rawKeys = map[string]bool{
+	"knownhostscommand": true,
+	"localcommand":      true,
+	"proxycommand":      true,
+	"remotecommand":     true,
+}
+
+// Keys expanded with the full set of tokens, tilde and environment variables.
+var pathKeys = map[string]bool{
+	"certificatefile":    true,
+	"controlpath":        true,
+	"identityagent":      true,
+	"identityfile":       true,
+	"revokedhostkeys":    true,
+	"userknownhostsfile": true,
+}
+
+// Keys expanded with the full set of tokens, but not tilde.
+var commandKeys = map[string]bool{
+	"knownhostscommand": true,
+	"localcommand":      true,
+	"remotecommand":     true,
+}
+
+// Keys expanded with the reduced set of tokens %%, %h, %n, %p and %r.
+var proxyKeys = map[string]bool{
+	"proxycommand": true,
+	"proxyjump":    true,
+}
+
+// Keys that exclude each other.
+var competingKeys = map[string]string{
+	"proxycommand": "proxyjump",
+	"proxyjump":    "proxycommand",
+}
+
+// Maximum nesting of Include directives, as OpenSSH.
+const maxIncludeDepth = 16
+
+// loadSshConfig reads and parses the ssh_config file at path.
+func loadSshConfig(path string) (*SshConfig, error) {
+	entries, err := readSshConfigFile(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &SshConfig{entries: entries, path: path}, nil
+}
+
+// parseSshConfig parses a ssh_config file, following the syntax of
+// ssh_config(5): comments, "Key Value" and "Key=Value" forms, quoted arguments,
+// Host and Match blocks and Include directives.
+func parseSshConfig(rd io.Reader) (*SshConfig, error) {
+	entries, err := parseSshEntries(rd, "ssh_config", 0)
+	if err != nil {
+		return nil, err
+	}
+	return &SshConfig{entries: entries}, nil
+}
+
+func readSshConfigFile(path string, depth int) ([]sshEntry, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("parseSshConfig: %s", err)
+	}
+	defer fi.Close()
+	return parseSshEntries(fi, path, depth)
+}
+
+func parseSshEntries(rd io.Reader, name string, depth int) ([]sshEntry, error) {
+	var entries []sshEntry
+	scanner := bufio.NewScanner(rd)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		pos := fmt.Sprintf("%s:%d", name, lineNo)
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		end := strings.IndexAny(line, " \t=")
+		if end == -1 {
+			end = len(line)
+		}
+		key := strings.ToLower(line[:end])
+		rest := strings.TrimLeft(line[end:], " \t")
+		rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+
+		var args []string
+		if rawKeys[key] {
+			if rest != "" {
+				args = []string{rest}
+			}
+		} else {
+			var err error
+			if args, err = splitArgs(rest); err != nil {
+				return nil, fmt.Errorf("parseSshConfig: %s: %s", pos, err)
+			}
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("parseSshConfig: %s: missing argument for '%s'",
+				pos, line[:end])
+		}
+
+		entry := sshEntry{key: key, args: args, pos: pos}
+		if key == "include" {
+			if depth >= maxIncludeDepth {
+				return nil, fmt.Errorf("parseSshConfig: %s: too many nested Include",
+					pos)
+			}
+			included, err := includeSshConfig(args, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entry.included = included
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("parseSshConfig: %s: %s", name, err)
+	}
+
+	return entries, nil
+}
+
+// includeSshConfig parses the files matching the glob patterns of an Include
+// directive. As in OpenSSH, relative paths are relative to ~/.ssh and a
+// pattern without matches is not an error.
+func includeSshConfig(patterns []string, depth int) ([]sshEntry, error) {
+	var entries []sshEntry
+	for _, pattern := range patterns {
+		pattern, err := expandTilde(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("parseSshConfig: Include: %s", err)
+		}
+		if !filepath.IsAbs(pattern) {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("parseSshConfig: Include: %s", err)
+			}
+			pattern = filepath.Join(home, ".ssh", pattern)
+		}
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("parseSshConfig: Include %s: %s", pattern, err)
+		}
+		for _, path := range paths {
+			included, err := readSshConfigFile(path, depth)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, included...)
+		}
+	}
+	return entries, nil
+}
+
+// splitArgs splits the arguments of a ssh_config line. Arguments are separated
+// by whitespace and can be enclosed in single or double quotes; an unquoted
+// '#' at the beginning of an argument starts a comment.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+				continue
+			}
+			if c == '\\' && i+1 < len(line) &&
+				(line[i+1] == quote || line[i+1] == '\\') {
+				i++
+				c = line[i]
+			}
+			arg.WriteByte(c)
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case c == '#' && !inArg:
+			return args, nil
+		case c == '"' || c == '\'':
+			quote = c
+			inArg = true
+		case c == '\\' && i+1 < len(line) && strings.IndexByte(`\"' `, line[i+1]) >= 0:
+			i++
+			arg.WriteByte(line[i])
+			inArg = true
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Aliases returns the names of the Host blocks, in order of appearance,
+// skipping patterns that contain wildcards or negations.
+func (self *SshConfig) Aliases() []string {
+	var aliases []string
+	seen := map[string]bool{}
+	var walk func(entries []sshEntry)
+	walk = func(entries []sshEntry) {
+		for _, entry := range entries {
+			walk(entry.included)
+			if entry.key != "host" {
+				continue
+			}
+			for _, pattern := range entry.args {
+				if strings.ContainsAny(pattern, "*?!") || seen[pattern] {
+					continue
+				}
+				seen[pattern] = true
+				aliases = append(aliases, pattern)
+			}
+		}
+	}
+	walk(self.entries)
+	return aliases
+}
+
+// HasHost reports whether alias is named by a Host block, either literally or
+// via a pattern such as "*.lab". The catch-all pattern "*" does not count.
+func (self *SshConfig) HasHost(alias string) bool {
+	var walk func(entries []sshEntry) bool
+	walk = func(entries []sshEntry) bool {
+		for _, entry := range entries {
+			if walk(entry.included) {
+				return true
+			}
+			if entry.key != "host" {
+				continue
+			}
+			var patterns []string
+			for _, pattern := range entry.args {
+				if pattern != "*" {
+					patterns = append(patterns, pattern)
+				}
+			}
+			if matchPatternList(alias, patterns, true) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(self.entries)
+}
+
+// Resolve returns the effective settings for the host named alias, as OpenSSH
+// does: the Host and Match blocks are evaluated in order of appearance and for
+// each key the first obtained value wins, apart from keys that accumulate,
+// such as IdentityFile. Missing HostName, Port and User get the OpenSSH
+// defaults, then tokens (%h, %u, ...), ~ and ${ENV} are expanded.
+func (self *SshConfig) Resolve(alias string) (Host, error) {
+	local, err := currentLocal()
+	if err != nil {
+		return nil, fmt.Errorf("ssh_config: %s", err)
+	}
+	res := resolver{alias: alias, local: local, host: Host{}}
+	if err := res.eval(self.entries); err != nil {
+		return nil, err
+	}
+	if res.wantFinal {
+		// As OpenSSH, a "Match final" triggers a second pass over the whole
+		// file; values obtained in the first pass still take precedence.
+		res.final = true
+		if err := res.eval(self.entries); err != nil {
+			return nil, err
+		}
+	}
+
+	host := res.host
+	hostName, err := expandTokens(host.GetDef("HostName", alias),
+		map[byte]string{'h': alias})
+	if err != nil {
+		return nil, fmt.Errorf("ssh_config: HostName: %s", err)
+	}
+	host["hostname"] = []string{hostName}
+	if _, ok := host["port"]; !ok {
+		host["port"] = []string{"22"}
+	}
+	if _, ok := host["user"]; !ok {
+		host["user"] = []string{local.user}
+	}
+
+	if err := host.expand(alias, local); err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+// localInfo is the information about the local side used by token expansion
+// and by Match.
+type localInfo struct {
+	user     string
+	home     string
+	hostname string
+	uid      string
+}
+
+func currentLocal() (localInfo, error) {
+	var local localInfo
+	if u, err := user.Current(); err == nil {
+		local.user = u.Username
+	} else {
+		local.user = os.Getenv("USER")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return local, err
+	}
+	local.home = home
+	local.hostname, _ = os.Hostname()
+	local.uid = strconv.Itoa(os.Getuid())
+	return local, nil
+}
+
+type resolver struct {
+	alias     string
+	local     localInfo
+	host      Host
+	final     bool // this is the final pass
+	wantFinal bool // a "Match final" has been seen
+}
+
+// eval evaluates entries, starting as if in a matching block. Recursion on
+// Include keeps the state of the including block unchanged, so that an Include
+// inside a Host or Match block is conditional on that block.
+func (self *resolver) eval(entries []sshEntry) error {
+	active := true
+	for _, entry := range entries {
+		switch entry.key {
+		case "host":
+			active = matchPatternList(self.alias, entry.args, true)
+		case "match":
+			var err error
+			if active, err = self.match(entry); err != nil {
+				return err
+			}
+		case "include":
+			if active {
+				if err := self.eval(entry.included); err != nil {
+					return err
+				}
+			}
+		default:
+			if active {
+				self.set(entry)
+			}
+		}
+	}
+	return nil
+}
+
+func (self *resolver) set(entry sshEntry) {
+	vals := entry.args
+	if joinedKeys[entry.key] {
+		vals = []string{strings.Join(vals, " ")}
+	}
+	if multiValueKeys[entry.key] {
+		self.host[entry.key] = append(self.host[entry.key], vals...)
+		return
+	}
+	// ProxyJump and ProxyCommand compete: the first one obtained wins.
+	if competing, ok := competingKeys[entry.key]; ok {
+		if _, ok := self.host[competing]; ok {
+			return
+		}
+	}
+	if _, ok := self.host[entry.key]; !ok {
+		self.host[entry.key] = vals
+	}
+}
+
+// match evaluates the criteria of a Match line: all criteria must match.
+func (self *resolver) match(entry sshEntry) (bool, error) {
+	result := true
+	args := entry.args
+	for i := 0; i < len(args); i++ {
+		criteria := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criteria, "!")
+		criteria = strings.TrimPrefix(criteria, "!")
+
+		var matched bool
+		switch criteria {
+		case "all":
+			matched = true
+		case "canonical", "final":
+			// We never canonicalize, so both match only in the final pass.
+			if criteria == "final" {
+				self.wantFinal = true
+			}
+			matched = self.final
+		case "host", "originalhost", "user", "localuser", "exec", "tagged":
+			if i+1 == len(args) {
+				return false, fmt.Errorf("ssh_config: %s: Match %s: missing argument",
+					entry.pos, criteria)
+			}
+			i++
+			var err error
+			if matched, err = self.matchCriteria(criteria, args[i]); err != nil {
+				return false, fmt.Errorf("ssh_config: %s: Match %s: %s",
+					entry.pos, criteria, err)
+			}
+		default:
+			return false, fmt.Errorf("ssh_config: %s: unsupported Match criteria '%s'",
+				entry.pos, args[i])
+		}
+		if matched == negate {
+			result = false
+		}
+	}
+	return result, nil
+}
+
+func (self *resolver) matchCriteria(criteria string, arg string) (bool, error) {
+	patterns := strings.Split(arg, ",")
+	switch criteria {
+	case "host":
+		hostName := self.host.GetDef("HostName", self.alias)
+		hostName, err := expandTokens(hostName, map[byte]string{'h': self.alias})
+		if err != nil {
+			return false, err
+		}
+		return matchPatternList(hostName, patterns, true), nil
+	case "originalhost":
+		return matchPatternList(self.alias, patterns, true), nil
+	case "user":
+		return matchPatternList(self.host.GetDef("User", self.local.user), patterns,
+			false), nil
+	case "localuser":
+		return matchPatternList(self.local.user, patterns, false), nil
+	case "tagged":
+		return matchPatternList(self.host.GetDef("Tag", ""), patterns, false), nil
+	case "exec":
+		command, err := expandTokens(arg, self.tokens())
+		if err != nil {
+			return false, err
+		}
+		err = exec.Command("/bin/sh", "-c", command).Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return false, fmt.Errorf("unknown criteria")
+}
+
+// tokens returns the tokens available while still evaluating the blocks.
+func (self *resolver) tokens() map[byte]string {
+	host := Host{}
+	for k, v := range self.host {
+		host[k] = v
+	}
+	host["hostname"] = []string{self.host.GetDef("HostName", self.alias)}
+	host["port"] = []string{self.host.GetDef("Port", "22")}
+	host["user"] = []string{self.host.GetDef("User", self.local.user)}
+	return host.tokens(self.alias, self.local)
+}
+
+// tokens returns the values of the percent tokens of ssh_config(5).
+func (self Host) tokens(alias string, local localInfo) map[byte]string {
+	hostName := self.GetDef("HostName", alias)
+	port := self.GetDef("Port", "22")
+	user := self.GetDef("User", local.user)
+	jump := self.GetDef("ProxyJump", "")
+	if jump == "none" {
+		jump = ""
+	}
+	short, _, _ := strings.Cut(local.hostname, ".")
+	hash := sha1.Sum([]byte(local.hostname + hostName + port + user + jump))
+
+	return map[byte]string{
+		'C': hex.EncodeToString(hash[:]),
+		'd': local.home,
+		'h': hostName,
+		'i': local.uid,
+		'j': jump,
+		'k': self.GetDef("HostKeyAlias", alias),
+		'L': short,
+		'l': local.hostname,
+		'n': alias,
+		'p': port,
+		'r': user,
+		'u': local.user,
+	}
+}
+
+// expand expands ~, ${ENV} and the percent tokens in the values of the keys
+// that support them.
+func (self Host) expand(alias string, local localInfo) error {
+	all := self.tokens(alias, local)
+	proxy := map[byte]string{}
+	for _, t := range []byte("hnpr") {
+		proxy[t] = all[t]
+	}
+
+	for key, vals := range self {
+		var tokens map[byte]string
+		switch {
+		case pathKeys[key], commandKeys[key]:
+			tokens = all
+		case proxyKeys[key]:
+			tokens = proxy
+		default:
+			continue
+		}
+		expanded := make([]string, 0, len(vals))
+		for _, val := range vals {
+			var err error
+			if pathKeys[key] {
+				if val, err = expandTilde(val); err != nil {
+					return fmt.Errorf("ssh_config: %s: %s", key, err)
+				}
+				if val, err = expandEnv(val); err != nil {
+					return fmt.Errorf("ssh_config: %s: %s", key, err)
+				}
+			}
+			if val, err = expandTokens(val, tokens); err != nil {
+				return fmt.Errorf("ssh_config: %s: %s", key, err)
+			}
+			expanded = append(expanded, val)
+		}
+		self[key] = expanded
+	}
+	return nil
+}
+
+// expandTokens replaces each %x in s with tokens[x]; %% is a literal '%'.
+func expandTokens(s string, tokens map[byte]string) (string, error) {
+	var bld strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			bld.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("'%s': invalid trailing '%%'", s)
+		}
+		if s[i] == '%' {
+			bld.WriteByte('%')
+			continue
+		}
+		val, ok := tokens[s[i]]
+		if !ok {
+			return "", fmt.Errorf("'%s': unknown token %%%c", s, s[i])
+		}
+		bld.WriteString(val)
+	}
+	return bld.String(), nil
+}
+
+// expandTilde replaces a leading ~ or ~/ with the home directory.
+func expandTilde(s string) (string, error) {
+	if s != "~" && !strings.HasPrefix(s, "~/") {
+		return s, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return home + s[1:], nil
+}
+
+// expandEnv replaces each ${VAR} in s with the value of the environment
+// variable VAR. As OpenSSH, an undefined variable is an error.
+func expandEnv(s string) (string, error) {
+	var bld strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start == -1 {
+			bld.WriteString(s)
+			return bld.String(), nil
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end == -1 {
+			return "", fmt.Errorf("'%s': unterminated ${", s)
+		}
+		name := s[start+2 : start+end]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("'%s': environment variable %s not set", s, name)
+		}
+		bld.WriteString(s[:start])
+		bld.WriteString(val)
+		s = s[start+end+1:]
+	}
+}
+
+// matchPatternList reports whether s matches the list of patterns, with the
+// semantics of OpenSSH: a match on a negated pattern (!pattern) wins over any
+// other match. Host names are compared case-insensitively.
+func matchPatternList(s string, patterns []string, hostNames bool) bool {
+	if hostNames {
+		s = strings.ToLower(s)
+	}
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if hostNames {
+			pattern = strings.ToLower(pattern)
+		}
+		if matchPattern(s, pattern) {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchPattern reports whether s matches pattern, where '*' matches zero or
+// more characters and '?' matches exactly one character.
+func matchPattern(s string, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(s[i:], pattern[1:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		s, pattern = s[1:], pattern[1:]
+	}
+	return len(s) == 0
+}
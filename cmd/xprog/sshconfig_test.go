@@ -0,0 +1,562 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSshConfigResolveSuccess(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XPROG_TEST_KEYS", "/keys")
+
+	testCases := []struct {
+		name     string
+		contents string
+		alias    string
+		wantHost Host
+	}{
+		{
+			name: "as generated by vagrant ssh-config",
+			contents: `
+Host foobar
+  HostName 127.0.0.1
+  User vagrant
+  Port 2222
+  UserKnownHostsFile /dev/null
+  StrictHostKeyChecking no
+  PasswordAuthentication no
+  IdentityFile private_key
+  IdentitiesOnly yes
+`,
+			alias: "foobar",
+			wantHost: Host{
+				"hostname":               {"127.0.0.1"},
+				"user":                   {"vagrant"},
+				"port":                   {"2222"},
+				"userknownhostsfile":     {"/dev/null"},
+				"stricthostkeychecking":  {"no"},
+				"passwordauthentication": {"no"},
+				"identityfile":           {"private_key"},
+				"identitiesonly":         {"yes"},
+			},
+		},
+		{
+			name: "pick the second of two hosts",
+			contents: `
+Host foobar
+  HostName 127.0.0.1
+
+Host zoo
+  HostName 1.2.3.4
+  User bob
+`,
+			alias: "zoo",
+			wantHost: Host{
+				"hostname": {"1.2.3.4"},
+				"port":     {"22"},
+				"user":     {"bob"},
+			},
+		},
+		{
+			name: "comments, case-insensitive keys, Key=Value and quotes",
+			contents: `
+# A comment
+Host zoo # trailing comment
+  hostname=1.2.3.4
+  USER = bob
+  IdentityFile "/path with/spaces"
+  Port '2222'
+`,
+			alias: "zoo",
+			wantHost: Host{
+				"hostname":     {"1.2.3.4"},
+				"port":         {"2222"},
+				"user":         {"bob"},
+				"identityfile": {"/path with/spaces"},
+			},
+		},
+		{
+			name: "first match wins, wildcard defaults, multi-value keys",
+			contents: `
+Host zoo
+  User bob
+  IdentityFile /a
+
+Host z*
+  User alice
+  Port 2222
+  IdentityFile /b
+
+Host *
+  User nobody
+  Port 22
+  IdentityFile /c
+`,
+			alias: "zoo",
+			wantHost: Host{
+				"hostname":     {"zoo"},
+				"port":         {"2222"},
+				"user":         {"bob"},
+				"identityfile": {"/a", "/b", "/c"},
+			},
+		},
+		{
+			name: "negated patterns",
+			contents: `
+Host *.lab !bastion.lab
+  User bob
+
+Host *
+  User alice
+`,
+			alias: "bastion.lab",
+			wantHost: Host{
+				"hostname": {"bastion.lab"},
+				"port":     {"22"},
+				"user":     {"alice"},
+			},
+		},
+		{
+			name: "Match host and originalhost",
+			contents: `
+Host zoo
+  HostName zoo.example.com
+
+Match originalhost zoo host *.example.com
+  User bob
+`,
+			alias: "zoo",
+			wantHost: Host{
+				"hostname": {"zoo.example.com"},
+				"port":     {"22"},
+				"user":     {"bob"},
+			},
+		},
+		{
+			name: "Match negated, all and exec",
+			contents: `
+Match !host zoo
+  User nobody
+
+Match exec "test %h = zoo"
+  Port 2222
+
+Match exec false
+  Port 3333
+
+Match all
+  User bob
+`,
+			alias: "zoo",
+			wantHost: Host{
+				"hostname": {"zoo"},
+				"port":     {"2222"},
+				"user":     {"bob"},
+			},
+		},
+		{
+			name: "Match final is evaluated in a second pass",
+			contents: `
+Match final
+  User bob
+  Port 2222
+
+Host zoo
+  User alice
+`,
+			alias: "zoo",
+			wantHost: Host{
+				"hostname": {"zoo"},
+				"port":     {"2222"},
+				"user":     {"alice"},
+			},
+		},
+		{
+			name: "ProxyJump and ProxyCommand compete",
+			contents: `
+Host zoo
+  User bob
+  ProxyCommand nc %h %p
+
+Host *
+  ProxyJump bastion
+`,
+			alias: "zoo",
+			wantHost: Host{
+				"hostname":     {"zoo"},
+				"port":         {"22"},
+				"user":         {"bob"},
+				"proxycommand": {"nc zoo 22"},
+			},
+		},
+		{
+			name: "token, tilde and environment expansion",
+			contents: `
+Host zoo
+  HostName %h.example.com
+  User bob
+  Port 2222
+  IdentityFile ~/.ssh/%n_%r
+  IdentityFile ${XPROG_TEST_KEYS}/%h:%p
+  UserKnownHostsFile %d/known_hosts
+  ProxyCommand nc %h %p
+`,
+			alias: "zoo",
+			wantHost: Host{
+				"hostname": {"zoo.example.com"},
+				"port":     {"2222"},
+				"user":     {"bob"},
+				"identityfile": {
+					home + "/.ssh/zoo_bob",
+					"/keys/zoo.example.com:2222",
+				},
+				"userknownhostsfile": {home + "/known_hosts"},
+				"proxycommand":       {"nc zoo.example.com 2222"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := parseSshConfig(strings.NewReader(tc.contents))
+			if err != nil {
+				t.Fatalf("parse: error: have: %s; want: <no error>", err)
+			}
+
+			host, err := config.Resolve(tc.alias)
+			if err != nil {
+				t.Fatalf("resolve: error: have: %s; want: <no error>", err)
+			}
+
+			if diff := cmp.Diff(host, tc.wantHost); diff != "" {
+				t.Fatalf("\noutput mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSshConfigResolveDefaults(t *testing.T) {
+	config, err := parseSshConfig(strings.NewReader("Host foo\n  Port 2222\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := config.Resolve("bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Host{
+		"hostname": {"bar"},
+		"port":     {"22"},
+		"user":     {current.Username},
+	}
+	if diff := cmp.Diff(host, want); diff != "" {
+		t.Fatalf("\noutput mismatch (-have, +want)\n%s", diff)
+	}
+}
+
+func TestSshConfigInclude(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotSsh := filepath.Join(home, ".ssh")
+	if err := os.MkdirAll(filepath.Join(dotSsh, "config.d"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"config.d/a.conf": "Host zoo\n  User bob\n",
+		"config.d/b.conf": "Host zoo\n  User alice\n  Port 2222\n",
+		"conditional":     "Port 3333\nHost *\n  IdentityFile /b\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dotSsh, name), []byte(contents),
+			0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contents := `
+Include config.d/*.conf
+
+Host zoo
+  Include conditional
+  IdentityFile /a
+
+Host other
+  Include ~/.ssh/conditional
+  Include nonexisting
+`
+	config, err := parseSshConfig(strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	{
+		host, err := config.Resolve("zoo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Host{
+			"hostname":     {"zoo"},
+			"port":         {"2222"},
+			"user":         {"bob"},
+			"identityfile": {"/b", "/a"},
+		}
+		if diff := cmp.Diff(host, want); diff != "" {
+			t.Errorf("\nzoo: output mismatch (-have, +want)\n%s", diff)
+		}
+	}
+
+	{
+		have := config.Aliases()
+		want := []string{"zoo", "other"}
+		if diff := cmp.Diff(have, want); diff != "" {
+			t.Errorf("\naliases: output mismatch (-have, +want)\n%s", diff)
+		}
+	}
+}
+
+func TestSshConfigAliases(t *testing.T) {
+	contents := `
+Host *
+  User bob
+Host foo bar *.lab !baz
+  Port 22
+Match host zoo
+  Port 22
+Host foo qux
+  Port 22
+`
+	config, err := parseSshConfig(strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := config.Aliases()
+	want := []string{"foo", "bar", "qux"}
+	if diff := cmp.Diff(have, want); diff != "" {
+		t.Errorf("\noutput mismatch (-have, +want)\n%s", diff)
+	}
+}
+
+func TestSshConfigHasHost(t *testing.T) {
+	contents := `
+Host *
+  User bob
+Host foo *.lab !bad.lab
+  Port 22
+`
+	config, err := parseSshConfig(strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		alias string
+		want  bool
+	}{
+		{alias: "foo", want: true},
+		{alias: "FOO", want: true},
+		{alias: "a.lab", want: true},
+		{alias: "bad.lab", want: false},
+		{alias: "bar", want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.alias, func(t *testing.T) {
+			if have := config.HasHost(tc.alias); have != tc.want {
+				t.Fatalf("have: %v; want: %v", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseSshConfigFailure(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{
+			name: "missing argument",
+			contents: `
+Host foobar
+  HostName
+`,
+			wantErr: "parseSshConfig: ssh_config:3: missing argument for 'HostName'",
+		},
+		{
+			name:     "unterminated quote",
+			contents: `IdentityFile "foo`,
+			wantErr:  "parseSshConfig: ssh_config:1: unterminated quote",
+		},
+		{
+			name:     "Include of unreadable file",
+			contents: "Include /",
+			wantErr:  "parseSshConfig: /: read /: is a directory",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseSshConfig(strings.NewReader(tc.contents))
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			if have != tc.wantErr {
+				t.Fatalf("error: have: %s; want: %s", have, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSshConfigResolveFailure(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{
+			name:     "unsupported Match criteria",
+			contents: "Match localnetwork 10.0.0.0/8\n  User bob\n",
+			wantErr:  "ssh_config: ssh_config:1: unsupported Match criteria 'localnetwork'",
+		},
+		{
+			name:     "Match criteria without argument",
+			contents: "Match host\n  User bob\n",
+			wantErr:  "ssh_config: ssh_config:1: Match host: missing argument",
+		},
+		{
+			name:     "unknown token",
+			contents: "Host foo\n  IdentityFile %z\n",
+			wantErr:  "ssh_config: identityfile: '%z': unknown token %z",
+		},
+		{
+			name:     "undefined environment variable",
+			contents: "Host foo\n  IdentityFile ${XPROG_TEST_UNDEFINED}\n",
+			wantErr:  "ssh_config: identityfile: '${XPROG_TEST_UNDEFINED}': environment variable XPROG_TEST_UNDEFINED not set",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := parseSshConfig(strings.NewReader(tc.contents))
+			if err != nil {
+				t.Fatalf("parse: error: have: %s; want: <no error>", err)
+			}
+
+			_, err = config.Resolve("foo")
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			if have != tc.wantErr {
+				t.Fatalf("error: have: %s; want: %s", have, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	testCases := []struct {
+		line     string
+		wantArgs []string
+	}{
+		{line: "", wantArgs: nil},
+		{line: "a", wantArgs: []string{"a"}},
+		{line: "  a \t b  ", wantArgs: []string{"a", "b"}},
+		{line: `"a b" c`, wantArgs: []string{"a b", "c"}},
+		{line: `'a "b"' c`, wantArgs: []string{`a "b"`, "c"}},
+		{line: `"a \"b\""`, wantArgs: []string{`a "b"`}},
+		{line: `a\ b`, wantArgs: []string{"a b"}},
+		{line: `a#b # comment`, wantArgs: []string{"a#b"}},
+		{line: `""`, wantArgs: []string{""}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.line, func(t *testing.T) {
+			have, err := splitArgs(tc.line)
+			if err != nil {
+				t.Fatalf("error: have: %s; want: <no error>", err)
+			}
+			if diff := cmp.Diff(have, tc.wantArgs); diff != "" {
+				t.Fatalf("\noutput mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMatchPatternList(t *testing.T) {
+	testCases := []struct {
+		s        string
+		patterns string
+		want     bool
+	}{
+		{s: "foo", patterns: "foo", want: true},
+		{s: "FOO", patterns: "foo", want: true},
+		{s: "foo", patterns: "bar", want: false},
+		{s: "foo", patterns: "*", want: true},
+		{s: "foo", patterns: "f?o", want: true},
+		{s: "foo", patterns: "f?", want: false},
+		{s: "a.lab", patterns: "*.lab", want: true},
+		{s: "a.lab", patterns: "*.lab,!a.*", want: false},
+		{s: "b.lab", patterns: "!a.*", want: false},
+		{s: "foo", patterns: "bar,foo", want: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.s+" "+tc.patterns, func(t *testing.T) {
+			have := matchPatternList(tc.s, strings.Split(tc.patterns, ","), true)
+			if have != tc.want {
+				t.Fatalf("have: %v; want: %v", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestHostGet(t *testing.T) {
+	host := Host{
+		"k": {"V"},
+	}
+
+	{
+		have, err := host.Get("K")
+		want := "V"
+		if err != nil {
+			t.Fatalf("get existing key: error: %s", err)
+		}
+		if have != want {
+			t.Errorf("get existing key: have: %s; want: %s", have, want)
+		}
+	}
+
+	{
+		if _, err := host.Get("X"); err == nil {
+			t.Fatal("get non-existing key: want: error; have: <no error>")
+		}
+	}
+}
+
+func TestHostGetDef(t *testing.T) {
+	host := Host{
+		"k": {"V"},
+	}
+
+	if have, want := host.GetDef("K", "default"), "V"; have != want {
+		t.Errorf("get existing key: have: %s; want: %s", have, want)
+	}
+
+	if have, want := host.GetDef("X", "default"), "default"; have != want {
+		t.Errorf("get non-existing key: have: %s; want: %s", have, want)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fileChange is a file of the remote working directory that differs from the
+// host package directory.
+type fileChange struct {
+	path  string // slash-separated, relative to the working directory
+	isNew bool
+}
+
+// checkSyncBackPaths verifies that the paths to sync back are within the
+// package directory, to avoid overwriting files elsewhere on the host, and do
+// not contain the files written by xprog in the remote working directory, for
+// test binary testBinary.
+func checkSyncBackPaths(paths []string, testBinary string) error {
+	// The names written by xprog at the top of the working directory; "."
+	// holds them all.
+	written := map[string]bool{
+		".":                            true,
+		path.Base(testBinary):          true,
+		path.Base(testBinary) + ".pid": true,
+		"output":                       true,
+		"gocoverdir":                   true,
+		"testgocoverdir":               true,
+		"fuzzcache":                    true,
+	}
+	for _, p := range paths {
+		if !filepath.IsLocal(p) {
+			return fmt.Errorf("sync-back %s: must be a relative path within the package directory", p)
+		}
+		top, _, _ := strings.Cut(path.Clean(filepath.ToSlash(p)), "/")
+		if written[top] {
+			return fmt.Errorf("sync-back %s: contains files written by xprog on the target (test binary, pid file, output)", p)
+		}
+	}
+	return nil
+}
+
+// syncBack copies back to the package directory on the host the files below
+// paths in remote directory workDir that are new or that differ from the host,
+// for example golden files rewritten by a test run with -update. Files deleted
+// on the target are left alone.
+func syncBack(conn *ssh.Client, sf *sftpTransfer, workDir string, paths []string,
+	timeout func(size int64) time.Duration) ([]fileChange, error) {
+	var remote checksums
+	var err error
+	if sf != nil {
+		remote, err = sf.Checksums(workDir, paths)
+	} else {
+		remote, err = remoteChecksums(conn, workDir, paths)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var changes []fileChange
+	var files []remoteFile
+	for _, file := range remote.names {
+		sum, err := localChecksum(filepath.FromSlash(file))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		switch {
+		case err != nil:
+			changes = append(changes, fileChange{path: file, isNew: true})
+		case sum != remote.sums[file]:
+			changes = append(changes, fileChange{path: file})
+		default:
+			continue
+		}
+		files = append(files, remoteFile{name: file, size: remote.sums[file].size})
+	}
+	if err := downloadTree(conn, sf, workDir, files, ".", timeout); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// checksum identifies the contents of a file, as computed by POSIX cksum.
+type checksum struct {
+	crc  uint32
+	size int64
+}
+
+type checksums struct {
+	names []string // in the order of find
+	sums  map[string]checksum
+}
+
+// remoteChecksums returns the checksums of the regular files below paths in
+// remote directory dir, keyed by slash-separated path relative to dir. It uses
+// cksum, the only checksum utility mandated by POSIX.
+func remoteChecksums(conn *ssh.Client, dir string, paths []string) (checksums, error) {
+	sums := checksums{sums: map[string]checksum{}}
+	var quoted []string
+	for _, p := range paths {
+		quoted = append(quoted, shellQuote("./"+path.Clean(filepath.ToSlash(p))))
+	}
+	cmd := fmt.Sprintf(
+		`cd %s && for p in %s; do if [ -e "$p" ]; then find "$p" -type f -exec cksum {} +; fi; done`,
+		shellQuote(dir), strings.Join(quoted, " "))
+
+	sess, err := conn.NewSession()
+	if err != nil {
+		return sums, fmt.Errorf("sync-back: %s", err)
+	}
+	defer sess.Close()
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	out, err := sess.Output(cmd)
+	if err != nil {
+		return sums, fmt.Errorf("sync-back: %s: %s: %s", cmd, err,
+			bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// crc size name
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return sums, fmt.Errorf("sync-back: cksum: unexpected output: %q", scanner.Text())
+		}
+		crc, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return sums, fmt.Errorf("sync-back: cksum: %s", err)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return sums, fmt.Errorf("sync-back: cksum: %s", err)
+		}
+		name := strings.TrimPrefix(fields[2], "./")
+		if _, ok := sums.sums[name]; !ok {
+			sums.names = append(sums.names, name)
+		}
+		sums.sums[name] = checksum{crc: uint32(crc), size: size}
+	}
+	return sums, nil
+}
+
+// localChecksum returns the POSIX cksum of the file at path on the host.
+func localChecksum(path string) (checksum, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return checksum{}, err
+	}
+	defer fd.Close()
+	return cksum(bufio.NewReader(fd))
+}
+
+// cksumTable is the table of the CRC-32 of POSIX cksum: polynomial 0x04C11DB7,
+// most significant bit first (unlike hash/crc32).
+var cksumTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// cksum computes the checksum of r as the POSIX cksum utility: the CRC of the
+// data followed by its length, least significant byte first and without
+// trailing zero bytes.
+func cksum(r io.ByteReader) (checksum, error) {
+	var crc uint32
+	var size int64
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return checksum{}, err
+		}
+		crc = crc<<8 ^ cksumTable[byte(crc>>24)^c]
+		size++
+	}
+	for n := size; n > 0; n >>= 8 {
+		crc = crc<<8 ^ cksumTable[byte(crc>>24)^byte(n)]
+	}
+	return checksum{crc: ^crc, size: size}, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestCksum(t *testing.T) {
+	// Expected values computed with the cksum utility.
+	testCases := []struct {
+		name string
+		data string
+		want checksum
+	}{
+		{name: "empty", data: "", want: checksum{crc: 4294967295, size: 0}},
+		{name: "one byte", data: "a", want: checksum{crc: 1220704766, size: 1}},
+		{name: "text", data: "hello world", want: checksum{crc: 1135714720, size: 11}},
+		{name: "size on two bytes", data: strings.Repeat("x", 300),
+			want: checksum{crc: 3786917833, size: 300}},
+		{name: "size on three bytes", data: strings.Repeat("\x00", 70000),
+			want: checksum{crc: 1774371287, size: 70000}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			have, err := cksum(bytes.NewReader([]byte(tc.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != tc.want {
+				t.Errorf("have: %+v; want: %+v", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckSyncBackPaths(t *testing.T) {
+	testCases := []struct {
+		paths   []string
+		wantErr string
+	}{
+		{paths: []string{"testdata", "testdata/golden/", "a/../b"}},
+		{
+			paths:   []string{"testdata", "../other"},
+			wantErr: "sync-back ../other: must be a relative path within the package directory",
+		},
+		{
+			paths:   []string{"/etc"},
+			wantErr: "sync-back /etc: must be a relative path within the package directory",
+		},
+		{
+			paths:   []string{"."},
+			wantErr: "sync-back .: contains files written by xprog on the target (test binary, pid file, output)",
+		},
+		{
+			paths:   []string{"testdata/.."},
+			wantErr: "sync-back testdata/..: contains files written by xprog on the target (test binary, pid file, output)",
+		},
+		{
+			paths:   []string{"./foo.test.pid"},
+			wantErr: "sync-back ./foo.test.pid: contains files written by xprog on the target (test binary, pid file, output)",
+		},
+		{
+			paths:   []string{"output/cpu.out"},
+			wantErr: "sync-back output/cpu.out: contains files written by xprog on the target (test binary, pid file, output)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.paths, ","), func(t *testing.T) {
+			err := checkSyncBackPaths(tc.paths, "/tmp/go-build1/b001/foo.test")
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			want := tc.wantErr
+			if want == "" {
+				want = "<no error>"
+			}
+			if have != want {
+				t.Fatalf("error: have: %s; want: %s", have, want)
+			}
+		})
+	}
+}
+
+func TestSshCmdRunSyncBack(t *testing.T) {
+	sshConfig, _ := startShellServer(t)
+	// Behaves as a test run with -update.
+	testBinary := writeTestBinary(t, `
+echo new > testdata/golden.txt
+echo added > testdata/sub/added.txt
+echo ignored > other.txt
+rm testdata/deleted.txt
+`)
+	pkgDir := t.TempDir()
+	writeFiles(t, pkgDir, map[string]string{
+		"testdata/golden.txt":  "old\n",
+		"testdata/same.txt":    "same\n",
+		"testdata/deleted.txt": "deleted\n",
+		"testdata/sub/x.txt":   "x\n",
+	})
+	chdir(t, pkgDir)
+
+	sut := SshCmd{
+		CommonArgs: CommonArgs{TestBinary: testBinary},
+		SshConfig:  sshConfig,
+		SyncBack:   []string{"testdata", "nonexisting"},
+		opts:       Opts{logger: hclog.NewNullLogger()},
+	}
+	if err := sut.Run(sut.opts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"testdata/golden.txt":    "new\n",
+		"testdata/same.txt":      "same\n",
+		"testdata/deleted.txt":   "deleted\n",
+		"testdata/sub/x.txt":     "x\n",
+		"testdata/sub/added.txt": "added\n",
+	}
+	if diff := cmp.Diff(readFiles(t, "."), want); diff != "" {
+		t.Errorf("\nfiles mismatch (-have, +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+)
+
+// Maximum number of hosts traversed to reach a target, to detect loops of
+// ProxyJump.
+const maxJumps = 16
+
+// sshTarget is a SSH host, with the settings resolved from the ssh_config file,
+// ready to be dialed, directly or via ProxyJump or ProxyCommand.
+type sshTarget struct {
+	alias        string
+	addr         string // HostName:Port
+	cfg          ssh.ClientConfig
+	auth         *sshAuth
+	proxyJump    []jumpHost
+	proxyCommand string
+	mux          *muxConfig // nil without ControlPath
+	hostKey      string     // SHA256 fingerprint, once dialed; empty if unknown
+	//
+	sshConf *SshConfig // to resolve the jump hosts
+	log     hclog.Logger
+	closers []io.Closer // jump hosts, in dial order
+}
+
+// jumpHost is an element of ProxyJump: [user@]host[:port]. Empty user and port
+// mean the values of the ssh_config file.
+type jumpHost struct {
+	user  string
+	alias string
+	port  string
+}
+
+// newSshTarget resolves the settings of dest from sshConf. Call Close when
+// done.
+func newSshTarget(sshConf *SshConfig, dest jumpHost, log hclog.Logger) (*sshTarget, error) {
+	host, err := sshConf.Resolve(dest.alias)
+	if err != nil {
+		return nil, err
+	}
+	if dest.user != "" {
+		host["user"] = []string{dest.user}
+	}
+	if dest.port != "" {
+		host["port"] = []string{dest.port}
+	}
+
+	user, err := host.Get("User")
+	if err != nil {
+		return nil, err
+	}
+	hostName, err := host.Get("HostName")
+	if err != nil {
+		return nil, err
+	}
+	port, err := host.Get("Port")
+	if err != nil {
+		return nil, err
+	}
+
+	self := &sshTarget{
+		alias:   dest.alias,
+		addr:    net.JoinHostPort(hostName, port),
+		sshConf: sshConf,
+		log:     log.With("host", dest.alias),
+	}
+
+	if jump := host.GetDef("ProxyJump", "none"); jump != "none" {
+		if self.proxyJump, err = parseProxyJump(jump); err != nil {
+			return nil, err
+		}
+	}
+	if command := host.GetDef("ProxyCommand", "none"); command != "none" {
+		self.proxyCommand = command
+	}
+
+	if self.mux, err = newMuxConfig(host); err != nil {
+		return nil, err
+	}
+
+	hostKeys, err := newHostKeyChecker(host, self.log)
+	if err != nil {
+		return nil, err
+	}
+
+	self.auth, err = newSshAuth(host, self.log)
+	if err != nil {
+		return nil, err
+	}
+
+	// As OpenSSH, ConnectTimeout is in seconds.
+	timeout := defaultConnectTimeout
+	if val := host.GetDef("ConnectTimeout", "none"); val != "none" {
+		secs, err := strconv.Atoi(val)
+		if err != nil || secs <= 0 {
+			return nil, fmt.Errorf("ssh_config: ConnectTimeout %s: want seconds", val)
+		}
+		timeout = time.Duration(secs) * time.Second
+	}
+
+	self.cfg = ssh.ClientConfig{
+		Timeout:           timeout,
+		User:              user,
+		Auth:              self.auth.Methods(),
+		HostKeyCallback:   self.recordHostKey(hostKeys.Check),
+		HostKeyAlgorithms: hostKeys.Algorithms(self.addr),
+	}
+
+	return self, nil
+}
+
+// parseProxyJump parses the value of ProxyJump: a comma-separated list of
+// [user@]host[:port] or ssh://[user@]host[:port].
+func parseProxyJump(val string) ([]jumpHost, error) {
+	var hops []jumpHost
+	for _, elem := range strings.Split(val, ",") {
+		var hop jumpHost
+		if strings.HasPrefix(elem, "ssh://") {
+			u, err := url.Parse(elem)
+			if err != nil {
+				return nil, fmt.Errorf("ProxyJump %s: %s", val, err)
+			}
+			hop.user = u.User.Username()
+			hop.alias = u.Hostname()
+			hop.port = u.Port()
+		} else {
+			if at := strings.LastIndexByte(elem, '@'); at != -1 {
+				hop.user, elem = elem[:at], elem[at+1:]
+			}
+			hop.alias = elem
+			if host, port, err := net.SplitHostPort(elem); err == nil {
+				hop.alias, hop.port = host, port
+			}
+		}
+		if hop.alias == "" {
+			return nil, fmt.Errorf("ProxyJump %s: missing host", val)
+		}
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// recordHostKey returns check, recording the fingerprint of the accepted host
+// key.
+func (self *sshTarget) recordHostKey(check ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := check(hostname, remote, key); err != nil {
+			return err
+		}
+		self.hostKey = ssh.FingerprintSHA256(key)
+		return nil
+	}
+}
+
+// Dial connects to the target, through the jump hosts if any, or through the
+// multiplexing daemon if ControlPath is set.
+func (self *sshTarget) Dial() (*ssh.Client, error) {
+	if self.mux != nil {
+		return self.dialMux()
+	}
+	return self.dial(0)
+}
+
+func (self *sshTarget) dial(depth int) (*ssh.Client, error) {
+	if depth > maxJumps {
+		return nil, errors.New("too many jump hosts (ProxyJump loop?)")
+	}
+
+	switch {
+	case len(self.proxyJump) > 0:
+		// As OpenSSH, the first jump host is reached with its own proxy
+		// settings, the following ones through the previous hop.
+		var client *ssh.Client
+		for i, hop := range self.proxyJump {
+			jump, err := newSshTarget(self.sshConf, hop, self.log)
+			if err != nil {
+				return nil, fmt.Errorf("jump host %s: %s", hop.alias, err)
+			}
+			self.closers = append(self.closers, jump)
+			if i == 0 {
+				client, err = jump.dial(depth + len(self.proxyJump))
+			} else {
+				client, err = jump.dialVia(client)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("jump host %s: %s", hop.alias, err)
+			}
+			self.closers = append(self.closers, client)
+		}
+		return self.dialVia(client)
+
+	case self.proxyCommand != "":
+		self.log.Debug("ProxyCommand", "command", self.proxyCommand)
+		conn, err := newProxyCommandConn(self.proxyCommand)
+		if err != nil {
+			return nil, fmt.Errorf("ProxyCommand: %s", err)
+		}
+		return self.handshake(conn)
+
+	default:
+		self.log.Debug("ssh.Dial", "addr", self.addr)
+		return ssh.Dial("tcp", self.addr, &self.cfg)
+	}
+}
+
+// dialVia connects to the target through the jump host client.
+func (self *sshTarget) dialVia(client *ssh.Client) (*ssh.Client, error) {
+	self.log.Debug("ssh.Dial via jump host", "addr", self.addr)
+	conn, err := client.Dial("tcp", self.addr)
+	if err != nil {
+		return nil, err
+	}
+	return self.handshake(conn)
+}
+
+func (self *sshTarget) handshake(conn net.Conn) (*ssh.Client, error) {
+	// As ssh.Dial, bound the handshake by the connect timeout.
+	if self.cfg.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(self.cfg.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, self.addr, &self.cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// Close closes the connections to the jump hosts and the ssh-agent.
+func (self *sshTarget) Close() error {
+	for i := len(self.closers) - 1; i >= 0; i-- {
+		self.closers[i].Close()
+	}
+	self.closers = nil
+	return self.auth.Close()
+}
+
+// proxyCommandConn is a net.Conn over the stdin and stdout of a ProxyCommand.
+type proxyCommandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	//
+	closeOnce sync.Once
+	mu        sync.Mutex
+	deadline  *time.Timer
+	expired   bool
+}
+
+func newProxyCommandConn(command string) (*proxyCommandConn, error) {
+	// As OpenSSH, exec, so that killing the shell kills the command.
+	cmd := exec.Command("/bin/sh", "-c", "exec "+command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &proxyCommandConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+func (self *proxyCommandConn) Read(b []byte) (int, error) {
+	n, err := self.stdout.Read(b)
+	return n, self.deadlineError(err)
+}
+
+func (self *proxyCommandConn) Write(b []byte) (int, error) {
+	n, err := self.stdin.Write(b)
+	return n, self.deadlineError(err)
+}
+
+// deadlineError returns os.ErrDeadlineExceeded instead of err if the
+// connection was closed by the deadline.
+func (self *proxyCommandConn) deadlineError(err error) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if err != nil && self.expired {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+func (self *proxyCommandConn) Close() error {
+	self.closeOnce.Do(func() {
+		self.stdin.Close()
+		self.cmd.Process.Kill()
+		self.cmd.Wait()
+	})
+	return nil
+}
+
+func (self *proxyCommandConn) LocalAddr() net.Addr  { return proxyCommandAddr{} }
+func (self *proxyCommandConn) RemoteAddr() net.Addr { return proxyCommandAddr{} }
+
+// SetDeadline closes the connection, killing the command, at t, since pipes
+// have no deadline. A zero t cancels it.
+func (self *proxyCommandConn) SetDeadline(t time.Time) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.deadline != nil {
+		self.deadline.Stop()
+		self.deadline = nil
+	}
+	if !t.IsZero() {
+		self.deadline = time.AfterFunc(time.Until(t), func() {
+			self.mu.Lock()
+			self.expired = true
+			self.mu.Unlock()
+			self.Close()
+		})
+	}
+	return nil
+}
+
+func (self *proxyCommandConn) SetReadDeadline(t time.Time) error  { return self.SetDeadline(t) }
+func (self *proxyCommandConn) SetWriteDeadline(t time.Time) error { return self.SetDeadline(t) }
+
+type proxyCommandAddr struct{}
+
+func (proxyCommandAddr) Network() string { return "proxycommand" }
+func (proxyCommandAddr) String() string  { return "proxycommand" }
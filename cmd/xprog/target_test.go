@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gliderssh "github.com/gliderlabs/ssh"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+)
+
+// testServer is a SSH server on localhost that answers each command with its
+// name and the command and that allows port forwarding, to act as jump host.
+type testServer struct {
+	name string
+	port string
+	//
+	mu        sync.Mutex
+	forwarded []string // destinations of port forwarding
+}
+
+func startTestServer(t *testing.T, name string) *testServer {
+	t.Helper()
+	self := &testServer{name: name}
+	server := &gliderssh.Server{
+		Handler: func(sess gliderssh.Session) {
+			fmt.Fprintf(sess, "%s: %s", self.name, sess.RawCommand())
+		},
+		PublicKeyHandler: func(ctx gliderssh.Context, key gliderssh.PublicKey) bool {
+			return true
+		},
+		LocalPortForwardingCallback: func(ctx gliderssh.Context, host string, port uint32) bool {
+			self.mu.Lock()
+			defer self.mu.Unlock()
+			self.forwarded = append(self.forwarded, fmt.Sprintf("%s:%d", host, port))
+			return true
+		},
+		ChannelHandlers: map[string]gliderssh.ChannelHandler{
+			"session":      gliderssh.DefaultSessionHandler,
+			"direct-tcpip": gliderssh.DirectTCPIPHandler,
+		},
+	}
+	if err := gliderssh.HostKeyFile("../../testdata/host_key")(server); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, self.port, _ = net.SplitHostPort(listener.Addr().String())
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return self
+}
+
+func (self *testServer) Reset() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.forwarded = nil
+}
+
+func (self *testServer) Forwarded() []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.forwarded
+}
+
+// writeTestSshConfig writes a ssh_config file with contents followed by the
+// settings to authenticate to a testServer and returns its path.
+func writeTestSshConfig(t *testing.T, contents string) string {
+	t.Helper()
+	keyPath, err := filepath.Abs("../../testdata/client_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents += fmt.Sprintf(`
+Host *
+  HostName 127.0.0.1
+  User tester
+  StrictHostKeyChecking no
+  UserKnownHostsFile /dev/null
+  IdentityAgent none
+  IdentityFile %s
+`, keyPath)
+	path := filepath.Join(t.TempDir(), "ssh_config")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSshTargetDial(t *testing.T) {
+	target := startTestServer(t, "target")
+	bastion1 := startTestServer(t, "bastion1")
+	bastion2 := startTestServer(t, "bastion2")
+	t.Setenv("XPROG_TEST_PROXY_COMMAND", "1")
+
+	targetAddr := "127.0.0.1:" + target.port
+	testCases := []struct {
+		name          string
+		contents      string
+		wantForwarded [][]string // for bastion1, bastion2
+	}{
+		{
+			name: "direct",
+			contents: fmt.Sprintf(`
+Host target
+  Port %s
+`, target.port),
+			wantForwarded: [][]string{nil, nil},
+		},
+		{
+			name: "one jump host",
+			contents: fmt.Sprintf(`
+Host target
+  Port %s
+  ProxyJump bastion1
+Host bastion1
+  Port %s
+`, target.port, bastion1.port),
+			wantForwarded: [][]string{{targetAddr}, nil},
+		},
+		{
+			name: "chain of jump hosts, user and port overrides",
+			contents: fmt.Sprintf(`
+Host target
+  Port %s
+  ProxyJump bastion1,someone@bastion2:%s
+Host bastion1
+  Port %s
+`, target.port, bastion2.port, bastion1.port),
+			wantForwarded: [][]string{
+				{"127.0.0.1:" + bastion2.port},
+				{targetAddr},
+			},
+		},
+		{
+			name: "first jump host with its own ProxyJump",
+			contents: fmt.Sprintf(`
+Host target
+  Port %s
+  ProxyJump bastion2
+Host bastion2
+  Port %s
+  ProxyJump bastion1
+Host bastion1
+  Port %s
+`, target.port, bastion2.port, bastion1.port),
+			wantForwarded: [][]string{
+				{"127.0.0.1:" + bastion2.port},
+				{targetAddr},
+			},
+		},
+		{
+			name: "ProxyCommand",
+			contents: fmt.Sprintf(`
+Host target
+  Port %s
+  ProxyCommand %s -test.run=TestHelperProxyCommand -- %%h %%p
+`, target.port, os.Args[0]),
+			wantForwarded: [][]string{nil, nil},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bastion1.Reset()
+			bastion2.Reset()
+			sshConf, err := loadSshConfig(writeTestSshConfig(t, tc.contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sut, err := newSshTarget(sshConf, jumpHost{alias: "target"},
+				hclog.NewNullLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sut.Close()
+
+			client, err := sut.Dial()
+			if err != nil {
+				t.Fatalf("dial: %s", err)
+			}
+			defer client.Close()
+			sess, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := sess.Output("hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have, want := string(out), "target: hello"; have != want {
+				t.Errorf("output: have: %q; want: %q", have, want)
+			}
+			have := [][]string{bastion1.Forwarded(), bastion2.Forwarded()}
+			if diff := cmp.Diff(have, tc.wantForwarded); diff != "" {
+				t.Errorf("\nforwarded mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestHelperProxyCommand is not a real test: it is the ProxyCommand of
+// TestSshTargetDial, connecting stdin and stdout to host:port.
+func TestHelperProxyCommand(t *testing.T) {
+	if os.Getenv("XPROG_TEST_PROXY_COMMAND") != "1" {
+		t.Skip("helper process")
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: -- host port")
+		os.Exit(2)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(args[1], args[2]))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	go io.Copy(conn, os.Stdin)
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestSshTargetProxyCommandTimeout(t *testing.T) {
+	// A ProxyCommand that never answers.
+	path := writeTestSshConfig(t, `
+Host target
+  ConnectTimeout 1
+  ProxyCommand sleep 60
+`)
+	sshConf, err := loadSshConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sut, err := newSshTarget(sshConf, jumpHost{alias: "target"}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sut.Close()
+
+	start := time.Now()
+	_, err = sut.Dial()
+	elapsed := time.Since(start)
+
+	if err == nil || !strings.Contains(err.Error(), "i/o timeout") {
+		t.Fatalf("error: have: %v; want: i/o timeout", err)
+	}
+	if elapsed > 10*time.Second {
+		t.Errorf("elapsed: have: %s; want: about 1s", elapsed)
+	}
+}
+
+func TestParseProxyJump(t *testing.T) {
+	testCases := []struct {
+		val      string
+		wantHops []jumpHost
+		wantErr  string
+	}{
+		{
+			val:      "a",
+			wantHops: []jumpHost{{alias: "a"}},
+		},
+		{
+			val: "bob@a:2222,b,ssh://alice@c:23",
+			wantHops: []jumpHost{
+				{user: "bob", alias: "a", port: "2222"},
+				{alias: "b"},
+				{user: "alice", alias: "c", port: "23"},
+			},
+		},
+		{
+			val:      "[::1]:2222",
+			wantHops: []jumpHost{{alias: "::1", port: "2222"}},
+		},
+		{
+			val:     "a,,b",
+			wantErr: "ProxyJump a,,b: missing host",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.val, func(t *testing.T) {
+			hops, err := parseProxyJump(tc.val)
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			want := tc.wantErr
+			if want == "" {
+				want = "<no error>"
+			}
+			if have != want {
+				t.Fatalf("error: have: %s; want: %s", have, want)
+			}
+			if diff := cmp.Diff(hops, tc.wantHops,
+				cmp.AllowUnexported(jumpHost{})); diff != "" {
+				t.Errorf("\nhops mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSshTargetProxyJumpLoop(t *testing.T) {
+	path := writeTestSshConfig(t, `
+Host a
+  ProxyJump b
+Host b
+  ProxyJump a
+`)
+	sshConf, err := loadSshConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sut, err := newSshTarget(sshConf, jumpHost{alias: "a"}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sut.Close()
+
+	_, err = sut.Dial()
+
+	if err == nil || !strings.Contains(err.Error(), "too many jump hosts") {
+		t.Fatalf("error: have: %v; want: too many jump hosts", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// testFlagDefs are the flags of a test binary, as defined by the testing
+// package, without the "test." prefix. The value tells if it is a boolean flag,
+// that does not take the next argument as value.
+var testFlagDefs = map[string]bool{
+	"artifacts":            true,
+	"bench":                false,
+	"benchmem":             true,
+	"benchtime":            false,
+	"blockprofile":         false,
+	"blockprofilerate":     false,
+	"count":                false,
+	"coverprofile":         false,
+	"cpu":                  false,
+	"cpuprofile":           false,
+	"failfast":             true,
+	"fullpath":             true,
+	"fuzz":                 false,
+	"fuzzcachedir":         false,
+	"fuzzminimizetime":     false,
+	"fuzztime":             false,
+	"fuzzworker":           true,
+	"gocoverdir":           false,
+	"list":                 false,
+	"memprofile":           false,
+	"memprofilerate":       false,
+	"mutexprofile":         false,
+	"mutexprofilefraction": false,
+	"outputdir":            false,
+	"paniconexit0":         true,
+	"parallel":             false,
+	"run":                  false,
+	"short":                true,
+	"shuffle":              false,
+	"skip":                 false,
+	"testlogfile":          false,
+	"timeout":              false,
+	"trace":                false,
+	"v":                    true,
+}
+
+// testFlags are the arguments of the test binary, parsed as the flag package
+// would: "-flag=value", "-flag value" (not for boolean flags), "--flag" as
+// "-flag", up to "--" or the first non-flag argument. Unknown flags, such as
+// the ones defined by the tests themselves, are kept verbatim; since their
+// type is unknown, an unknown flag without "=value" stops the parsing, as the
+// next argument could be its value.
+type testFlags struct {
+	args []testArg
+}
+
+// testArg is a flag of the test binary or, if name is empty, arguments kept
+// verbatim.
+type testArg struct {
+	name    string // without the "test." prefix
+	value   string
+	changed bool     // by Rewrite: raw is obsolete
+	raw     []string // as received
+}
+
+func parseTestFlags(args []string) *testFlags {
+	self := &testFlags{}
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		name := strings.TrimPrefix(arg[1:], "-")
+		name, value, hasValue := strings.Cut(name, "=")
+		name, prefixed := strings.CutPrefix(name, "test.")
+		isBool, known := testFlagDefs[name]
+		known = known && prefixed
+		switch {
+		case !known && !hasValue:
+			self.args = append(self.args, testArg{raw: args})
+			return self
+		case !known:
+			self.args = append(self.args, testArg{raw: args[:1]})
+			args = args[1:]
+		case hasValue:
+			self.args = append(self.args, testArg{name: name, value: value, raw: args[:1]})
+			args = args[1:]
+		case isBool:
+			self.args = append(self.args, testArg{name: name, value: "true", raw: args[:1]})
+			args = args[1:]
+		case len(args) == 1:
+			// Missing value: the test binary will complain.
+			self.args = append(self.args, testArg{raw: args})
+			return self
+		default:
+			self.args = append(self.args, testArg{name: name, value: args[1], raw: args[:2]})
+			args = args[2:]
+		}
+	}
+	if len(args) > 0 {
+		self.args = append(self.args, testArg{raw: args})
+	}
+	return self
+}
+
+// Lookup returns the value of flag name (without the "test." prefix) and
+// whether it is present. As with the flag package, the last occurrence wins.
+// A boolean flag without value has value "true".
+func (self *testFlags) Lookup(name string) (string, bool) {
+	var value string
+	var found bool
+	for _, arg := range self.args {
+		if arg.name == name {
+			value, found = arg.value, true
+		}
+	}
+	return value, found
+}
+
+// Bool returns the value of boolean flag name, false if absent. For -test.v,
+// "test2json" is true.
+func (self *testFlags) Bool(name string) bool {
+	value, _ := self.Lookup(name)
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return name == "v" && value == "test2json"
+	}
+	return b
+}
+
+// Int returns the value of integer flag name, def if absent or invalid.
+func (self *testFlags) Int(name string, def int) int {
+	value, _ := self.Lookup(name)
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// Duration returns the value of duration flag name, def if absent or invalid.
+func (self *testFlags) Duration(name string, def time.Duration) time.Duration {
+	value, _ := self.Lookup(name)
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// Rewrite replaces the value of each occurrence of flag name with the result
+// of fn applied to it.
+func (self *testFlags) Rewrite(name string, fn func(value string) string) {
+	for i := range self.args {
+		if arg := &self.args[i]; arg.name == name {
+			arg.value = fn(arg.value)
+			arg.changed = true
+		}
+	}
+}
+
+// Args returns the arguments for the test binary: as received, except the
+// flags changed by Rewrite, in the form "-test.name=value".
+func (self *testFlags) Args() []string {
+	args := []string{}
+	for _, arg := range self.args {
+		if arg.changed {
+			args = append(args, "-test."+arg.name+"="+arg.value)
+			continue
+		}
+		args = append(args, arg.raw...)
+	}
+	return args
+}
+
+// logTestFlags logs the flags of the test binary that matter to xprog.
+func logTestFlags(log hclog.Logger, flags *testFlags) {
+	run, _ := flags.Lookup("run")
+	log.Debug("test flags", "run", run,
+		"timeout", flags.Duration("timeout", 0),
+		"v", flags.Bool("v"),
+		"count", flags.Int("count", 1),
+		"paniconexit0", flags.Bool("paniconexit0"))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParseTestFlags(t *testing.T) {
+	type values struct {
+		Run          string
+		Timeout      time.Duration
+		Verbose      bool
+		Count        int
+		PanicOnExit0 bool
+		Coverprofile string
+	}
+	testCases := []struct {
+		name string
+		args []string
+		want values
+	}{
+		{
+			name: "empty",
+			want: values{Count: 1},
+		},
+		{
+			name: "as passed by go test",
+			args: []string{"-test.paniconexit0", "-test.timeout=10m0s",
+				"-test.v=true", "-test.count=3", "-test.run=^TestFoo$",
+				"-test.coverprofile=/tmp/go-build1/b001/_cover_.out"},
+			want: values{
+				Run:          "^TestFoo$",
+				Timeout:      10 * time.Minute,
+				Verbose:      true,
+				Count:        3,
+				PanicOnExit0: true,
+				Coverprofile: "/tmp/go-build1/b001/_cover_.out",
+			},
+		},
+		{
+			name: "space form and double dash",
+			args: []string{"--test.run", "TestFoo/with space", "-test.timeout", "5s",
+				"--test.v", "-test.coverprofile", "a=b.out"},
+			want: values{
+				Run:          "TestFoo/with space",
+				Timeout:      5 * time.Second,
+				Verbose:      true,
+				Count:        1,
+				Coverprofile: "a=b.out",
+			},
+		},
+		{
+			name: "boolean flags do not take the next argument",
+			args: []string{"-test.v", "-test.paniconexit0", "-test.run=X"},
+			want: values{Run: "X", Verbose: true, PanicOnExit0: true, Count: 1},
+		},
+		{
+			name: "explicit false and test2json",
+			args: []string{"-test.paniconexit0=false", "-test.v=test2json"},
+			want: values{Verbose: true, Count: 1},
+		},
+		{
+			name: "last occurrence wins",
+			args: []string{"-test.run=A", "-test.count=2", "-test.run", "B"},
+			want: values{Run: "B", Count: 2},
+		},
+		{
+			name: "unknown flag with value is skipped",
+			args: []string{"-myflag=1", "-test.run=A"},
+			want: values{Run: "A", Count: 1},
+		},
+		{
+			name: "unknown flag without value stops parsing",
+			args: []string{"-myflag", "-test.run=A"},
+			want: values{Count: 1},
+		},
+		{
+			name: "double dash stops parsing",
+			args: []string{"-test.v", "--", "-test.run=A"},
+			want: values{Verbose: true, Count: 1},
+		},
+		{
+			name: "non-flag argument stops parsing",
+			args: []string{"-test.v", "arg", "-test.run=A"},
+			want: values{Verbose: true, Count: 1},
+		},
+		{
+			name: "flags without test prefix are not test flags",
+			args: []string{"-run=A", "-v"},
+			want: values{Count: 1},
+		},
+		{
+			name: "missing value",
+			args: []string{"-test.run"},
+			want: values{Count: 1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sut := parseTestFlags(tc.args)
+
+			run, _ := sut.Lookup("run")
+			coverprofile, _ := sut.Lookup("coverprofile")
+			have := values{
+				Run:          run,
+				Timeout:      sut.Duration("timeout", 0),
+				Verbose:      sut.Bool("v"),
+				Count:        sut.Int("count", 1),
+				PanicOnExit0: sut.Bool("paniconexit0"),
+				Coverprofile: coverprofile,
+			}
+			if diff := cmp.Diff(have, tc.want); diff != "" {
+				t.Errorf("\nvalues mismatch (-have, +want)\n%s", diff)
+			}
+			// Without Rewrite, the arguments are unchanged.
+			if diff := cmp.Diff(sut.Args(), tc.args, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("\nargs mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTestFlagsRewrite(t *testing.T) {
+	sut := parseTestFlags([]string{"-test.v", "-test.run", "A", "--test.run=B",
+		"-test.count", "2"})
+
+	sut.Rewrite("run", func(val string) string { return val + "x" })
+
+	want := []string{"-test.v", "-test.run=Ax", "-test.run=Bx", "-test.count", "2"}
+	if diff := cmp.Diff(sut.Args(), want); diff != "" {
+		t.Errorf("\nargs mismatch (-have, +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Time to establish the connection: TCP and SSH handshake. A target that is
+	// still booting can take a while.
+	defaultConnectTimeout = 10 * time.Second
+	// Base time of a transfer, to which the time at the minimum throughput is
+	// added.
+	defaultTransferTimeout = 10 * time.Second
+	defaultMinThroughput   = "256KiB"
+	// After the run timeout, time given to the test binary to exit on SIGQUIT,
+	// printing the goroutine dump.
+	runTimeoutGrace = 10 * time.Second
+)
+
+// byteUnits are the suffixes accepted by parseByteSize.
+var byteUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1000,
+	"KiB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1000 * 1000,
+	"MiB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1000 * 1000 * 1000,
+	"GiB": 1 << 30,
+}
+
+// parseByteSize parses a size such as 512KiB or 1MB. An optional "/s" suffix is
+// accepted, for throughputs.
+func parseByteSize(s string) (int64, error) {
+	str := strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	i := strings.IndexFunc(str, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i == -1 {
+		i = len(str)
+	}
+	unit, ok := byteUnits[strings.TrimSpace(str[i:])]
+	if !ok {
+		return 0, fmt.Errorf("size %q: unknown unit (want B, KiB, MiB, GiB, KB, MB, GB)", s)
+	}
+	num, err := strconv.ParseFloat(str[:i], 64)
+	if err != nil || num <= 0 {
+		return 0, fmt.Errorf("size %q: want a positive number with unit", s)
+	}
+	return int64(num * float64(unit)), nil
+}
+
+// formatByteSize formats n in binary units, for humans.
+func formatByteSize(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	val := float64(n) / unit
+	for _, suffix := range []string{"KiB", "MiB", "GiB"} {
+		if val < unit || suffix == "GiB" {
+			return fmt.Sprintf("%.1f%s", val, suffix)
+		}
+		val /= unit
+	}
+	panic("unreachable")
+}
+
+// transferTimeout returns the deadline of the transfer of size bytes: base plus
+// the time to transfer them at minThroughput bytes per second.
+func transferTimeout(base time.Duration, size int64, minThroughput int64) time.Duration {
+	return base + time.Duration(float64(size)/float64(minThroughput)*float64(time.Second))
+}
+
+// transferTimeout returns the deadline of the upload (or download) of size
+// bytes, according to the options.
+func (self SshCmd) transferTimeout(download bool, size int64) time.Duration {
+	base := self.UploadTimeout
+	if download {
+		base = self.DownloadTimeout
+	}
+	if base <= 0 {
+		base = defaultTransferTimeout
+	}
+	return transferTimeout(base, size, self.minThroughput)
+}
+
+// uploadDeadline returns the deadline of the upload of size bytes, as
+// transferTimeout.
+func (self SshCmd) uploadDeadline(size int64) time.Duration {
+	return self.transferTimeout(false, size)
+}
+
+// downloadDeadline returns the deadline of the download of size bytes, as
+// transferTimeout.
+func (self SshCmd) downloadDeadline(size int64) time.Duration {
+	return self.transferTimeout(true, size)
+}
+
+// checkTimeouts validates the timeout options and parses --min-throughput.
+func (self *SshCmd) checkTimeouts() error {
+	for _, opt := range []struct {
+		name string
+		val  time.Duration
+	}{
+		{"--connect-timeout", self.ConnectTimeout},
+		{"--upload-timeout", self.UploadTimeout},
+		{"--download-timeout", self.DownloadTimeout},
+		{"--run-timeout", self.RunTimeout},
+	} {
+		if opt.val < 0 {
+			return fmt.Errorf("%s %s: want a positive duration", opt.name, opt.val)
+		}
+	}
+	throughput := self.MinThroughput
+	if throughput == "" {
+		throughput = defaultMinThroughput
+	}
+	var err error
+	if self.minThroughput, err = parseByteSize(throughput); err != nil {
+		return fmt.Errorf("--min-throughput: %s", err)
+	}
+	return nil
+}
+
+// progress logs the progress of a transfer, at most once per second, in
+// verbose mode.
+type progress struct {
+	log   hclog.Logger
+	what  string
+	total int64
+	//
+	mu    sync.Mutex
+	done  int64
+	start time.Time
+	last  time.Time
+}
+
+// newProgress returns the scp PassThru of the transfer of what, nil if not in
+// verbose mode.
+func newProgress(log hclog.Logger, what string) func(io.Reader, int64) io.Reader {
+	if !log.IsDebug() {
+		return nil
+	}
+	return func(r io.Reader, total int64) io.Reader {
+		return newProgressReader(log, what, r, total)
+	}
+}
+
+// newProgressReader returns r, logging the progress of reading its total bytes
+// in verbose mode.
+func newProgressReader(log hclog.Logger, what string, r io.Reader, total int64) io.Reader {
+	if !log.IsDebug() {
+		return r
+	}
+	now := time.Now()
+	return &progressReader{r: r, p: &progress{
+		log: log, what: what, total: total, start: now, last: now,
+	}}
+}
+
+func (self *progress) add(n int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.done += int64(n)
+	now := time.Now()
+	if now.Sub(self.last) < time.Second && self.done < self.total {
+		return
+	}
+	self.last = now
+	elapsed := now.Sub(self.start)
+	rate := float64(self.done) / max(elapsed.Seconds(), 0.001)
+	var eta time.Duration
+	if rate > 0 {
+		eta = time.Duration(float64(self.total-self.done) / rate * float64(time.Second))
+	}
+	self.log.Debug("transfer progress", "what", self.what,
+		"bytes", formatByteSize(self.done), "total", formatByteSize(self.total),
+		"rate", formatByteSize(int64(rate))+"/s", "eta", eta.Round(time.Second))
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (self *progressReader) Read(buf []byte) (int, error) {
+	n, err := self.r.Read(buf)
+	self.p.add(n)
+	return n, err
+}
+
+// waitRun waits for the test binary started in sess to exit, for at most
+// --run-timeout. When it expires, the test binary receives SIGQUIT, so that it
+// prints the goroutine dump as on go test -timeout, and is given some time to
+// exit; if it does not, the session is closed.
+func (self SshCmd) waitRun(conn *ssh.Client, sess *ssh.Session, pidFile string) error {
+	log := self.opts.logger
+	waitCh := make(chan error, 1)
+	go func() { waitCh <- sess.Wait() }()
+	if self.RunTimeout <= 0 {
+		return remoteExitError(<-waitCh, self.addr)
+	}
+
+	timer := time.NewTimer(self.RunTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-waitCh:
+		return remoteExitError(err, self.addr)
+	case <-timer.C:
+	}
+
+	log.Warn("run timeout expired, sending SIGQUIT to test binary",
+		"timeout", self.RunTimeout, "target", self.addr)
+	if err := self.signalRemote(conn, pidFile, "QUIT"); err != nil {
+		log.Warn("sending signal", "signal", "QUIT", "err", err)
+	}
+	grace := time.NewTimer(runTimeoutGrace)
+	defer grace.Stop()
+	select {
+	case err := <-waitCh:
+		msg := fmt.Sprintf("run timeout %s expired", self.RunTimeout)
+		runErr := remoteExitError(err, self.addr)
+		if testErr, ok := runErr.(*testExitError); ok {
+			testErr.msg = msg + ": " + testErr.msg
+			return testErr
+		}
+		if runErr == nil {
+			return &testExitError{code: 1, msg: msg}
+		}
+		return runErr
+	case <-grace.C:
+		sess.Close()
+		return fmt.Errorf("sshRun: run timeout %s expired: test binary on %s still running %s after SIGQUIT",
+			self.RunTimeout, self.addr, runTimeoutGrace)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestParseByteSize(t *testing.T) {
+	testCases := []struct {
+		in      string
+		want    int64
+		wantErr string
+	}{
+		{in: "100", want: 100},
+		{in: "100B", want: 100},
+		{in: "256KiB", want: 256 << 10},
+		{in: "256K", want: 256 << 10},
+		{in: "1.5MiB", want: 3 << 19},
+		{in: "2MB/s", want: 2_000_000},
+		{in: "1GiB", want: 1 << 30},
+		{in: "1 KB", want: 1000},
+		{in: "", wantErr: `size "": want a positive number with unit`},
+		{in: "0KiB", wantErr: `size "0KiB": want a positive number with unit`},
+		{in: "MiB", wantErr: `size "MiB": want a positive number with unit`},
+		{in: "12mib", wantErr: `size "12mib": unknown unit (want B, KiB, MiB, GiB, KB, MB, GB)`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			have, err := parseByteSize(tc.in)
+
+			haveErr := "<no error>"
+			if err != nil {
+				haveErr = err.Error()
+			}
+			wantErr := tc.wantErr
+			if wantErr == "" {
+				wantErr = "<no error>"
+			}
+			if haveErr != wantErr {
+				t.Fatalf("error: have: %s; want: %s", haveErr, wantErr)
+			}
+			if have != tc.want {
+				t.Errorf("have: %d; want: %d", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatByteSize(t *testing.T) {
+	testCases := []struct {
+		in   int64
+		want string
+	}{
+		{in: 0, want: "0B"},
+		{in: 1023, want: "1023B"},
+		{in: 1536, want: "1.5KiB"},
+		{in: 50 << 20, want: "50.0MiB"},
+		{in: 3 << 40, want: "3072.0GiB"},
+	}
+
+	for _, tc := range testCases {
+		if have := formatByteSize(tc.in); have != tc.want {
+			t.Errorf("%d: have: %s; want: %s", tc.in, have, tc.want)
+		}
+	}
+}
+
+func TestSshCmdTransferTimeout(t *testing.T) {
+	testCases := []struct {
+		name     string
+		sut      SshCmd
+		download bool
+		size     int64
+		want     time.Duration
+	}{
+		{
+			name: "defaults",
+			size: 50 << 20,
+			want: 10*time.Second + 200*time.Second,
+		},
+		{
+			name: "upload",
+			sut:  SshCmd{UploadTimeout: time.Minute, DownloadTimeout: time.Hour},
+			size: 1 << 20,
+			want: time.Minute + 4*time.Second,
+		},
+		{
+			name:     "download",
+			sut:      SshCmd{UploadTimeout: time.Minute, DownloadTimeout: time.Hour},
+			download: true,
+			want:     time.Hour,
+		},
+		{
+			name: "min throughput",
+			sut:  SshCmd{MinThroughput: "1MiB"},
+			size: 50 << 20,
+			want: 10*time.Second + 50*time.Second,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.sut.checkTimeouts(); err != nil {
+				t.Fatal(err)
+			}
+
+			have := tc.sut.transferTimeout(tc.download, tc.size)
+
+			if have != tc.want {
+				t.Errorf("have: %s; want: %s", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestSshCmdCheckTimeouts(t *testing.T) {
+	testCases := []struct {
+		name    string
+		sut     SshCmd
+		wantErr string
+	}{
+		{
+			name:    "negative duration",
+			sut:     SshCmd{RunTimeout: -time.Second},
+			wantErr: "--run-timeout -1s: want a positive duration",
+		},
+		{
+			name:    "invalid throughput",
+			sut:     SshCmd{MinThroughput: "fast"},
+			wantErr: `--min-throughput: size "fast": unknown unit (want B, KiB, MiB, GiB, KB, MB, GB)`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.sut.checkTimeouts()
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			if have != tc.wantErr {
+				t.Errorf("error: have: %s; want: %s", have, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewSshTargetConnectTimeout(t *testing.T) {
+	testCases := []struct {
+		name    string
+		conf    string
+		want    time.Duration
+		wantErr string
+	}{
+		{
+			name: "default",
+			want: defaultConnectTimeout,
+		},
+		{
+			name: "from ssh_config",
+			conf: "  ConnectTimeout 60\n",
+			want: time.Minute,
+		},
+		{
+			name:    "invalid",
+			conf:    "  ConnectTimeout 1m\n",
+			wantErr: "ssh_config: ConnectTimeout 1m: want seconds",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestSshConfig(t, "Host target\n"+tc.conf)
+			sshConf, err := loadSshConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sut, err := newSshTarget(sshConf, jumpHost{alias: "target"},
+				hclog.NewNullLogger())
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			wantErr := tc.wantErr
+			if wantErr == "" {
+				wantErr = "<no error>"
+			}
+			if have != wantErr {
+				t.Fatalf("error: have: %s; want: %s", have, wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer sut.Close()
+			if have := sut.cfg.Timeout; have != tc.want {
+				t.Errorf("timeout: have: %s; want: %s", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestSshCmdRunTimeout(t *testing.T) {
+	sshConfig, _ := startShellServer(t)
+	testBinary := writeTestBinary(t, `
+trap 'echo goroutine dump >&2; exit 2' QUIT
+while true; do sleep 0.1; done
+`)
+	var stderr strings.Builder
+	sut := SshCmd{
+		CommonArgs: CommonArgs{TestBinary: testBinary},
+		SshConfig:  sshConfig,
+		RunTimeout: time.Second,
+		opts:       Opts{logger: hclog.NewNullLogger()},
+		stdout:     io.Discard,
+		stderr:     &stderr,
+	}
+
+	err := sut.Run(sut.opts)
+
+	var testErr *testExitError
+	if !errors.As(err, &testErr) {
+		t.Fatalf("error: have: %v; want: testExitError", err)
+	}
+	if have, want := testErr.code, 2; have != want {
+		t.Errorf("exit code: have: %d; want: %d", have, want)
+	}
+	if have, want := testErr.msg, "run timeout 1s expired: "; !strings.HasPrefix(have, want) {
+		t.Errorf("msg: have: %s; want prefix: %s", have, want)
+	}
+	if have, want := stderr.String(), "goroutine dump\n"; have != want {
+		t.Errorf("stderr: have: %q; want: %q", have, want)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// uploadPath is a local file or directory to upload, with dst its path relative
+// to the remote working directory (slash-separated).
+type uploadPath struct {
+	src string
+	dst string
+}
+
+// uploadPaths returns the paths to upload to the remote working directory: the
+// testdata directory of the package, if any, followed by extra. As go test runs
+// xprog in the package directory, relative paths are relative to it and keep
+// their position in the remote working directory; the other paths are placed
+// at the top of it.
+func uploadPaths(extra []string) ([]uploadPath, error) {
+	var paths []uploadPath
+	if fi, err := os.Stat("testdata"); err == nil && fi.IsDir() {
+		paths = append(paths, uploadPath{src: "testdata", dst: "testdata"})
+	}
+	for _, src := range extra {
+		if _, err := os.Lstat(src); err != nil {
+			return nil, fmt.Errorf("upload: %s", err)
+		}
+		dst := filepath.Base(src)
+		if filepath.IsLocal(src) {
+			dst = filepath.ToSlash(filepath.Clean(src))
+		}
+		paths = append(paths, uploadPath{src: src, dst: dst})
+	}
+	return paths, nil
+}
+
+// uploadTree copies paths to directory dir on the target, by extracting there a
+// tar archive, so that file modes and symlinks are preserved. It requires tar on
+// the target, unless sf is not nil: then it uses SFTP. The transfer must end in
+// the deadline returned by timeout for the total size of the files.
+func uploadTree(conn *ssh.Client, sf *sftpTransfer, dir string, paths []uploadPath,
+	timeout func(size int64) time.Duration) error {
+	size, err := uploadSize(paths)
+	if err != nil {
+		return fmt.Errorf("upload: %s", err)
+	}
+	deadline := timeout(size)
+	if sf != nil {
+		return sf.UploadTree(dir, paths, deadline)
+	}
+	sess, err := conn.NewSession()
+	if err != nil {
+		return fmt.Errorf("upload: %s", err)
+	}
+	defer sess.Close()
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("upload: %s", err)
+	}
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+
+	// -p: keep the file modes, ignoring the umask; -o: do not restore the
+	// owner, meaningless on the target.
+	cmd := "tar -x -p -o -f - -C " + shellQuote(dir)
+	if err := sess.Start(cmd); err != nil {
+		return fmt.Errorf("upload: %s: %s", cmd, err)
+	}
+	timer := time.AfterFunc(deadline, func() { sess.Close() })
+	tarErr := writeTar(stdin, paths)
+	stdin.Close()
+	waitErr := sess.Wait()
+	if !timer.Stop() {
+		return fmt.Errorf("upload: %s (%s): timeout %s expired", cmd,
+			formatByteSize(size), deadline)
+	}
+	if waitErr != nil {
+		return fmt.Errorf("upload: %s: %s: %s", cmd, waitErr, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if tarErr != nil {
+		return fmt.Errorf("upload: %s", tarErr)
+	}
+	return nil
+}
+
+// uploadSize returns the total size of the regular files of paths, walking
+// directories.
+func uploadSize(paths []uploadPath) (int64, error) {
+	var size int64
+	for _, up := range paths {
+		err := filepath.WalkDir(up.src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// writeTar writes to w a tar archive of paths, walking directories. Symlinks
+// are archived as such, not followed.
+func writeTar(w io.Writer, paths []uploadPath) error {
+	tw := tar.NewWriter(w)
+	for _, up := range paths {
+		err := filepath.WalkDir(up.src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(up.src, p)
+			if err != nil {
+				return err
+			}
+			return writeTarEntry(tw, p, path.Join(up.dst, filepath.ToSlash(rel)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, src string, name string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	var link string
+	switch mode := fi.Mode(); {
+	case mode&fs.ModeSymlink != 0:
+		if link, err = os.Readlink(src); err != nil {
+			return err
+		}
+	case mode.IsRegular(), mode.IsDir():
+	default:
+		return fmt.Errorf("%s: unsupported file type %s", src, mode.Type())
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	// The owner is not restored on the target.
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	fd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if _, err := io.Copy(tw, fd); err != nil {
+		return fmt.Errorf("%s: %s", src, err)
+	}
+	return nil
+}
+
+// remoteFile is a regular file on the target.
+type remoteFile struct {
+	name string // slash-separated, relative to a directory
+	size int64
+}
+
+// remoteFiles returns the regular files below directory dir on the target. A
+// missing dir has no files. It runs find and wc, unless sf is not nil: then it
+// uses SFTP.
+func remoteFiles(conn *ssh.Client, sf *sftpTransfer, dir string) ([]remoteFile, error) {
+	if sf != nil {
+		return sf.Files(dir)
+	}
+	sess, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	cmd := fmt.Sprintf("if [ -d %[1]s ]; then cd %[1]s && find . -type f -exec wc -c {} +; fi",
+		shellQuote(dir))
+	out, err := sess.Output(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", cmd, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return parseWcOutput(string(out))
+}
+
+// parseWcOutput parses the output of wc -c on the files found by find, as
+// "size ./name" lines. The lines of the totals, without "./", are skipped.
+func parseWcOutput(out string) ([]remoteFile, error) {
+	var files []remoteFile
+	for _, line := range strings.Split(out, "\n") {
+		sizeStr, name, _ := strings.Cut(strings.TrimLeft(line, " \t"), " ")
+		name, found := strings.CutPrefix(name, "./")
+		if !found {
+			continue
+		}
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("wc: unexpected output: %q", line)
+		}
+		files = append(files, remoteFile{name: name, size: size})
+	}
+	return files, nil
+}
+
+// localFiles returns the regular files below directory dir on the host, as
+// slash-separated paths relative to dir. A missing dir has no files.
+func localFiles(dir string) (map[string]bool, error) {
+	files := map[string]bool{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == dir {
+			return fs.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	return files, err
+}
+
+// downloadTree copies files, relative to directory remoteDir on the target, to
+// directory localDir on the host, at the same relative path. As uploadTree, it
+// transfers a tar archive, unless sf is not nil, in the deadline returned by
+// timeout for the total size of files.
+func downloadTree(conn *ssh.Client, sf *sftpTransfer, remoteDir string, files []remoteFile,
+	localDir string, timeout func(size int64) time.Duration) error {
+	if len(files) == 0 {
+		return nil
+	}
+	var size int64
+	for _, file := range files {
+		size += file.size
+	}
+	deadline := timeout(size)
+	if sf != nil {
+		return sf.DownloadTree(remoteDir, files, localDir, deadline)
+	}
+	sess, err := conn.NewSession()
+	if err != nil {
+		return fmt.Errorf("download: %s", err)
+	}
+	defer sess.Close()
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("download: %s", err)
+	}
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+
+	// The "./" prefix protects names starting with a dash.
+	args := []string{"tar", "-c", "-f", "-", "-C", remoteDir}
+	for _, file := range files {
+		args = append(args, "./"+file.name)
+	}
+	cmd := shellJoin(args)
+	if err := sess.Start(cmd); err != nil {
+		return fmt.Errorf("download: %s: %s", cmd, err)
+	}
+	timer := time.AfterFunc(deadline, func() { sess.Close() })
+	tarErr := readTar(stdout, localDir)
+	io.Copy(io.Discard, stdout)
+	waitErr := sess.Wait()
+	if !timer.Stop() {
+		return fmt.Errorf("download: %s (%s): timeout %s expired", cmd,
+			formatByteSize(size), deadline)
+	}
+	if waitErr != nil {
+		return fmt.Errorf("download: %s: %s: %s", cmd, waitErr, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if tarErr != nil {
+		return fmt.Errorf("download: %s", tarErr)
+	}
+	return nil
+}
+
+// downloadNew copies the files of remoteDir missing from localDir, as
+// downloadTree, and returns their names. Files present on both are left alone,
+// for directories whose files are named by content or are unique, such as the
+// fuzz cache.
+func downloadNew(conn *ssh.Client, sf *sftpTransfer, remoteDir, localDir string,
+	timeout func(size int64) time.Duration) ([]string, error) {
+	remote, err := remoteFiles(conn, sf, remoteDir)
+	if err != nil {
+		return nil, err
+	}
+	local, err := localFiles(localDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []remoteFile
+	var names []string
+	for _, file := range remote {
+		if !local[file.name] {
+			files = append(files, file)
+			names = append(names, file.name)
+		}
+	}
+	if err := downloadTree(conn, sf, remoteDir, files, localDir, timeout); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// readTar extracts the regular files of the tar archive r below directory dir,
+// creating the missing directories. Other entries are ignored.
+func readTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.FromSlash(path.Clean(hdr.Name))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("%s: path outside of destination", hdr.Name)
+		}
+		if err := checkNoSymlink(dir, name); err != nil {
+			return fmt.Errorf("%s: %s", hdr.Name, err)
+		}
+		dst := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		fd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+			hdr.FileInfo().Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fd, tr)
+		if closeErr := fd.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", dst, err)
+		}
+	}
+}
+
+// checkNoSymlink verifies that no element of the local path name, relative to
+// dir, is a symlink on the host: writing through it could overwrite a file
+// outside of dir.
+func checkNoSymlink(dir, name string) error {
+	p := dir
+	for _, elem := range strings.Split(name, string(filepath.Separator)) {
+		p = filepath.Join(p, elem)
+		info, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			rel, _ := filepath.Rel(dir, p)
+			return fmt.Errorf("%s is a symlink on host, not writing through it",
+				filepath.ToSlash(rel))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestUploadPaths(t *testing.T) {
+	pkgDir := t.TempDir()
+	outside := t.TempDir()
+	for _, dir := range []string{"testdata", "extra/sub"} {
+		if err := os.MkdirAll(filepath.Join(pkgDir, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, pkgDir)
+
+	testCases := []struct {
+		name    string
+		extra   []string
+		want    []uploadPath
+		wantErr string
+	}{
+		{
+			name: "testdata only",
+			want: []uploadPath{{src: "testdata", dst: "testdata"}},
+		},
+		{
+			name:  "relative paths keep their position",
+			extra: []string{"extra/sub/", "./extra"},
+			want: []uploadPath{
+				{src: "testdata", dst: "testdata"},
+				{src: "extra/sub/", dst: "extra/sub"},
+				{src: "./extra", dst: "extra"},
+			},
+		},
+		{
+			name:  "other paths go to the top",
+			extra: []string{outside, "../" + filepath.Base(outside)},
+			want: []uploadPath{
+				{src: "testdata", dst: "testdata"},
+				{src: outside, dst: filepath.Base(outside)},
+				{src: "../" + filepath.Base(outside), dst: filepath.Base(outside)},
+			},
+		},
+		{
+			name:    "missing path",
+			extra:   []string{"nonexisting"},
+			wantErr: "upload: lstat nonexisting: no such file or directory",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			paths, err := uploadPaths(tc.extra)
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			want := tc.wantErr
+			if want == "" {
+				want = "<no error>"
+			}
+			if have != want {
+				t.Fatalf("error: have: %s; want: %s", have, want)
+			}
+			if diff := cmp.Diff(paths, tc.want,
+				cmp.AllowUnexported(uploadPath{})); diff != "" {
+				t.Errorf("\npaths mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "run.sh"), []byte("echo"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/run.sh", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	single := filepath.Join(t.TempDir(), "single.txt")
+	if err := os.WriteFile(single, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	paths := []uploadPath{
+		{src: dir, dst: "testdata"},
+		{src: single, dst: "single.txt"},
+	}
+
+	var buf bytes.Buffer
+	if err := writeTar(&buf, paths); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		Name     string
+		Mode     os.FileMode
+		Linkname string
+		Contents string
+	}
+	var have []entry
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have = append(have, entry{
+			Name:     hdr.Name,
+			Mode:     hdr.FileInfo().Mode(),
+			Linkname: hdr.Linkname,
+			Contents: string(contents),
+		})
+	}
+	want := []entry{
+		{Name: "testdata/", Mode: os.ModeDir | 0o700},
+		{Name: "testdata/link", Mode: os.ModeSymlink | 0o777, Linkname: "sub/run.sh"},
+		{Name: "testdata/sub/", Mode: os.ModeDir | 0o750},
+		{Name: "testdata/sub/run.sh", Mode: 0o755, Contents: "echo"},
+		{Name: "single.txt", Mode: 0o600, Contents: "hello"},
+	}
+	if diff := cmp.Diff(have, want); diff != "" {
+		t.Errorf("\ntar mismatch (-have, +want)\n%s", diff)
+	}
+}
+
+func TestReadTar(t *testing.T) {
+	testCases := []struct {
+		name      string
+		entries   []string
+		symlinks  map[string]string // on host, to the outside directory
+		wantFiles map[string]string
+		wantErr   string
+	}{
+		{
+			name:      "nested files",
+			entries:   []string{"./a/b/c.txt", "d.txt"},
+			wantFiles: map[string]string{"a/b/c.txt": "./a/b/c.txt", "d.txt": "d.txt"},
+		},
+		{
+			name:      "outside of destination",
+			entries:   []string{"../evil.txt"},
+			wantFiles: map[string]string{},
+			wantErr:   "../evil.txt: path outside of destination",
+		},
+		{
+			name:      "symlink at destination",
+			entries:   []string{"a.txt"},
+			symlinks:  map[string]string{"a.txt": "victim.txt"},
+			wantFiles: map[string]string{},
+			wantErr:   "a.txt: a.txt is a symlink on host, not writing through it",
+		},
+		{
+			name:      "symlink in the parents",
+			entries:   []string{"sub/victim.txt"},
+			symlinks:  map[string]string{"sub": "."},
+			wantFiles: map[string]string{},
+			wantErr:   "sub/victim.txt: sub is a symlink on host, not writing through it",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, name := range tc.entries {
+				hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(name)),
+					Typeflag: tar.TypeReg}
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tw.Write([]byte(name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			outside := t.TempDir()
+			writeFiles(t, outside, map[string]string{"victim.txt": "original"})
+			for link, target := range tc.symlinks {
+				err := os.Symlink(filepath.Join(outside, target), filepath.Join(dir, link))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := readTar(&buf, dir)
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			want := tc.wantErr
+			if want == "" {
+				want = "<no error>"
+			}
+			if have != want {
+				t.Fatalf("error: have: %s; want: %s", have, want)
+			}
+			if diff := cmp.Diff(readFiles(t, dir), tc.wantFiles); diff != "" {
+				t.Errorf("\nfiles mismatch (-have, +want)\n%s", diff)
+			}
+			wantOutside := map[string]string{"victim.txt": "original"}
+			if diff := cmp.Diff(readFiles(t, outside), wantOutside); diff != "" {
+				t.Errorf("\noutside files mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUploadSize(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"testdata/a.txt":     "hello",
+		"testdata/sub/b.txt": "world!",
+		"single.txt":         "abc",
+	})
+	if err := os.Symlink("a.txt", filepath.Join(dir, "testdata", "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	paths := []uploadPath{
+		{src: filepath.Join(dir, "testdata"), dst: "testdata"},
+		{src: filepath.Join(dir, "single.txt"), dst: "single.txt"},
+	}
+
+	have, err := uploadSize(paths)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(5 + 6 + 3); have != want {
+		t.Errorf("have: %d; want: %d", have, want)
+	}
+}
+
+func TestParseWcOutput(t *testing.T) {
+	testCases := []struct {
+		name    string
+		out     string
+		want    []remoteFile
+		wantErr string
+	}{
+		{
+			name: "empty",
+			out:  "",
+		},
+		{
+			name: "single file",
+			out:  "5 ./a.txt\n",
+			want: []remoteFile{{name: "a.txt", size: 5}},
+		},
+		{
+			name: "padded, with total",
+			out:  "       5 ./a.txt\n      12 ./sub/b c.txt\n      17 total\n",
+			want: []remoteFile{{name: "a.txt", size: 5}, {name: "sub/b c.txt", size: 12}},
+		},
+		{
+			name:    "unexpected",
+			out:     "five ./a.txt\n",
+			wantErr: `wc: unexpected output: "five ./a.txt"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			files, err := parseWcOutput(tc.out)
+
+			have := "<no error>"
+			if err != nil {
+				have = err.Error()
+			}
+			wantErr := tc.wantErr
+			if wantErr == "" {
+				wantErr = "<no error>"
+			}
+			if have != wantErr {
+				t.Errorf("error: have: %s; want: %s", have, wantErr)
+			}
+			if diff := cmp.Diff(files, tc.want, cmp.AllowUnexported(remoteFile{})); diff != "" {
+				t.Errorf("\nfiles mismatch (-have, +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTreeTransferTimeout(t *testing.T) {
+	sshConfig, home := startShellServer(t)
+	// A tar that stalls, as on a stuck target.
+	shims := t.TempDir()
+	writeFiles(t, shims, map[string]string{"tar": "#!/bin/sh\nexec sleep 5\n"})
+	if err := os.Chmod(filepath.Join(shims, "tar"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", shims+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	sut := SshCmd{SshConfig: sshConfig, opts: Opts{logger: hclog.NewNullLogger()}}
+	if err := sut.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	defer sut.target.Close()
+	conn, err := sut.target.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	localDir := t.TempDir()
+	writeFiles(t, localDir, map[string]string{"a.txt": "hello"})
+	var sizes []int64
+	timeout := func(size int64) time.Duration {
+		sizes = append(sizes, size)
+		return 200 * time.Millisecond
+	}
+
+	errs := []error{
+		uploadTree(conn, nil, home,
+			[]uploadPath{{src: filepath.Join(localDir, "a.txt"), dst: "a.txt"}}, timeout),
+		downloadTree(conn, nil, home,
+			[]remoteFile{{name: "a.txt", size: 5}, {name: "b.txt", size: 7}}, localDir, timeout),
+	}
+
+	for _, err := range errs {
+		have := "<no error>"
+		if err != nil {
+			have = err.Error()
+		}
+		if want := "timeout 200ms expired"; !strings.HasSuffix(have, want) {
+			t.Errorf("error: have: %s; want suffix: %s", have, want)
+		}
+	}
+	if diff := cmp.Diff(sizes, []int64{5, 12}); diff != "" {
+		t.Errorf("\nsizes mismatch (-have, +want)\n%s", diff)
+	}
+}